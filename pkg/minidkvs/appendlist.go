@@ -0,0 +1,54 @@
+package minidkvs
+
+// AppendList is a replicated grow-only list. Each entry is its own key,
+// prefix+NextID(prefix), written once and never changed, so entries appended
+// on different nodes never conflict and lists merge by union.
+//
+// Entries are ordered by ID, which is roughly the time they were appended.
+// An entry from a node that was offline can sort before entries already read,
+// so an index only stays put once every node's entries up to it have arrived.
+type AppendList struct {
+	db     *Database
+	prefix string
+}
+
+// NewAppendList is ctor for AppendList.
+func NewAppendList(db *Database, prefix string) *AppendList {
+	return &AppendList{db: db, prefix: prefix}
+}
+
+// Append adds content to the end of the list and returns its ID.
+func (l *AppendList) Append(content []byte) (string, error) {
+	id, err := l.db.NextID(l.prefix)
+	if err != nil {
+		return "", err
+	}
+	return id, l.db.Set(l.prefix+id, content)
+}
+
+// Len returns how many entries the list has. It needs a KeyLister storage.
+func (l *AppendList) Len() (int, error) {
+	n, err := l.db.Count(l.prefix)
+	return int(n), err
+}
+
+// ReadFrom returns the entries from index onwards, oldest first. It needs a
+// KeyLister storage.
+func (l *AppendList) ReadFrom(index int) ([][]byte, error) {
+	deltas, err := l.db.dumpLive(l.prefix)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(deltas) {
+		return [][]byte{}, nil
+	}
+
+	entries := make([][]byte, 0, len(deltas)-index)
+	for _, delta := range deltas[index:] {
+		entries = append(entries, delta.Value.Content)
+	}
+	return entries, nil
+}
@@ -0,0 +1,45 @@
+package minidkvs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendListMerges(t *testing.T) {
+	a, _ := NewMemoryDatabase()
+	defer a.Close()
+	b, _ := NewMemoryDatabase()
+	defer b.Close()
+
+	listA, listB := NewAppendList(a, "events/"), NewAppendList(b, "events/")
+	listA.Append([]byte("a1"))
+	listA.Append([]byte("a2"))
+	listB.Append([]byte("b1"))
+
+	syncAll(t, a, b)
+
+	for _, list := range []*AppendList{listA, listB} {
+		if n, _ := list.Len(); n != 3 {
+			t.Errorf("Expected 3 entries but got %d", n)
+		}
+		entries, err := list.ReadFrom(1)
+		if err != nil || len(entries) != 2 {
+			t.Fatal("Expected the last two entries")
+		}
+	}
+
+	all, _ := listA.ReadFrom(0)
+	other, _ := listB.ReadFrom(0)
+	if !bytes.Equal(bytes.Join(all, nil), bytes.Join(other, nil)) {
+		t.Error("Both nodes should agree on the order")
+	}
+	fromA := [][]byte{}
+	for _, entry := range all {
+		if entry[0] == 'a' {
+			fromA = append(fromA, entry)
+		}
+	}
+	if string(bytes.Join(fromA, nil)) != "a1a2" {
+		t.Error("Entries from one node should keep their order")
+	}
+}
@@ -0,0 +1,215 @@
+package minidkvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one write. It says who wrote which key and when, but not
+// the content.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor,omitempty"`
+	Key        string    `json:"key"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Remote     bool      `json:"remote,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	Version    int       `json:"version"`
+	ModifiedBy NodeID    `json:"modifiedBy"`
+	ModifiedAt int64     `json:"modifiedAt"`
+}
+
+// AuditLog is interface for an append-only record of writes.
+type AuditLog interface {
+	Append(entry AuditEntry) error
+}
+
+// audit appends change to Options.AuditLog. Only called from the message loop.
+func (d *Database) audit(change Change) error {
+	if d.options.AuditLog == nil {
+		return nil
+	}
+	return d.options.AuditLog.Append(AuditEntry{
+		Time:       time.Now(),
+		Actor:      change.Actor,
+		Key:        change.Key,
+		Deleted:    change.Value.Deleted,
+		Remote:     change.Remote,
+		Group:      change.Group,
+		Version:    change.Value.Version,
+		ModifiedBy: change.Value.ModifiedBy,
+		ModifiedAt: change.Value.ModifiedAt,
+	})
+}
+
+// FileAuditLog writes entries as JSON lines to Path. Once the file reaches
+// MaxBytes it is renamed with a timestamp suffix and a new one is started.
+// It is safe for concurrent use.
+type FileAuditLog struct {
+	Path string
+
+	// MaxBytes is the size at which the file is rotated. Zero never rotates.
+	MaxBytes int64
+
+	// MaxFiles is how many rotated files to keep. Zero keeps them all.
+	MaxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Append writes entry, rotating first if the file is full.
+func (l *FileAuditLog) Append(entry AuditEntry) error {
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != nil && l.MaxBytes > 0 && l.size+int64(len(line)) > l.MaxBytes && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the current file. Appending afterwards reopens it.
+func (l *FileAuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Export writes every entry, oldest first, from the rotated files followed by
+// the current one.
+func (l *FileAuditLog) Export(w io.Writer) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	files, err := l.rotated()
+	if err != nil {
+		return err
+	}
+	files = append(files, l.Path)
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entries reads back every entry in the same order as Export.
+func (l *FileAuditLog) Entries() ([]AuditEntry, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(l.Export(pw))
+	}()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			pr.CloseWithError(err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (l *FileAuditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file aside and prunes old ones. The next Append
+// opens a fresh file.
+func (l *FileAuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	l.size = 0
+
+	name := fmt.Sprintf("%s.%s", l.Path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(l.Path, name); err != nil {
+		return err
+	}
+
+	if l.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := l.rotated()
+	if err != nil {
+		return err
+	}
+	for len(files) > l.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// rotated lists the rotated files oldest first. The timestamp suffix sorts in
+// time order.
+func (l *FileAuditLog) rotated() ([]string, error) {
+	matches, err := filepath.Glob(l.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
@@ -0,0 +1,138 @@
+package minidkvs
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogRecordsWrites(t *testing.T) {
+	log := &FileAuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	defer log.Close()
+
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{AuditLog: log})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.SetWithOptions("a", []byte("secret"), WriteOptions{Actor: "alice"}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal("Failed to delete value")
+	}
+	if err := db.ReceiveRemote(remoteDelta("b", []byte{1}, 100)); err != nil {
+		t.Fatal("Failed to receive delta")
+	}
+
+	entries, err := log.Entries()
+	if err != nil {
+		t.Fatal("Failed to read audit log")
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries but got %d", len(entries))
+	}
+	if entries[0].Key != "a" || entries[0].Actor != "alice" || entries[0].Deleted {
+		t.Error("First entry should be alice's write")
+	}
+	if !entries[1].Deleted {
+		t.Error("Second entry should be the delete")
+	}
+	if entries[2].Key != "b" || !entries[2].Remote {
+		t.Error("Third entry should be the replicated write")
+	}
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	dir := t.TempDir()
+	log := &FileAuditLog{Path: filepath.Join(dir, "audit.log"), MaxBytes: 200, MaxFiles: 2}
+	defer log.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := log.Append(AuditEntry{Key: "k", Actor: "bob"}); err != nil {
+			t.Fatal("Failed to append entry")
+		}
+	}
+
+	rotated, err := log.rotated()
+	if err != nil {
+		t.Fatal("Failed to list rotated files")
+	}
+	if len(rotated) != 2 {
+		t.Errorf("Expected 2 rotated files to be kept but got %d", len(rotated))
+	}
+
+	entries, err := log.Entries()
+	if err != nil {
+		t.Fatal("Failed to read audit log")
+	}
+	if len(entries) == 0 || len(entries) >= 20 {
+		t.Errorf("Expected pruning to drop some entries but got %d", len(entries))
+	}
+}
+
+func TestActorReplicates(t *testing.T) {
+	log := &FileAuditLog{Path: filepath.Join(t.TempDir(), "audit.log")}
+	defer log.Close()
+
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	b, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{AuditLog: log})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+
+	if _, err := a.SetWithOptions("k", []byte{1}, WriteOptions{Actor: "alice"}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	value, _ := a.GetRemote("k")
+	if value.Actor != "alice" {
+		t.Error("Actor should be stored with the value")
+	}
+	if err := b.ReceiveRemote(&Delta{Key: "k", Value: value}); err != nil {
+		t.Fatal("Failed to receive delta")
+	}
+
+	entries, err := log.Entries()
+	if err != nil || len(entries) != 1 {
+		t.Fatal("Expected one audit entry")
+	}
+	if entries[0].Actor != "alice" || !entries[0].Remote {
+		t.Error("Replicated write should be attributed to its actor")
+	}
+}
+
+// failingAuditLog refuses every entry.
+type failingAuditLog struct{}
+
+func (failingAuditLog) Append(AuditEntry) error { return errors.New("disk full") }
+
+func TestAuditFailureDoesNotFailWrite(t *testing.T) {
+	var failed []string
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{
+		AuditLog:     failingAuditLog{},
+		OnAuditError: func(key string, err error) { failed = append(failed, key) },
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if err := db.Set("k", []byte{1}); err != nil {
+		t.Fatal("Write that reached storage should succeed")
+	}
+	if res, _ := db.Get("k"); !res.HasValue {
+		t.Error("Value should be stored")
+	}
+	if stats := db.Stats(); stats.AuditFailures != 1 {
+		t.Errorf("Expected one audit failure but got %d", stats.AuditFailures)
+	}
+	if len(failed) != 1 || failed[0] != "k" {
+		t.Error("OnAuditError should be called with the key")
+	}
+}
@@ -0,0 +1,246 @@
+package minidkvs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBackupCorrupt is returned when a backup doesn't match its checksum.
+var ErrBackupCorrupt = errors.New("minidkvs: backup checksum mismatch")
+
+// BackupDestination is interface for wherever backups are kept (a local
+// directory, an object store...). Names sort oldest first.
+type BackupDestination interface {
+	Write(name string, data []byte) error
+	Read(name string) ([]byte, error)
+	List() ([]string, error)
+	Remove(name string) error
+}
+
+// DirDestination keeps backups as files in a local directory.
+type DirDestination struct {
+	Dir string
+}
+
+// Write creates the file atomically by writing to a temp file first.
+func (d *DirDestination) Write(name string, data []byte) error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.Dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.Dir, name))
+}
+
+// Read reads a whole file.
+func (d *DirDestination) Read(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.Dir, name))
+}
+
+// List returns every finished file in sorted order.
+func (d *DirDestination) List() ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Remove deletes a file.
+func (d *DirDestination) Remove(name string) error {
+	return os.Remove(filepath.Join(d.Dir, name))
+}
+
+// BackupOptions configures a BackupManager.
+type BackupOptions struct {
+	Destination BackupDestination
+
+	// Interval between scheduled backups. Zero disables the schedule so
+	// backups only happen through BackupNow.
+	Interval time.Duration
+
+	// Retain is how many backups to keep. Zero keeps all of them.
+	Retain int
+
+	// OnError is called with failures of scheduled backups.
+	OnError func(err error)
+}
+
+// BackupManager takes snapshots of a Database into a BackupDestination on a
+// schedule, prunes old ones and verifies them. Each backup is a snapshot file
+// plus a ".sha256" file holding its checksum.
+type BackupManager struct {
+	db      *Database
+	options BackupOptions
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+const (
+	backupPrefix   = "backup-"
+	backupSuffix   = ".jsonl"
+	checksumSuffix = ".sha256"
+)
+
+// NewBackupManager is ctor for BackupManager. Scheduled backups run until
+// Stop is called.
+func NewBackupManager(db *Database, options BackupOptions) *BackupManager {
+	b := &BackupManager{
+		db:      db,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.schedule()
+	return b
+}
+
+// Stop ends scheduled backups and waits for one in progress to finish.
+func (b *BackupManager) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+func (b *BackupManager) schedule() {
+	defer close(b.done)
+	if b.options.Interval <= 0 {
+		<-b.stop
+		return
+	}
+
+	ticker := time.NewTicker(b.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if _, err := b.BackupNow(); err != nil && b.options.OnError != nil {
+				b.options.OnError(err)
+			}
+		}
+	}
+}
+
+// BackupNow takes a backup immediately, prunes beyond Retain and returns the
+// new backup's name.
+func (b *BackupManager) BackupNow() (string, error) {
+	var buf bytes.Buffer
+	if err := b.db.Snapshot(&buf); err != nil {
+		return "", err
+	}
+
+	name, err := writeBackup(b.options.Destination, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return name, b.prune()
+}
+
+// writeBackup stores a snapshot in dest with its checksum and returns the
+// backup's name.
+func writeBackup(dest BackupDestination, data []byte) (string, error) {
+	name := fmt.Sprintf("%s%020d%s", backupPrefix, time.Now().UnixNano(), backupSuffix)
+	sum := sha256.Sum256(data)
+
+	if err := dest.Write(name, data); err != nil {
+		return "", err
+	}
+	if err := dest.Write(name+checksumSuffix, []byte(hex.EncodeToString(sum[:]))); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Backups lists the names of all backups, oldest first.
+func (b *BackupManager) Backups() ([]string, error) {
+	names, err := b.options.Destination.List()
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	return backups, nil
+}
+
+// Verify checks a backup against its checksum.
+func (b *BackupManager) Verify(name string) error {
+	_, err := b.read(name)
+	return err
+}
+
+// RestoreFrom verifies a backup and merges it into the database.
+func (b *BackupManager) RestoreFrom(name string) error {
+	data, err := b.read(name)
+	if err != nil {
+		return err
+	}
+	return b.db.Restore(bytes.NewReader(data))
+}
+
+func (b *BackupManager) read(name string) ([]byte, error) {
+	dest := b.options.Destination
+	data, err := dest.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := dest.Read(name + checksumSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != string(checksum) {
+		return nil, ErrBackupCorrupt
+	}
+	return data, nil
+}
+
+func (b *BackupManager) prune() error {
+	if b.options.Retain <= 0 {
+		return nil
+	}
+
+	backups, err := b.Backups()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > b.options.Retain {
+		dest := b.options.Destination
+		if err := dest.Remove(backups[0]); err != nil {
+			return err
+		}
+		if err := dest.Remove(backups[0] + checksumSuffix); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package minidkvs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupManager(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	dest := &DirDestination{Dir: t.TempDir()}
+	backups := NewBackupManager(db, BackupOptions{Destination: dest, Retain: 2})
+	defer backups.Stop()
+
+	db.Set("a", []byte{1})
+	db.Set("b", []byte{2})
+	db.Delete("b")
+
+	for i := 0; i < 3; i++ {
+		if _, err := backups.BackupNow(); err != nil {
+			t.Fatal("Failed to back up")
+		}
+	}
+
+	names, err := backups.Backups()
+	if err != nil || len(names) != 2 {
+		t.Fatal("Retention should keep two backups")
+	}
+	if err := backups.Verify(names[1]); err != nil {
+		t.Error("Fresh backup should verify")
+	}
+
+	restored, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer restored.Close()
+	restoring := NewBackupManager(restored, BackupOptions{Destination: dest})
+	defer restoring.Stop()
+
+	if err := restoring.RestoreFrom(names[1]); err != nil {
+		t.Fatal("Failed to restore backup")
+	}
+	if res, _ := restored.Get("a"); !res.HasValue || res.Value[0] != 1 {
+		t.Error("Restored database missing value")
+	}
+	if res, _ := restored.Get("b"); res.HasValue {
+		t.Error("Restored database resurrected deleted value")
+	}
+
+	os.WriteFile(filepath.Join(dest.Dir, names[0]), []byte("junk"), 0644)
+	if err := backups.Verify(names[0]); err != ErrBackupCorrupt {
+		t.Error("Tampered backup should fail verification")
+	}
+}
+
+func TestScheduledBackups(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	options := BackupOptions{
+		Destination: &DirDestination{Dir: t.TempDir()},
+		Interval:    10 * time.Millisecond,
+	}
+	backups := NewBackupManager(db, options)
+	defer backups.Stop()
+
+	if !waitFor(func() bool { names, _ := backups.Backups(); return len(names) > 0 }) {
+		t.Error("Scheduled backup never ran")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	db.Set("k", []byte("old"))
+	db.Close()
+
+	upper := Migration{Version: 1, Name: "upper", Migrate: func(s Storage) error {
+		value, err := s.Get("k")
+		if err != nil {
+			return err
+		}
+		value.Content = []byte("OLD")
+		return s.Set("k", value)
+	}}
+	dest := &DirDestination{Dir: t.TempDir()}
+	options := Options{Migrations: []Migration{upper}, MigrationBackup: dest}
+
+	db, err = NewDatabaseWithOptions(storage, options)
+	if err != nil {
+		t.Fatal("Failed to open with migrations")
+	}
+	if res, _ := db.Get("k"); string(res.Value) != "OLD" {
+		t.Error("Migration should have run at open")
+	}
+	db.Close()
+
+	backups := NewBackupManager(db, BackupOptions{Destination: dest})
+	defer backups.Stop()
+	if names, err := backups.Backups(); err != nil || len(names) != 1 || backups.Verify(names[0]) != nil {
+		t.Error("Expected one verified backup taken before migrating")
+	}
+
+	db, err = NewDatabaseWithOptions(storage, options)
+	if err != nil {
+		t.Fatal("Failed to reopen")
+	}
+	db.Close()
+	if names, _ := backups.Backups(); len(names) != 1 {
+		t.Error("Migrations shouldn't run again once applied")
+	}
+
+	if _, err := NewDatabaseWithOptions(storage, Options{Migrations: []Migration{{Version: 0}}}); err != ErrSchemaTooNew {
+		t.Error("Expected older build to refuse newer schema")
+	}
+	db, err = NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Storage should be released after a failed open")
+	}
+	db.Close()
+}
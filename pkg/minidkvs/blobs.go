@@ -0,0 +1,193 @@
+package minidkvs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// BlobChunkPrefix is where Blobs keeps chunks. Each chunk is stored under this
+// prefix followed by the hex SHA-256 of its content.
+const BlobChunkPrefix = ReservedPrefix + "blob/chunk/"
+
+// DefaultBlobChunkSize is the chunk size used when NewBlobs is given zero.
+const DefaultBlobChunkSize = 64 * 1024
+
+// ErrBlobIncomplete is returned when a blob references a chunk that isn't on
+// this node yet, usually because replication hasn't caught up.
+var ErrBlobIncomplete = errors.New("minidkvs: blob chunk missing")
+
+// ErrBlobCorrupt is returned when a chunk's content doesn't match its hash.
+var ErrBlobCorrupt = errors.New("minidkvs: blob chunk corrupt")
+
+// Blobs stores large values as content-addressed chunks with a small manifest
+// under the blob's own key. Since every chunk is an ordinary key, replicas only
+// ever transfer chunks they don't have and identical chunks are stored once no
+// matter how many blobs use them. Chunks are never removed, even when no blob
+// references them any more.
+type Blobs struct {
+	db        *Database
+	chunkSize int
+}
+
+// blobManifest is the value stored under a blob's key.
+type blobManifest struct {
+	Size   int
+	Chunks []string
+}
+
+// NewBlobs is ctor for Blobs. A chunkSize of zero uses DefaultBlobChunkSize.
+func NewBlobs(db *Database, chunkSize int) *Blobs {
+	if chunkSize <= 0 {
+		chunkSize = DefaultBlobChunkSize
+	}
+	return &Blobs{db: db, chunkSize: chunkSize}
+}
+
+// Put splits data into chunks, writes any chunk not already present and then
+// points key at them.
+func (b *Blobs) Put(key string, data []byte) error {
+	return b.PutReader(key, bytes.NewReader(data))
+}
+
+// PutReader is Put reading the content from r one chunk at a time, so the
+// whole blob is never held in memory.
+func (b *Blobs) PutReader(key string, r io.Reader) error {
+	var manifest blobManifest
+	buf := make([]byte, b.chunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunkKey, putErr := b.putChunk(buf[:n])
+			if putErr != nil {
+				return putErr
+			}
+			manifest.Chunks = append(manifest.Chunks, chunkKey)
+			manifest.Size += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.db.SetJSON(key, manifest)
+}
+
+// putChunk writes chunk under its hash unless it's already there and returns
+// the key it lives under.
+func (b *Blobs) putChunk(chunk []byte) (string, error) {
+	hash := sha256.Sum256(chunk)
+	chunkKey := BlobChunkPrefix + hex.EncodeToString(hash[:])
+
+	res, err := b.db.Get(chunkKey)
+	if err != nil {
+		return "", err
+	}
+	if res.HasValue {
+		return chunkKey, nil
+	}
+
+	// Chunks are copied since the caller's buffer is reused for the next one.
+	return chunkKey, b.db.Set(chunkKey, append([]byte(nil), chunk...))
+}
+
+// getChunk reads a chunk and verifies it against its hash.
+func (b *Blobs) getChunk(chunkKey string) ([]byte, error) {
+	res, err := b.db.Get(chunkKey)
+	if err != nil {
+		return nil, err
+	}
+	if !res.HasValue {
+		return nil, ErrBlobIncomplete
+	}
+
+	hash := sha256.Sum256(res.Value)
+	if chunkKey != BlobChunkPrefix+hex.EncodeToString(hash[:]) {
+		return nil, ErrBlobCorrupt
+	}
+	return res.Value, nil
+}
+
+// Get reassembles the blob under key, verifying each chunk against its hash. A
+// missing key returns false like Get.
+func (b *Blobs) Get(key string) ([]byte, bool, error) {
+	r, found, err := b.GetReader(key)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) != r.size {
+		return nil, false, ErrBlobCorrupt
+	}
+	return data, true, nil
+}
+
+// GetReader returns a reader over the blob under key that fetches and verifies
+// one chunk at a time. A missing key returns false like Get.
+func (b *Blobs) GetReader(key string) (*BlobReader, bool, error) {
+	var manifest blobManifest
+	found, err := b.db.GetJSON(key, &manifest)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return &BlobReader{blobs: b, chunks: manifest.Chunks, size: manifest.Size}, true, nil
+}
+
+// BlobReader streams a blob's content chunk by chunk.
+type BlobReader struct {
+	blobs   *Blobs
+	chunks  []string
+	size    int
+	current []byte
+}
+
+// Read implements io.Reader.
+func (r *BlobReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk, err := r.blobs.getChunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+		r.current = chunk
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close implements io.Closer. There is nothing to release.
+func (r *BlobReader) Close() error {
+	return nil
+}
+
+// SetReader stores the content of r under key without reading it all into
+// memory. The value is kept as a blob (see Blobs) so it must be read back with
+// GetReader rather than Get.
+func (d *Database) SetReader(key string, r io.Reader) error {
+	return NewBlobs(d, 0).PutReader(key, r)
+}
+
+// GetReader streams a value written by SetReader. A missing key returns a nil
+// reader and nil error.
+func (d *Database) GetReader(key string) (io.ReadCloser, error) {
+	r, found, err := NewBlobs(d, 0).GetReader(key)
+	if err != nil || !found {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,79 @@
+package minidkvs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestBlobs(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	blobs := NewBlobs(db, 4)
+	data := []byte("aaaabbbbaaaac")
+
+	if err := blobs.Put("file", data); err != nil {
+		t.Fatal("Failed to put blob")
+	}
+	if err := blobs.Put("copy", data); err != nil {
+		t.Fatal("Failed to put duplicate blob")
+	}
+
+	out, found, err := blobs.Get("copy")
+	if err != nil || !found || !bytes.Equal(out, data) {
+		t.Error("Blob read back wrong")
+	}
+
+	var manifest blobManifest
+	db.GetJSON("file", &manifest)
+	if len(manifest.Chunks) != 4 || manifest.Chunks[0] != manifest.Chunks[2] {
+		t.Error("Identical chunks should share a key")
+	}
+
+	db.Set(manifest.Chunks[1], []byte("xxxx"))
+	if _, _, err := blobs.Get("file"); err != ErrBlobCorrupt {
+		t.Error("Tampered chunk should be detected")
+	}
+
+	db.Delete(manifest.Chunks[1])
+	if _, _, err := blobs.Get("file"); err != ErrBlobIncomplete {
+		t.Error("Missing chunk should be reported")
+	}
+
+	if _, found, err := blobs.Get("nothing"); found || err != nil {
+		t.Error("Missing blob should not be found")
+	}
+}
+
+func TestStreamingValues(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), DefaultBlobChunkSize/4)
+	if err := db.SetReader("big", bytes.NewReader(data)); err != nil {
+		t.Fatal("Failed to set from reader")
+	}
+
+	r, err := db.GetReader("big")
+	if err != nil || r == nil {
+		t.Fatal("Failed to get reader")
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Error("Streamed value read back wrong")
+	}
+
+	r, err = db.GetReader("missing")
+	if err != nil || r != nil {
+		t.Error("Missing key should give nil reader")
+	}
+}
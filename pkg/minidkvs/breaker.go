@@ -0,0 +1,81 @@
+package minidkvs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStorageUnavailable is returned without touching storage while the circuit
+// breaker is open after repeated storage failures.
+var ErrStorageUnavailable = errors.New("minidkvs: storage unavailable")
+
+// DefaultBreakerBackoff is the first wait before retrying storage when
+// Options.BreakerBackoff is zero.
+const DefaultBreakerBackoff = time.Second
+
+// maxBreakerBackoff caps how far the wait between retries grows.
+const maxBreakerBackoff = time.Minute
+
+// breaker is a circuit breaker around storage. Only used from the message loop.
+//
+// After threshold consecutive failures it opens: storage calls fail straight
+// away with ErrStorageUnavailable. Once the backoff has passed the next call
+// is let through as a probe. Success closes the breaker and failure reopens
+// it with double the backoff.
+type breaker struct {
+	threshold int
+	failures  int
+	open      bool
+	backoff   time.Duration
+	initial   time.Duration
+	retryAt   time.Time
+}
+
+func newBreaker(threshold int, backoff time.Duration) breaker {
+	if backoff <= 0 {
+		backoff = DefaultBreakerBackoff
+	}
+	return breaker{threshold: threshold, initial: backoff, backoff: backoff}
+}
+
+// allow reports whether a storage call may go ahead.
+func (b *breaker) allow(now time.Time) bool {
+	return !b.open || !now.Before(b.retryAt)
+}
+
+// result records the outcome of a storage call that allow let through.
+func (b *breaker) result(now time.Time, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		b.open = false
+		b.backoff = b.initial
+		return
+	}
+
+	b.failures++
+	if b.open {
+		b.backoff *= 2
+		if b.backoff > maxBreakerBackoff {
+			b.backoff = maxBreakerBackoff
+		}
+	}
+	if b.open || b.failures >= b.threshold {
+		b.open = true
+		b.retryAt = now.Add(b.backoff)
+	}
+}
+
+// guard runs a storage call through the breaker.
+func (d *Database) guard(call func() error) error {
+	now := time.Now()
+	if !d.breaker.allow(now) {
+		return ErrStorageUnavailable
+	}
+	err := call()
+	d.breaker.result(time.Now(), err)
+	return err
+}
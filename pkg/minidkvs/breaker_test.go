@@ -0,0 +1,149 @@
+package minidkvs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyStorage fails every call while broken is set.
+type flakyStorage struct {
+	*MemoryStorage
+	broken bool
+	calls  int
+}
+
+func (f *flakyStorage) Get(key string) (*Value, error) {
+	f.calls++
+	if f.broken {
+		return nil, errors.New("disk on fire")
+	}
+	return f.MemoryStorage.Get(key)
+}
+
+func TestBreaker(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: mustMemoryStorage(t), broken: true}
+	options := Options{BreakerThreshold: 2, BreakerBackoff: 20 * time.Millisecond}
+	db, err := NewDatabaseWithOptions(storage, options)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Get("k")
+	db.Get("k")
+	if db.Stats().StorageHealthy {
+		t.Error("Storage should be unhealthy after two failures")
+	}
+
+	calls := storage.calls
+	if _, err := db.Get("k"); err != ErrStorageUnavailable {
+		t.Error("Open breaker should fail fast")
+	}
+	if err := db.ReceiveRemote(remoteDelta("k", []byte{1}, 100)); err != ErrStorageUnavailable {
+		t.Error("Open breaker should refuse deltas")
+	}
+	if storage.calls != calls {
+		t.Error("Open breaker should not call storage")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := db.Get("k"); err == nil || err == ErrStorageUnavailable {
+		t.Error("Probe after backoff should reach storage")
+	}
+	if db.Stats().StorageHealthy {
+		t.Error("Failed probe should keep the breaker open")
+	}
+
+	storage.broken = false
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("k"); err != nil {
+		t.Error("Probe should succeed once storage recovers")
+	}
+	if !db.Stats().StorageHealthy {
+		t.Error("Successful probe should close the breaker")
+	}
+}
+
+// hangingStorage blocks every Get until release is closed.
+type hangingStorage struct {
+	*MemoryStorage
+	release chan struct{}
+}
+
+func (h *hangingStorage) Get(key string) (*Value, error) {
+	<-h.release
+	return h.MemoryStorage.Get(key)
+}
+
+func TestOperationTimeout(t *testing.T) {
+	storage := &hangingStorage{MemoryStorage: mustMemoryStorage(t), release: make(chan struct{})}
+	db, err := NewDatabaseWithOptions(storage, Options{OperationTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.Get("k"); err != ErrTimeout {
+		t.Error("Hung storage should time out")
+	}
+	if err := db.Set("k", []byte{1}); err != ErrTimeout {
+		t.Error("Calls queued behind hung storage should time out")
+	}
+
+	close(storage.release)
+	if err := db.Set("k", []byte{2}); err != nil {
+		t.Error("Database should recover once storage answers")
+	}
+}
+
+// panickingStorage panics on Get of "boom".
+type panickingStorage struct {
+	*MemoryStorage
+}
+
+func (p *panickingStorage) Get(key string) (*Value, error) {
+	if key == "boom" {
+		panic("storage bug")
+	}
+	return p.MemoryStorage.Get(key)
+}
+
+func TestPanicInLoopFailsCalls(t *testing.T) {
+	db, err := NewDatabase(&panickingStorage{MemoryStorage: mustMemoryStorage(t)})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.Get("boom"); !errors.Is(err, ErrInternal) {
+		t.Error("Call that panicked should get ErrInternal")
+	}
+	if err := db.Set("k", []byte{1}); !errors.Is(err, ErrInternal) {
+		t.Error("Later calls should get ErrInternal")
+	}
+	if db.Health(time.Second).Live() {
+		t.Error("Failed database should not be live")
+	}
+}
+
+func TestCloseContextGivesUp(t *testing.T) {
+	storage := &hangingStorage{MemoryStorage: mustMemoryStorage(t), release: make(chan struct{})}
+	db, err := NewDatabaseWithOptions(storage, Options{OperationTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	db.Get("k")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Error("CloseContext should give up while storage hangs")
+	}
+
+	close(storage.release)
+	if err := db.Close(); err != nil {
+		t.Error("Close should finish once storage answers")
+	}
+}
@@ -0,0 +1,126 @@
+package minidkvs
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Publisher is interface for a message broker such as NATS or MQTT. Adapting a
+// broker client is usually a one-line method calling its publish function.
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+// BridgeRoute maps keys under Prefix to topics under Topic. The rest of the key
+// after the prefix is appended to Topic, with "/" replaced by the bridge's
+// separator.
+type BridgeRoute struct {
+	Prefix string
+	Topic  string
+}
+
+// BridgeOptions configures an EventBridge.
+type BridgeOptions struct {
+	// Routes are tried in order and the first matching prefix wins. Keys
+	// matching no route are not published.
+	Routes []BridgeRoute
+
+	// Separator joins topic levels: "." for NATS, "/" (the default) for MQTT.
+	Separator string
+
+	// OnError is called when publishing fails. The event is not retried.
+	OnError func(err error)
+}
+
+// BridgeEvent is the JSON payload published for each change.
+type BridgeEvent struct {
+	Key        string
+	Content    []byte
+	Deleted    bool
+	Version    int
+	ModifiedBy NodeID
+	ModifiedAt int64
+	Remote     bool
+}
+
+// EventBridge publishes every change in a Database to a message broker.
+type EventBridge struct {
+	publisher Publisher
+	options   BridgeOptions
+	watcher   *Watcher
+	done      chan struct{}
+}
+
+// NewEventBridge is ctor for EventBridge. Publishing starts straight away and
+// continues until Close.
+func NewEventBridge(db *Database, publisher Publisher, options BridgeOptions) (*EventBridge, error) {
+	if options.Separator == "" {
+		options.Separator = "/"
+	}
+
+	watcher, err := db.Watch("")
+	if err != nil {
+		return nil, err
+	}
+	b := &EventBridge{
+		publisher: publisher,
+		options:   options,
+		watcher:   watcher,
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// Close stops publishing and waits for the event in flight.
+func (b *EventBridge) Close() {
+	b.watcher.Close()
+	<-b.done
+}
+
+func (b *EventBridge) run() {
+	defer close(b.done)
+	for change := range b.watcher.Changes {
+		topic, ok := b.topic(change.Key)
+		if !ok {
+			continue
+		}
+
+		event := BridgeEvent{
+			Key:        change.Key,
+			Content:    change.Value.Content,
+			Deleted:    change.Value.Deleted,
+			Version:    change.Value.Version,
+			ModifiedBy: change.Value.ModifiedBy,
+			ModifiedAt: change.Value.ModifiedAt,
+			Remote:     change.Remote,
+		}
+		payload, err := json.Marshal(&event)
+		if err == nil {
+			err = b.publisher.Publish(topic, payload)
+		}
+		if err != nil && b.options.OnError != nil {
+			b.options.OnError(err)
+		}
+	}
+}
+
+// topic derives the topic for key from the first matching route.
+func (b *EventBridge) topic(key string) (string, bool) {
+	for _, route := range b.options.Routes {
+		if !strings.HasPrefix(key, route.Prefix) {
+			continue
+		}
+
+		rest := strings.Trim(strings.TrimPrefix(key, route.Prefix), "/")
+		if rest == "" {
+			return route.Topic, true
+		}
+		rest = strings.ReplaceAll(rest, "/", b.options.Separator)
+		if route.Topic == "" {
+			return rest, true
+		}
+		return route.Topic + b.options.Separator + rest, true
+	}
+	return "", false
+}
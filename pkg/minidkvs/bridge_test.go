@@ -0,0 +1,195 @@
+package minidkvs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type publishedEvent struct {
+	topic   string
+	payload []byte
+}
+
+type chanPublisher chan publishedEvent
+
+func (c chanPublisher) Publish(topic string, payload []byte) error {
+	c <- publishedEvent{topic: topic, payload: payload}
+	return nil
+}
+
+func TestEventBridge(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	published := make(chanPublisher, 10)
+	options := BridgeOptions{
+		Routes:    []BridgeRoute{{Prefix: "sensors/", Topic: "edge.sensors"}},
+		Separator: ".",
+	}
+	bridge, err := NewEventBridge(db, published, options)
+	if err != nil {
+		t.Fatal("Failed to create bridge")
+	}
+	defer bridge.Close()
+
+	db.Set("other", []byte{1})
+	db.Set("sensors/room1/temp", []byte("21"))
+
+	event := <-published
+	if event.topic != "edge.sensors.room1.temp" {
+		t.Error("Wrong topic: " + event.topic)
+	}
+
+	var decoded BridgeEvent
+	if err := json.Unmarshal(event.payload, &decoded); err != nil {
+		t.Fatal("Payload is not JSON")
+	}
+	if decoded.Key != "sensors/room1/temp" || string(decoded.Content) != "21" {
+		t.Error("Payload has wrong content")
+	}
+}
+
+// mapTarget is a MirrorTarget that fails the first failures calls.
+type mapTarget struct {
+	mu       sync.Mutex
+	data     map[string]string
+	failures int
+}
+
+func (m *mapTarget) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("target unavailable")
+	}
+	m.data[key] = string(value)
+	return nil
+}
+
+func (m *mapTarget) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func (m *mapTarget) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.data[key]
+	return value, ok
+}
+
+func TestMirror(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	db.ReceiveRemote(remoteDelta("old", []byte("x"), 100))
+
+	target := &mapTarget{data: make(map[string]string), failures: 2}
+	options := MirrorOptions{RetryBackoff: time.Millisecond}
+	mirror, err := NewMirror(db, "legacy", target, options)
+	if err != nil {
+		t.Fatal("Failed to create mirror")
+	}
+
+	db.Set("b", []byte("2"))
+	db.Delete("a")
+	mirrored := waitFor(func() bool {
+		_, hasA := target.get("a")
+		b, _ := target.get("b")
+		old, _ := target.get("old")
+		return !hasA && b == "2" && old == "x"
+	})
+	mirror.Close()
+	if !mirrored {
+		t.Fatal("Expected every change to reach the target despite failures")
+	}
+
+	if res, _ := db.Get(MirrorCheckpointPrefix + "legacy/" + db.NodeID().String()); !res.HasValue {
+		t.Fatal("Expected a checkpoint to be saved")
+	}
+
+	replayed := &mapTarget{data: make(map[string]string)}
+	mirror, err = NewMirror(db, "legacy", replayed, options)
+	if err != nil {
+		t.Fatal("Failed to create mirror")
+	}
+	db.Set("c", []byte("3"))
+	if !waitFor(func() bool {
+		c, _ := replayed.get("c")
+		return c == "3"
+	}) {
+		t.Error("Expected new writes to be mirrored after a restart")
+	}
+	mirror.Close()
+	if _, ok := replayed.get("old"); ok {
+		t.Error("Writes older than the checkpoint shouldn't be replayed")
+	}
+	if b, _ := replayed.get("b"); b != "2" {
+		t.Error("Writes near the checkpoint should be replayed")
+	}
+}
+
+// sliceFeed is a Feed that returns its records then io.EOF.
+type sliceFeed []FeedRecord
+
+func (f *sliceFeed) Next() (FeedRecord, error) {
+	if len(*f) == 0 {
+		return FeedRecord{}, io.EOF
+	}
+	record := (*f)[0]
+	*f = (*f)[1:]
+	return record, nil
+}
+
+func TestInboundBridge(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	bridge := NewInboundBridge(db, "orders", InboundOptions{KeyPrefix: "orders/"})
+	if offset, err := bridge.Offset("0"); err != nil || offset != -1 {
+		t.Error("Expected no offset before anything is applied")
+	}
+
+	feed := &sliceFeed{
+		{Partition: "0", Offset: 0, Key: "1", Value: []byte("new")},
+		{Partition: "0", Offset: 1, Key: "1", Value: []byte("paid")},
+		{Partition: "1", Offset: 0, Key: "2", Value: []byte("new")},
+	}
+	if err := bridge.Consume(feed); err != io.EOF {
+		t.Fatal("Consume should stop with the feed's error")
+	}
+	if res, _ := db.Get("orders/1"); string(res.Value) != "paid" {
+		t.Errorf("Expected paid but got %q", res.Value)
+	}
+	if offset, _ := bridge.Offset("0"); offset != 1 {
+		t.Errorf("Expected offset 1 but got %d", offset)
+	}
+
+	// Redelivery after a restart must not roll the key back.
+	if applied, err := bridge.Apply(FeedRecord{Partition: "0", Offset: 0, Key: "1", Value: []byte("new")}); err != nil || applied {
+		t.Error("Redelivered record should be skipped")
+	}
+	if applied, _ := bridge.Apply(FeedRecord{Partition: "0", Offset: 2, Key: "1", Deleted: true}); !applied {
+		t.Error("Expected the delete to be applied")
+	}
+	if res, _ := db.Get("orders/1"); res.HasValue {
+		t.Error("Expected the key to be deleted")
+	}
+}
@@ -0,0 +1,70 @@
+package minidkvs
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInternal is returned by every call once the message loop has died from a
+// panic, usually in a Storage implementation. The database can't recover and
+// should be closed and reopened.
+var ErrInternal = errors.New("minidkvs: internal error, database has failed")
+
+// ErrTimeout is returned when an operation doesn't finish within
+// Options.OperationTimeout.
+var ErrTimeout = errors.New("minidkvs: operation timed out")
+
+// DefaultOperationTimeout is used when Options.OperationTimeout is zero.
+const DefaultOperationTimeout = 30 * time.Second
+
+// call passes msg to the message loop and waits for the reply on replyChan,
+// giving up with ErrTimeout after Options.OperationTimeout. Reply channels
+// must be buffered so that the loop never blocks on a caller that gave up.
+func call[T any](d *Database, msg dbMessage, replyChan chan T) (T, error) {
+	var expired <-chan time.Time
+	if timeout := d.operationTimeout(); timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	return exchange(d, msg, replyChan, expired)
+}
+
+// wait is call without the timeout, for calls that have no error to report
+// it with. It still gives up if the loop has stopped, returning the zero T.
+func wait[T any](d *Database, msg dbMessage, replyChan chan T) T {
+	reply, _ := exchange(d, msg, replyChan, nil)
+	return reply
+}
+
+func exchange[T any](d *Database, msg dbMessage, replyChan chan T, expired <-chan time.Time) (T, error) {
+	var zero T
+	atomic.AddInt64(&d.inFlight, 1)
+	defer atomic.AddInt64(&d.inFlight, -1)
+	defer d.slowCall(msg, time.Now())
+
+	select {
+	case d.msgChan <- msg:
+	case <-expired:
+		return zero, ErrTimeout
+	case <-d.stopped:
+		return zero, d.stopErr()
+	}
+
+	select {
+	case reply := <-replyChan:
+		return reply, nil
+	case <-expired:
+		return zero, ErrTimeout
+	case <-d.stopped:
+		return zero, d.stopErr()
+	}
+}
+
+func (d *Database) operationTimeout() time.Duration {
+	if d.options.OperationTimeout == 0 {
+		return DefaultOperationTimeout
+	}
+	return d.options.OperationTimeout
+}
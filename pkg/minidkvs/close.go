@@ -0,0 +1,105 @@
+package minidkvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrClosed is returned by calls made after Close.
+var ErrClosed = errors.New("minidkvs: database is closed")
+
+// StorageOpener is an optional Storage extension for backends that acquire
+// resources (file handles, mmaps, connections) before use. Open is called by
+// NewDatabase before anything else. Backends that hold resources should also
+// implement io.Closer, which Database.Close calls last.
+type StorageOpener interface {
+	Open() error
+}
+
+// StorageFlusher is an optional Storage extension for backends that buffer
+// writes. Flush makes everything written so far durable. It is called by
+// Database.Flush and before the Storage is closed.
+type StorageFlusher interface {
+	Flush() error
+}
+
+// Flush makes every write so far durable when the Storage implements
+// StorageFlusher, and does nothing otherwise.
+func (d *Database) Flush() error {
+	m := dbMessageFlush{errorChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newFlushMessage(&m), m.errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// flushStorage is the in-loop half of Flush.
+func (d *Database) flushStorage() error {
+	if flusher, ok := d.storage.(StorageFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close stops the message loop, waits for it to exit and then flushes and
+// closes the Storage if it implements StorageFlusher and io.Closer.
+// Operations already queued finish first; later calls fail with ErrClosed.
+// Every Watcher's Changes channel is closed. Calling Close again returns the
+// same result. Close should always be called when the database is not going
+// to be used again.
+func (d *Database) Close() error {
+	return d.CloseContext(context.Background())
+}
+
+// CloseContext is Close that stops waiting when ctx is done, for bounded
+// shutdown. The database still closes once the loop gets to it.
+func (d *Database) CloseContext(ctx context.Context) error {
+	d.closeOnce.Do(func() {
+		go func() {
+			select {
+			case d.msgChan <- newCloseMessage():
+			case <-d.stopped:
+			}
+		}()
+	})
+
+	select {
+	case <-d.stopped:
+		return d.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopErr says why calls fail once the loop has stopped.
+func (d *Database) stopErr() error {
+	if d.failure != nil {
+		return d.failure
+	}
+	return ErrClosed
+}
+
+// exitLoop runs as the message loop exits. A panic is recovered so that it
+// doesn't take down the process; every pending and future call fails with
+// ErrInternal instead. Watchers are closed, since no more changes will reach
+// them, and storage is flushed and closed either way since nothing else will
+// touch it; the first error is kept for Close to return.
+func (d *Database) exitLoop() {
+	if r := recover(); r != nil {
+		d.failure = fmt.Errorf("%w: %v", ErrInternal, r)
+	}
+	for _, w := range d.watchers {
+		d.removeWatcher(w)
+	}
+	d.closeErr = d.flushStorage()
+	if closer, ok := d.storage.(io.Closer); ok {
+		if err := closer.Close(); d.closeErr == nil {
+			d.closeErr = err
+		}
+	}
+	releaseStorage(d.storage)
+	close(d.stopped)
+}
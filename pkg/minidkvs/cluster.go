@@ -0,0 +1,76 @@
+package minidkvs
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ReservedPrefix is the namespace for keys minidkvs keeps for itself.
+// Application keys shouldn't start with it.
+const ReservedPrefix = "_minidkvs/"
+
+// ClusterConfigPrefix is reserved for settings that apply to the whole
+// cluster. They replicate like any other key, and every node with
+// Options.ClusterSettings applies a change as soon as it arrives, so limits
+// and GC policy can be changed without restarting nodes. A setting that is
+// deleted or can't be parsed falls back to the node's Options.
+const ClusterConfigPrefix = ReservedPrefix + "config/"
+
+// Names of the settings under ClusterConfigPrefix and the Options field each
+// one overrides.
+const (
+	SettingMaxValueSize     = "max_value_size"
+	SettingMinFreeSpace     = "min_free_space"
+	SettingTombstoneWindow  = "tombstone_window"
+	SettingHistoryRetention = "history_retention"
+)
+
+var clusterSettings = map[string]string{
+	SettingMaxValueSize:     "MaxValueSize",
+	SettingMinFreeSpace:     "MinFreeSpace",
+	SettingTombstoneWindow:  "TombstoneWindow",
+	SettingHistoryRetention: "HistoryRetention",
+}
+
+// ClusterConfig returns the Config for the cluster-wide settings, whose names
+// are the Setting constants.
+func (d *Database) ClusterConfig() *Config {
+	return NewConfig(d, ClusterConfigPrefix)
+}
+
+// loadClusterConfig applies the cluster settings already in storage. One that
+// can't be read keeps its Options value until it next changes. Only called
+// from the message loop.
+func (d *Database) loadClusterConfig() {
+	if !d.options.ClusterSettings {
+		return
+	}
+	for name := range clusterSettings {
+		if value, err := d.storageGet(ClusterConfigPrefix + name); err == nil {
+			d.applySetting(name, value)
+		}
+	}
+}
+
+// applySetting overrides the Options field for a cluster setting with value,
+// or restores what the node was configured with. Only called from the message
+// loop.
+func (d *Database) applySetting(name string, value *Value) {
+	fieldName, ok := clusterSettings[name]
+	if !ok {
+		return
+	}
+	field := reflect.ValueOf(&d.options).Elem().FieldByName(fieldName)
+	configured := reflect.ValueOf(d.configured).FieldByName(fieldName)
+
+	if !isLive(value) || setField(field, string(value.Content)) != nil {
+		field.Set(configured)
+	}
+}
+
+// settingChanged applies key if it is a cluster setting.
+func (d *Database) settingChanged(key string, value *Value) {
+	if d.options.ClusterSettings && strings.HasPrefix(key, ClusterConfigPrefix) {
+		d.applySetting(strings.TrimPrefix(key, ClusterConfigPrefix), value)
+	}
+}
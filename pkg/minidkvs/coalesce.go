@@ -0,0 +1,112 @@
+package minidkvs
+
+import (
+	"sync"
+	"time"
+)
+
+// readKey identifies reads that can share a result.
+type readKey struct {
+	key         string
+	consistency Consistency
+}
+
+// readFlight is a read in progress that later callers can wait on.
+type readFlight struct {
+	done   chan struct{}
+	result GetResult
+	err    error
+}
+
+// readGroup coalesces concurrent reads of the same key for
+// Options.CoalesceReads. The zero value is ready to use.
+type readGroup struct {
+	lock    sync.Mutex
+	flights map[readKey]*readFlight
+}
+
+// do runs read unless one for the same key is already running, in which case
+// it waits for that one and returns its result.
+func (g *readGroup) do(key readKey, read func() (GetResult, error)) (GetResult, error) {
+	g.lock.Lock()
+	if flight, ok := g.flights[key]; ok {
+		g.lock.Unlock()
+		<-flight.done
+		return flight.result, flight.err
+	}
+	if g.flights == nil {
+		g.flights = make(map[readKey]*readFlight)
+	}
+	flight := &readFlight{done: make(chan struct{})}
+	g.flights[key] = flight
+	g.lock.Unlock()
+
+	flight.result, flight.err = read()
+
+	g.lock.Lock()
+	delete(g.flights, key)
+	g.lock.Unlock()
+	close(flight.done)
+
+	return flight.result, flight.err
+}
+
+// maxNegativeCacheEntries bounds the negative cache so that lookups of many
+// distinct missing keys can't grow it without limit.
+const maxNegativeCacheEntries = 10000
+
+// negativeCache remembers keys that storage reported missing, or deleted
+// along with their tombstone, for Options.NegativeCacheTTL. Only used from
+// the message loop.
+type negativeCache struct {
+	ttl     time.Duration
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	tombstone *Value
+	until     time.Time
+}
+
+func newNegativeCache(ttl time.Duration) negativeCache {
+	return negativeCache{ttl: ttl, entries: make(map[string]negativeEntry)}
+}
+
+// get returns the cached tombstone (nil for a missing key) and whether key
+// was cached.
+func (c *negativeCache) get(key string) (*Value, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.until) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.tombstone, true
+}
+
+func (c *negativeCache) put(key string, tombstone *Value) {
+	if c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= maxNegativeCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{tombstone: tombstone, until: now.Add(c.ttl)}
+}
+
+func (c *negativeCache) forget(key string) {
+	delete(c.entries, key)
+}
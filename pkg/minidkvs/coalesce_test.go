@@ -0,0 +1,85 @@
+package minidkvs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingGetStorage counts Get calls and can hold them until released.
+type countingGetStorage struct {
+	*MemoryStorage
+	gets    int32
+	release chan struct{}
+}
+
+func (c *countingGetStorage) Get(key string) (*Value, error) {
+	atomic.AddInt32(&c.gets, 1)
+	<-c.release
+	return c.MemoryStorage.Get(key)
+}
+
+func TestCoalesceReads(t *testing.T) {
+	storage := &countingGetStorage{MemoryStorage: mustMemoryStorage(t), release: make(chan struct{})}
+	db, err := NewDatabaseWithOptions(storage, Options{CoalesceReads: true})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.Get("hot")
+		}()
+	}
+
+	// Let the first read reach storage and the rest pile up behind it.
+	waitFor(func() bool { return atomic.LoadInt32(&storage.gets) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	close(storage.release)
+	wg.Wait()
+
+	if gets := atomic.LoadInt32(&storage.gets); gets != 1 {
+		t.Errorf("Expected one storage read but got %d", gets)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{NegativeCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Get("missing")
+	calls := storage.calls
+	for i := 0; i < 10; i++ {
+		db.Get("missing")
+	}
+	if storage.calls != calls {
+		t.Error("Repeated lookups of a missing key should not reach storage")
+	}
+
+	if err := db.Set("missing", []byte{1}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if res, _ := db.Get("missing"); !res.HasValue {
+		t.Error("Write should invalidate the cached absence")
+	}
+
+	db.Delete("missing")
+	if res, _ := db.Get("missing"); res.HasValue {
+		t.Error("Deleted key should read as missing")
+	}
+	if err := db.Set("missing", []byte{2}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if value, _ := db.GetRemote("missing"); value == nil || value.Version != 3 {
+		t.Error("Writes over a cached tombstone should keep counting versions")
+	}
+}
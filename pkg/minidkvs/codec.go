@@ -0,0 +1,70 @@
+package minidkvs
+
+import "encoding/json"
+
+// Codec converts between Go values and the bytes stored in the database.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values with encoding/json.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// CodecError is returned when a value can't be encoded or decoded. Err is the
+// codec's own error.
+type CodecError struct {
+	Key string
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	return "minidkvs: codec failed for key " + e.Key + ": " + e.Err.Error()
+}
+
+// Unwrap gives access to the codec's error.
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// SetWithCodec encodes v with codec and upserts it under key.
+func (d *Database) SetWithCodec(key string, v interface{}, codec Codec) error {
+	bytes, err := codec.Marshal(v)
+	if err != nil {
+		return &CodecError{Key: key, Err: err}
+	}
+	return d.Set(key, bytes)
+}
+
+// GetWithCodec decodes the value under key into v. Like Get, a missing key is
+// not an error: it returns false and leaves v untouched.
+func (d *Database) GetWithCodec(key string, v interface{}, codec Codec) (bool, error) {
+	res, err := d.Get(key)
+	if err != nil || !res.HasValue {
+		return false, err
+	}
+	if err := codec.Unmarshal(res.Value, v); err != nil {
+		return false, &CodecError{Key: key, Err: err}
+	}
+	return true, nil
+}
+
+// SetJSON is SetWithCodec using JSONCodec.
+func (d *Database) SetJSON(key string, v interface{}) error {
+	return d.SetWithCodec(key, v, JSONCodec)
+}
+
+// GetJSON is GetWithCodec using JSONCodec.
+func (d *Database) GetJSON(key string, v interface{}) (bool, error) {
+	return d.GetWithCodec(key, v, JSONCodec)
+}
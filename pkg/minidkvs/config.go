@@ -0,0 +1,231 @@
+package minidkvs
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is a configuration store on top of a Database. Each setting is its
+// own key, prefix+name, holding text such as "8080", "true" or "5s", so
+// settings can be changed with any client.
+//
+// Updates follow the database's rules. Writes to different settings never
+// conflict, even when made on different nodes at once. Concurrent writes to
+// the same setting are last-writer-wins. Reads are local, so a node sees a
+// change once it has replicated there.
+type Config struct {
+	db     *Database
+	prefix string
+}
+
+// ConfigUpdate is a freshly loaded config struct. Value holds whatever loaded
+// successfully when Err is set.
+type ConfigUpdate[T any] struct {
+	Value T
+	Err   error
+}
+
+// ConfigWatcher delivers the whole config struct again whenever a setting
+// changes.
+type ConfigWatcher[T any] struct {
+	Updates <-chan ConfigUpdate[T]
+
+	watcher   *Watcher
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var errNotStruct = errors.New("minidkvs: config must be loaded into a pointer to a struct")
+
+// NewConfig is ctor for Config.
+func NewConfig(db *Database, prefix string) *Config {
+	return &Config{db: db, prefix: prefix}
+}
+
+// GetString returns the setting, or def when it isn't set.
+func (c *Config) GetString(name, def string) (string, error) {
+	res, err := c.db.Get(c.prefix + name)
+	if err != nil || !res.HasValue {
+		return def, err
+	}
+	return string(res.Value), nil
+}
+
+// GetInt returns the setting parsed as an int, or def when it isn't set.
+func (c *Config) GetInt(name string, def int) (int, error) {
+	return getSetting(c, name, def, strconv.Atoi)
+}
+
+// GetBool returns the setting parsed by strconv.ParseBool, or def when it
+// isn't set.
+func (c *Config) GetBool(name string, def bool) (bool, error) {
+	return getSetting(c, name, def, strconv.ParseBool)
+}
+
+// GetDuration returns the setting parsed by time.ParseDuration, or def when it
+// isn't set.
+func (c *Config) GetDuration(name string, def time.Duration) (time.Duration, error) {
+	return getSetting(c, name, def, time.ParseDuration)
+}
+
+// getSetting reads a setting and parses it, wrapping parse errors in
+// CodecError.
+func getSetting[T any](c *Config, name string, def T, parse func(string) (T, error)) (T, error) {
+	text, err := c.GetString(name, "")
+	if err != nil || text == "" {
+		return def, err
+	}
+	v, err := parse(text)
+	if err != nil {
+		return def, &CodecError{Key: c.prefix + name, Err: err}
+	}
+	return v, nil
+}
+
+// Set stores a setting as text. Numbers, bools and durations are formatted
+// the way the getters parse them.
+func (c *Config) Set(name string, value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case int:
+		text = strconv.Itoa(v)
+	case bool:
+		text = strconv.FormatBool(v)
+	case time.Duration:
+		text = v.String()
+	default:
+		return &CodecError{Key: c.prefix + name, Err: errors.New("unsupported setting type " + reflect.TypeOf(value).String())}
+	}
+	return c.db.Set(c.prefix+name, []byte(text))
+}
+
+// Load fills the fields of the struct v points to from settings, read at one
+// consistent point. A field's setting is named by its `config` tag, or is the
+// field name in lower case; a tag of "-" skips it. Fields whose setting
+// isn't set keep their value, so v can be filled with defaults first. Fields
+// may be string, int, int64, bool or time.Duration. It needs a KeyLister
+// storage.
+func (c *Config) Load(v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Struct {
+		return errNotStruct
+	}
+	target = target.Elem()
+
+	deltas, err := c.db.dumpLive(c.prefix)
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]string, len(deltas))
+	for _, delta := range deltas {
+		settings[strings.TrimPrefix(delta.Key, c.prefix)] = string(delta.Value.Content)
+	}
+
+	var firstErr error
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		name := field.Tag.Get("config")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		text, ok := settings[name]
+		if !ok {
+			continue
+		}
+		if err := setField(target.Field(i), text); err != nil && firstErr == nil {
+			firstErr = &CodecError{Key: c.prefix + name, Err: err}
+		}
+	}
+	return firstErr
+}
+
+func setField(field reflect.Value, text string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(text)
+		if err == nil {
+			field.SetInt(int64(d))
+		}
+		return err
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return errors.New("unsupported field type " + field.Type().String())
+	}
+	return nil
+}
+
+// WatchConfig loads a copy of defaults from c straight away and again after
+// every change to a setting, delivering each on Updates.
+func WatchConfig[T any](c *Config, defaults T) (*ConfigWatcher[T], error) {
+	watcher, err := c.db.Watch(c.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ConfigUpdate[T])
+	w := &ConfigWatcher[T]{
+		Updates: out,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+
+	load := func() ConfigUpdate[T] {
+		update := ConfigUpdate[T]{Value: defaults}
+		update.Err = c.Load(&update.Value)
+		return update
+	}
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case out <- load():
+			case <-w.done:
+				return
+			}
+			if _, ok := <-w.watcher.Changes; !ok {
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// Close unsubscribes the watcher and closes its Updates channel. Calling it
+// again does nothing.
+func (w *ConfigWatcher[T]) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.watcher.Close()
+	})
+}
@@ -0,0 +1,60 @@
+package minidkvs
+
+import (
+	"testing"
+	"time"
+)
+
+type serverConfig struct {
+	Port    int
+	Debug   bool
+	Timeout time.Duration `config:"request_timeout"`
+	Name    string        `config:"-"`
+}
+
+func TestConfig(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	config := NewConfig(db, "cfg/")
+	if port, err := config.GetInt("port", 80); err != nil || port != 80 {
+		t.Error("Unset setting should return its default")
+	}
+
+	config.Set("port", 8080)
+	config.Set("request_timeout", 5*time.Second)
+	db.Set("cfg/debug", []byte("yes"))
+
+	if port, _ := config.GetInt("port", 80); port != 8080 {
+		t.Error("Set setting should be returned")
+	}
+	if _, err := config.GetBool("debug", false); err == nil {
+		t.Error("Unparseable setting should be an error")
+	}
+
+	w, err := WatchConfig(config, serverConfig{Port: 80, Name: "default"})
+	if err != nil {
+		t.Fatal("Failed to watch config")
+	}
+	defer w.Close()
+
+	update := <-w.Updates
+	if update.Value.Port != 8080 || update.Value.Timeout != 5*time.Second || update.Value.Name != "default" {
+		t.Errorf("Unexpected config %+v", update.Value)
+	}
+	if update.Err == nil {
+		t.Error("Bad setting should be reported")
+	}
+
+	config.Set("debug", true)
+	update = <-w.Updates
+	if !update.Value.Debug || update.Err != nil {
+		t.Error("Watcher should deliver the changed config")
+	}
+
+	// The deferred Close makes this a second call, which must not panic.
+	w.Close()
+}
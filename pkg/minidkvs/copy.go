@@ -0,0 +1,87 @@
+package minidkvs
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrKeyNotFound is returned by operations that need an existing key.
+var ErrKeyNotFound = errors.New("minidkvs: key not found")
+
+// CopyOptions controls Copy and Rename.
+type CopyOptions struct {
+	// PreserveMetadata carries the source's tags, expiry and extensions over
+	// to the destination.
+	// Otherwise the destination starts with none. Version and modification
+	// details are always those of a fresh write so that it replicates.
+	PreserveMetadata bool
+}
+
+// Copy writes the value of src to dst in one step of the message loop. It
+// returns ErrKeyNotFound when src doesn't exist, is deleted or has expired.
+func (d *Database) Copy(src, dst string, options CopyOptions) error {
+	return d.sendCopy(src, dst, options, false)
+}
+
+// Rename is Copy followed by deleting src, in one step of the message loop.
+// Either both changes are stored or neither is, and watchers see them as one
+// Change.Group.
+func (d *Database) Rename(src, dst string, options CopyOptions) error {
+	return d.sendCopy(src, dst, options, true)
+}
+
+func (d *Database) sendCopy(src, dst string, options CopyOptions, rename bool) error {
+	m := dbMessageCopy{
+		src:       src,
+		dst:       dst,
+		options:   options,
+		rename:    rename,
+		errorChan: make(chan error, 1),
+	}
+	err, timeoutErr := call(d, newCopyMessage(&m), m.errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// copyKey does the work of Copy and Rename. Only called from the message loop.
+func (d *Database) copyKey(src, dst string, options CopyOptions, rename bool) error {
+	if src == dst {
+		return nil
+	}
+
+	source, err := d.storageGet(src)
+	if err != nil {
+		return err
+	}
+	if !isLive(source) {
+		return ErrKeyNotFound
+	}
+
+	value, err := d.newValue(dst, source.Content, false)
+	if err != nil {
+		return err
+	}
+	if options.PreserveMetadata {
+		value.Tags = source.Tags
+		value.ExpiresAt = source.ExpiresAt
+		value.Extensions = source.Extensions
+	}
+
+	if !rename {
+		return d.store(dst, value, false)
+	}
+
+	tombstone, err := d.newValue(src, nil, true)
+	if err != nil {
+		return err
+	}
+
+	group := uuid.New().String()
+	return d.storeChanges([]Change{
+		{Key: dst, Value: value, Group: group},
+		{Key: src, Value: tombstone, Group: group},
+	})
+}
@@ -1,34 +1,315 @@
 package minidkvs
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
+// ErrVersionMismatch is returned by conditional writes when the key's stored
+// version isn't the one expected.
+var ErrVersionMismatch = errors.New("minidkvs: version mismatch")
+
 // Storage is interface for loading/saving the database to disk.
 type Storage interface {
 	Get(key string) (*Value, error)
 	Set(key string, v *Value) error
 	Delete(key string) error
-	GetNodeID() (*uuid.UUID, error)
+	GetNodeID() (NodeID, error)
+}
+
+// KeyLister is an optional Storage extension for backends that can enumerate
+// their keys. Features that need the whole keyspace, like snapshots, return
+// ErrKeysUnsupported for storage without it.
+type KeyLister interface {
+	// Keys returns every key starting with prefix in sorted order.
+	Keys(prefix string) ([]string, error)
 }
 
 // Database is adapter to storage.
 type Database struct {
 	storage Storage
-	nodeID  uuid.UUID
+	nodeID  NodeID
 	msgChan chan dbMessage
+	options Options
+	peers   []Peer
+
+	// configured is options as given, before any cluster settings.
+	configured Options
+
+	// paused holds the keys written since each paused peer was paused.
+	paused map[Peer]map[string]struct{}
+
+	watchers      map[int]*Watcher
+	nextWatcherID int
+
+	sequences map[string]*idSequence
+
+	reads   readGroup
+	absent  negativeCache
+	digests digests
+	scans   map[*scanState]struct{}
+
+	// maintenance is nil unless the node is in maintenance.
+	maintenance *maintenance
+
+	// sweepWake is nil unless the expiry sweeper is running. nextSweep is
+	// when it will next run, or zero for never.
+	sweepWake chan struct{}
+	nextSweep int64
+
+	storageStats map[string]*OpStats
+	breaker      breaker
+	space        space
+
+	// inFlight and slowCalls are updated atomically from callers'
+	// goroutines.
+	inFlight  int64
+	slowCalls int64
+
+	rejected      int64
+	auditFailures int64
+
+	activity loopActivity
+
+	// stopped is closed when the message loop exits. Failure is set first
+	// if it died from a panic, and closeErr once storage is closed.
+	stopped   chan struct{}
+	failure   error
+	closeErr  error
+	closeOnce sync.Once
+}
+
+// Options configures optional Database behaviour. The zero value behaves the
+// same as NewDatabase.
+type Options struct {
+	// ReadRepair makes Get compare the local version with every peer in the
+	// background and push the winner to any replica that is stale.
+	ReadRepair bool
+
+	// OnConflict is called when a replicated write loses. That is either an
+	// incoming delta discarded because the local value wins, or a local value
+	// overwritten by a delta that doesn't descend from it (its version is not
+	// higher). It runs in the message loop so must not call the Database.
+	OnConflict func(key string, winner, loser *Value)
+
+	// MaxValueSize limits the size of value content in bytes, both for local
+	// writes and deltas from peers. Zero means no limit.
+	MaxValueSize int
+
+	// ValidateDelta is an optional hook that can reject a delta from a peer
+	// by returning an error, for example when content doesn't match the
+	// schema the application expects.
+	ValidateDelta func(delta *Delta) error
+
+	// DeadLetters, when set, keeps every rejected delta along with the reason
+	// it was rejected.
+	DeadLetters DeadLetterStore
+
+	// ReplicateFilter, when set, decides which values are shared with peers.
+	// Values it returns false for are neither pushed to peers nor returned
+	// from GetRemote, so they stay on this node. Tags are the usual thing to
+	// filter on.
+	ReplicateFilter func(key string, value *Value) bool
+
+	// Pins restricts keys under a prefix to the listed nodes, for data
+	// residency. Repairs aren't pushed to other peers, and a node that isn't
+	// listed rejects deltas for those keys. The longest matching prefix
+	// applies. Every node needs the same Pins for this to hold.
+	Pins map[string][]NodeID
+
+	// Namespaces sets how keys under each prefix replicate, so conflict
+	// tolerant data and data that must not conflict can share a cluster. The
+	// longest matching prefix applies and every node needs the same
+	// Namespaces.
+	Namespaces map[string]Namespace
+
+	// ClusterSettings applies the cluster-wide settings stored under
+	// ClusterConfigPrefix on top of these Options.
+	ClusterSettings bool
+
+	// WatchFilters are named predicates that watchers can select with
+	// WatchOptions.Filter. They run in the message loop so must be quick and
+	// must not call the Database.
+	WatchFilters map[string]func(change Change) bool
+
+	// HistoryRetention keeps every version of every key for this long so that
+	// GetAt can look back in time. Zero disables history. It needs a Storage
+	// that implements HistoryStorage.
+	HistoryRetention time.Duration
+
+	// GroupCommitWindow, when set, makes the message loop hold a local write
+	// for up to this long to collect more writes, then store them all with
+	// one SetBatch call. It needs a Storage that implements BatchStorage.
+	GroupCommitWindow time.Duration
+
+	// CoalesceReads makes concurrent Gets of the same key with the same
+	// consistency share one trip through the message loop, so a burst of
+	// reads for a hot key costs one storage read. A coalesced Get can miss a
+	// write that finished while the shared read was already queued, and
+	// callers share the returned Value so must not modify it. Reads with a
+	// causal token are never coalesced.
+	CoalesceReads bool
+
+	// NegativeCacheTTL, when set, remembers keys that storage reported
+	// missing or deleted for this long, so repeated lookups of keys that
+	// don't exist don't reach a disk backend. Every write through the
+	// database invalidates the entry, so it only goes stale if something
+	// else writes to the Storage.
+	NegativeCacheTTL time.Duration
+
+	// DigestBuckets, when set, splits the keyspace into this many buckets
+	// and keeps a digest of each up to date on every write. See Digests.
+	// Each write then costs an extra storage read.
+	DigestBuckets int
+
+	// Hasher hashes keys and values for digest buckets. Nil means
+	// DefaultHasher.
+	Hasher Hasher
+
+	// BreakerThreshold is how many storage failures in a row mark storage
+	// unhealthy. While unhealthy every operation that needs storage,
+	// including deltas from peers, fails fast with ErrStorageUnavailable and
+	// storage is retried with exponential backoff starting at
+	// BreakerBackoff. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerBackoff   time.Duration
+
+	// TombstoneWindow, when set, protects deletes from peers that were
+	// offline for a long time. A delta that would overwrite a tombstone is
+	// rejected if it was written more than TombstoneWindow before it
+	// arrived, even when its timestamp is newer than the delete. Writes
+	// made on this node are never affected.
+	TombstoneWindow time.Duration
+
+	// OperationTimeout bounds how long a call waits for the message loop,
+	// so that a hung Storage gives ErrTimeout rather than blocking the
+	// caller forever. Zero means DefaultOperationTimeout and a negative
+	// value waits forever. An operation that timed out may still complete.
+	OperationTimeout time.Duration
+
+	// Generation is the cluster's data generation. Bump it on every node
+	// after wiping data deliberately: deltas stamped with an older
+	// generation are rejected, so a peer that was offline during the wipe
+	// can't bring the old data back. Snapshots from before the bump are
+	// refused by Restore for the same reason.
+	Generation int64
+
+	// AuditLog, when set, gets an entry for every write that reaches
+	// storage, local or replicated. The value is already stored when its
+	// entry is appended, so a failed append doesn't fail the write: it is
+	// counted in Stats.AuditFailures and passed to OnAuditError.
+	AuditLog AuditLog
+
+	// OnAuditError is called with every failure to append to AuditLog. It
+	// runs in the message loop so must not call the Database.
+	OnAuditError func(key string, err error)
+
+	// SlowOpThreshold, when set, counts operations that take longer than
+	// this in Stats and reports each to OnSlowOp. Both calls to the
+	// Database and its calls to Storage are measured.
+	SlowOpThreshold time.Duration
+
+	// OnSlowOp is called for every operation over SlowOpThreshold. It may
+	// be called concurrently, and for storage calls it runs in the message
+	// loop so must not call the Database.
+	OnSlowOp func(op SlowOp)
+
+	// StallTimeout, with OnStall, starts a watchdog that reports any
+	// single operation holding the message loop for longer than this. The
+	// loop handles one operation at a time, so a stall blocks every caller.
+	// It should be well above GroupCommitWindow.
+	StallTimeout time.Duration
+
+	// OnStall is called from the watchdog's goroutine, once per stalled
+	// operation. The Database will not answer until the stall clears.
+	OnStall func(stall Stall)
+
+	// MinFreeSpace, when set, refuses writes that carry content with
+	// ErrLowSpace while storage reports less than this many bytes free
+	// through StorageSpace. Reads, deletes and sweeps carry on, so the node
+	// keeps serving and can free space. Storage without StorageSpace is
+	// never refused.
+	MinFreeSpace int64
+
+	// SweepExpired reclaims the content of expired values in the
+	// background. It needs storage implementing ExpiryIndex and is ignored
+	// otherwise. Expired values read as missing either way.
+	SweepExpired bool
+
+	// Redact, when set, is applied to content returned by DeadLetters so
+	// that sensitive values don't leak into operational tooling.
+	Redact Redactor
+
+	// Migrations upgrade the stored data when the Database opens. See
+	// Migration.
+	Migrations []Migration
+
+	// MigrationBackup, when set, receives a backup of the data before any
+	// migration runs. BackupManager can restore it.
+	MigrationBackup BackupDestination
 }
 
 // Value is a wrapper for all values in the database. Stores metadata necessary
 // for synchronization.
 type Value struct {
 	Version    int
-	ModifiedBy uuid.UUID
+	ModifiedBy NodeID
 	ModifiedAt int64
 	Deleted    bool
 	Content    []byte
+	Tags       []string
+
+	// ExpiresAt is the unix time after which the value reads as missing.
+	// Zero means it never expires.
+	ExpiresAt int64
+
+	// Extensions holds extra per-value metadata keyed by feature name, so
+	// that new features don't each need a field and a new on-disk format.
+	// Storage must keep it as is, including names it doesn't recognise, and
+	// leaves it out when empty so older data reads the same.
+	Extensions map[string][]byte `json:",omitempty"`
+
+	// Generation is Options.Generation of the node that made the write.
+	Generation int64 `json:",omitempty"`
+
+	// Actor is WriteOptions.Actor of the write. Unlike ModifiedBy it names
+	// the application's client rather than the node.
+	Actor string `json:",omitempty"`
+
+	// Fence is the highest WriteOptions.Fence any write to the key has
+	// carried. Writes inherit it, and a value with a higher fence beats one
+	// with a lower fence whatever their timestamps.
+	Fence uint64 `json:",omitempty"`
+}
+
+// Expired reports whether the value's TTL has run out at the unix time now.
+func (v *Value) Expired(now int64) bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= now
+}
+
+// isLive reports whether value is something Get would return: present, not
+// deleted and not expired.
+func isLive(value *Value) bool {
+	return value != nil && !value.Deleted && !value.Expired(time.Now().Unix())
+}
+
+// Extension returns the named extension and whether the value has it.
+func (v *Value) Extension(name string) ([]byte, bool) {
+	data, ok := v.Extensions[name]
+	return data, ok
+}
+
+// HasTag reports whether the value was written with the given tag.
+func (v *Value) HasTag(tag string) bool {
+	for _, t := range v.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Delta is a wrapper object for a database delta (ie: a new, updated or
@@ -45,23 +326,130 @@ type GetResult struct {
 	Value    []byte
 }
 
+// ReadOptions controls how a read is served. The zero value reads the local
+// replica only, which is what Get does.
+type ReadOptions struct {
+	Consistency Consistency
+
+	// After, when set, makes the read fail with ErrStaleRead rather than
+	// return anything older than the write the token came from.
+	After *CausalToken
+}
+
+// WriteOptions carries optional per-write settings.
+type WriteOptions struct {
+	// Tags are small labels stored with the value, such as "pii" or
+	// "ephemeral", that filters and policies can act on.
+	Tags []string
+
+	// TTL makes the value expire after this long, rounded up to whole
+	// seconds. Zero means it never expires.
+	TTL time.Duration
+
+	// Extensions are stored with the value. See Value.Extensions.
+	Extensions map[string][]byte
+
+	// Actor identifies who made the write, such as the authenticated client
+	// of a server built on the database. It is stored as Value.Actor and
+	// replicated, so watchers, the audit log and conflict reports on every
+	// node can name it.
+	Actor string
+
+	// Fence is a fencing token from an external lock service, which hands
+	// out a higher one each time the lock changes hands. The write fails
+	// with ErrFenced if the key has already seen a higher fence, so a
+	// client that lost the lock without noticing can't overwrite its
+	// successor. Zero writes without a fence.
+	Fence uint64
+
+	// checkVersion makes the write fail unless the stored version is
+	// version. Set by SetWithVersion.
+	checkVersion bool
+	version      int
+}
+
 // TryGet wraps a GetResult and includes Error obj.
 type TryGet struct {
 	Result GetResult
 	Error  error
 }
 
+// newGetResult converts a stored value (which may be missing, a tombstone or
+// expired) into what Get returns to the application.
+func newGetResult(value *Value) GetResult {
+	if !isLive(value) {
+		return GetResult{HasValue: false}
+	}
+	return GetResult{HasValue: true, Value: value.Content}
+}
+
 // NewDatabase is ctor for Database.
 func NewDatabase(storage Storage) (*Database, error) {
+	return NewDatabaseWithOptions(storage, Options{})
+}
+
+// NewDatabaseWithOptions is ctor for Database with non-default behaviour. A
+// Storage can only be used by one open Database at a time; it can be used
+// again once that Database is closed.
+func NewDatabaseWithOptions(storage Storage, options Options) (*Database, error) {
+	if err := claimStorage(storage); err != nil {
+		return nil, err
+	}
+
+	if opener, ok := storage.(StorageOpener); ok {
+		if err := opener.Open(); err != nil {
+			releaseStorage(storage)
+			return nil, err
+		}
+	}
+
 	nodeID, err := storage.GetNodeID()
+	if err == nil && nodeID == "" {
+		err = ErrNoNodeID
+	}
 	if err != nil {
+		if closer, ok := storage.(io.Closer); ok {
+			closer.Close()
+		}
+		releaseStorage(storage)
 		return nil, err
 	}
 
 	db := &Database{
 		storage: storage,
-		nodeID:  *nodeID,
+		nodeID:  nodeID,
 		msgChan: make(chan dbMessage),
+		options: options,
+
+		configured: options,
+
+		paused:    make(map[Peer]map[string]struct{}),
+		scans:     make(map[*scanState]struct{}),
+		watchers:  make(map[int]*Watcher),
+		sequences: make(map[string]*idSequence),
+
+		storageStats: make(map[string]*OpStats),
+		breaker:      newBreaker(options.BreakerThreshold, options.BreakerBackoff),
+		absent:       newNegativeCache(options.NegativeCacheTTL),
+
+		stopped: make(chan struct{}),
+	}
+
+	if err := db.migrate(); err != nil {
+		if closer, ok := storage.(io.Closer); ok {
+			closer.Close()
+		}
+		releaseStorage(storage)
+		return nil, err
+	}
+
+	if _, ok := storage.(ExpiryIndex); ok && options.SweepExpired {
+		db.sweepWake = make(chan struct{}, 1)
+		go db.sweeper()
+	}
+
+	if options.StallTimeout > 0 && options.OnStall != nil {
+		go db.watchdog()
 	}
 
 	go dbMessageLoop(db)
@@ -72,14 +460,20 @@ func NewDatabase(storage Storage) (*Database, error) {
 // newValue wraps the given bytes in a Value object including automatically
 // setting version and date fields.
 func (d *Database) newValue(key string, bytes []byte, deleted bool) (*Value, error) {
-	value, err := d.storage.Get(key)
+	value, err := d.storageGetMeta(key)
 	if err != nil {
 		return nil, err
 	}
+	return d.newValueFrom(value, bytes, deleted), nil
+}
 
+// newValueFrom is newValue given the value currently stored, if any.
+func (d *Database) newValueFrom(value *Value, bytes []byte, deleted bool) *Value {
 	version := 1
+	var fence uint64
 	if value != nil {
 		version = value.Version + 1
+		fence = value.Fence
 	}
 
 	result := &Value{
@@ -88,72 +482,369 @@ func (d *Database) newValue(key string, bytes []byte, deleted bool) (*Value, err
 		ModifiedAt: time.Now().Unix(),
 		Deleted:    deleted,
 		Content:    bytes,
+		Generation: d.options.Generation,
+		Fence:      fence,
+	}
+
+	// A local write must win over the value it replaces, otherwise a peer
+	// with a clock ahead of ours would make writes on this node go backwards.
+	if value != nil && !valueWins(result, value) {
+		result.ModifiedAt = value.ModifiedAt + 1
+	}
+
+	return result
+}
+
+// setLocal does the work of a local write and returns the stored value. Only
+// called from the message loop.
+func (d *Database) setLocal(key string, bytes []byte, options WriteOptions) (*Value, error) {
+	existing, err := d.storageGet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := d.prepareLocal(existing, bytes, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.storeChange(Change{Key: key, Value: value, Actor: options.Actor}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// prepareLocal checks a local write and builds the value to store over
+// existing.
+func (d *Database) prepareLocal(existing *Value, bytes []byte, options WriteOptions) (*Value, error) {
+	if d.options.MaxValueSize > 0 && len(bytes) > d.options.MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+
+	if existing != nil && options.Fence != 0 && options.Fence < existing.Fence {
+		return nil, ErrFenced
+	}
+	if options.checkVersion && versionOf(existing) != options.version {
+		return nil, ErrVersionMismatch
 	}
 
-	return result, nil
+	value := d.newValueFrom(existing, bytes, false)
+	if options.Fence > value.Fence {
+		value.Fence = options.Fence
+	}
+	value.Tags = options.Tags
+	value.ExpiresAt = expiresAt(options.TTL)
+	value.Extensions = options.Extensions
+	value.Actor = options.Actor
+	return value, nil
+}
+
+// store writes value to storage and tells any watchers about it. Remote is
+// true when the value came from a peer.
+func (d *Database) store(key string, value *Value, remote bool) error {
+	return d.storeChange(Change{Key: key, Value: value, Remote: remote, Actor: value.Actor})
+}
+
+// storeChange writes change.Value to storage and passes the change on to
+// watchers.
+func (d *Database) storeChange(change Change) error {
+	if !change.Remote {
+		if err := d.checkWriter(change.Key); err != nil {
+			return err
+		}
+	}
+	if err := d.storageSet(change.Key, change.Value); err != nil {
+		return err
+	}
+	return d.stored(change)
+}
+
+// storeChanges writes every change to storage or, on an error, none of them,
+// and only then passes them on to watchers. Storage that implements
+// BatchStorage gets them in one SetBatch. Otherwise they are written one at a
+// time and any already written are put back when a later one fails.
+func (d *Database) storeChanges(changes []Change) error {
+	for _, change := range changes {
+		if !change.Remote {
+			if err := d.checkWriter(change.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, ok := d.storage.(BatchStorage); ok {
+		deltas := make([]Delta, len(changes))
+		for i, change := range changes {
+			deltas[i] = Delta{Key: change.Key, Value: change.Value}
+		}
+		if err := d.storageSetBatch(deltas); err != nil {
+			return err
+		}
+	} else {
+		olds := make([]*Value, len(changes))
+		for i, change := range changes {
+			old, err := d.storageGet(change.Key)
+			if err != nil {
+				return err
+			}
+			olds[i] = old
+		}
+		for i, change := range changes {
+			if err := d.storageSet(change.Key, change.Value); err != nil {
+				return d.rollback(changes[:i], olds[:i], err)
+			}
+		}
+	}
+
+	for _, change := range changes {
+		if err := d.stored(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback puts back what each key held before storeChanges wrote changes,
+// newest first, and returns cause. A key that didn't exist is deleted again.
+func (d *Database) rollback(changes []Change, olds []*Value, cause error) error {
+	for i := len(changes) - 1; i >= 0; i-- {
+		key := changes[i].Key
+		var err error
+		if olds[i] == nil {
+			if err = d.guard(func() error { return d.storage.Delete(key) }); err == nil {
+				d.digestWrite(key, changes[i].Value, nil)
+			}
+		} else {
+			err = d.storageSet(key, olds[i])
+		}
+		if err != nil {
+			return fmt.Errorf("%w; rolling back %q also failed: %v", cause, key, err)
+		}
+	}
+	return cause
+}
+
+// stored does everything that follows a value reaching storage.
+func (d *Database) stored(change Change) error {
+	if err := d.recordHistory(change.Key, change.Value); err != nil {
+		return err
+	}
+	if err := d.audit(change); err != nil {
+		d.auditFailures++
+		if d.options.OnAuditError != nil {
+			d.options.OnAuditError(change.Key, err)
+		}
+	}
+	d.settingChanged(change.Key, change.Value)
+	d.hint(change.Key)
+	d.notify(change)
+	return nil
+}
+
+// valueWins decides whether a beats b under last-writer-wins. A higher fence
+// wins regardless of time. Timestamp ties are broken by comparing node IDs
+// byte-wise so that every node picks the same winner. It runs on every delta,
+// so it must not allocate.
+func valueWins(a, b *Value) bool {
+	if a.Fence != b.Fence {
+		return a.Fence > b.Fence
+	}
+	if a.ModifiedAt == b.ModifiedAt {
+		return a.ModifiedBy < b.ModifiedBy
+	}
+	return a.ModifiedAt > b.ModifiedAt
+}
+
+// sameWrite reports whether a and b are copies of the same write, as happens
+// when a delta is delivered more than once.
+func sameWrite(a, b *Value) bool {
+	return a.ModifiedAt == b.ModifiedAt && a.ModifiedBy == b.ModifiedBy
 }
 
 // handleReceive takes a delta from another peer and decides what to do with it.
 func (d *Database) handleReceive(delta *Delta) error {
-	existingIsConflictWinner := func(existing, new *Value) bool {
-		if existing.ModifiedAt == new.ModifiedAt {
-			return existing.ModifiedBy.String() < new.ModifiedBy.String()
-		}
-		return existing.ModifiedAt > new.ModifiedAt
+	if err := d.checkMaintenance(); err != nil {
+		return err
+	}
+	if reason := d.validateDelta(delta); reason != "" {
+		return d.reject(delta, reason)
 	}
 
-	existing, err := d.storage.Get(delta.Key)
+	existing, err := d.storageGet(delta.Key)
 	if err != nil {
 		return err
 	}
 
-	if existing == nil || existingIsConflictWinner(existing, delta.Value) {
-		return d.storage.Set(delta.Key, delta.Value)
+	if existing == nil {
+		return d.store(delta.Key, delta.Value, true)
 	}
 
-	return nil
+	if sameWrite(existing, delta.Value) {
+		return nil
+	}
+
+	if ns := d.namespace(delta.Key); ns.Mode == MergeValues && isLive(existing) && isLive(delta.Value) {
+		return d.mergeReceived(delta.Key, existing, delta.Value, ns.Merge)
+	}
+
+	if !valueWins(delta.Value, existing) {
+		d.conflict(delta.Key, existing, delta.Value)
+		return nil
+	}
+
+	if d.resurrects(existing, delta.Value) {
+		return d.reject(delta, "stale write would undelete key")
+	}
+
+	if delta.Value.Version <= existing.Version {
+		d.conflict(delta.Key, delta.Value, existing)
+	}
+
+	return d.store(delta.Key, delta.Value, true)
+}
+
+// resurrects reports whether replacing existing with incoming would bring a
+// deleted key back from a write older than Options.TombstoneWindow.
+func (d *Database) resurrects(existing, incoming *Value) bool {
+	if d.options.TombstoneWindow <= 0 || !existing.Deleted || incoming.Deleted {
+		return false
+	}
+	age := time.Duration(time.Now().Unix()-incoming.ModifiedAt) * time.Second
+	return age > d.options.TombstoneWindow
+}
+
+// replicates reports whether value may be shared with peers.
+func (d *Database) replicates(key string, value *Value) bool {
+	return d.options.ReplicateFilter == nil || d.options.ReplicateFilter(key, value)
+}
+
+// conflict reports a lost write to the OnConflict hook if there is one.
+func (d *Database) conflict(key string, winner, loser *Value) {
+	if d.options.OnConflict != nil {
+		d.options.OnConflict(key, winner, loser)
+	}
 }
 
 // ReceiveRemote accepts deltas from other peers.
 func (d *Database) ReceiveRemote(delta *Delta) error {
-	errorChan := make(chan error)
+	errorChan := make(chan error, 1)
 	recvMsg := dbMessageReceive{delta: delta, errorChan: errorChan}
-	d.msgChan <- newReceiveMessage(&recvMsg)
-	return <-errorChan
-}
-
-// Close breaks database goroutine out of its message loop. The database is no
-// longer usable afterward. Close() should always be called when the database
-// object is not going to be used again.
-func (d *Database) Close() {
-	d.msgChan <- newCloseMessage()
+	err, timeoutErr := call(d, newReceiveMessage(&recvMsg), errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
 }
 
 // Get fetches the given value from the database. Missing keys are NOT errors.
 // When the key is missing error result is nil but GetResult.HasValue will be
 // false.
 func (d *Database) Get(key string) (GetResult, error) {
-	getMsg := dbMessageGet{key: key, replyChan: make(chan TryGet)}
-	d.msgChan <- newGetMessage(&getMsg)
-	try := <-getMsg.replyChan
+	return d.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions is Get with a configurable consistency level. Levels above
+// ConsistencyLocal contact peers and return ErrConsistencyUnavailable when too
+// few of them answer.
+func (d *Database) GetWithOptions(key string, options ReadOptions) (GetResult, error) {
+	if d.options.CoalesceReads && options.After == nil {
+		return d.reads.do(readKey{key, options.Consistency}, func() (GetResult, error) {
+			return d.get(key, options)
+		})
+	}
+	return d.get(key, options)
+}
+
+// get sends a read to the message loop.
+func (d *Database) get(key string, options ReadOptions) (GetResult, error) {
+	getMsg := dbMessageGet{
+		key:         key,
+		consistency: options.Consistency,
+		after:       options.After,
+		replyChan:   make(chan TryGet, 1),
+	}
+	try, err := call(d, newGetMessage(&getMsg), getMsg.replyChan)
+	if err != nil {
+		return GetResult{}, err
+	}
 	return try.Result, try.Error
 }
 
 // Set upserts the given key/value pair.
 func (d *Database) Set(key string, value []byte) error {
-	errorChan := make(chan error)
-	m := dbMessageSet{key: key, value: value, errorChan: errorChan}
-	d.msgChan <- newSetMessage(&m)
-	return <-errorChan
+	_, err := d.SetWithToken(key, value)
+	return err
+}
+
+// SetWithToken is Set but also returns a CausalToken for the write, which can
+// be passed in ReadOptions to later reads on any node.
+func (d *Database) SetWithToken(key string, value []byte) (CausalToken, error) {
+	return d.SetWithOptions(key, value, WriteOptions{})
+}
+
+// SetWithOptions is SetWithToken with per-write settings.
+func (d *Database) SetWithOptions(key string, value []byte, options WriteOptions) (CausalToken, error) {
+	m := dbMessageSet{
+		key:       key,
+		value:     value,
+		options:   options,
+		replyChan: make(chan tryValue, 1),
+	}
+	try, err := call(d, newSetMessage(&m), m.replyChan)
+	if err != nil {
+		return CausalToken{}, err
+	}
+	return newCausalToken(try.value), try.err
 }
 
 // Delete removes the given key/value pair. If the key doesn't exist then it
 // does nothing and does not treat as an error.
 func (d *Database) Delete(key string) error {
-	errorChan := make(chan error)
-	m := dbMessageDelete{key: key, errorChan: errorChan}
-	d.msgChan <- newDeleteMessage(&m)
-	return <-errorChan
+	_, err := d.DeleteWithToken(key)
+	return err
+}
+
+// DeleteWithToken is Delete but also returns a CausalToken for the write.
+func (d *Database) DeleteWithToken(key string) (CausalToken, error) {
+	m := dbMessageDelete{key: key, replyChan: make(chan tryValue, 1)}
+	try, err := call(d, newDeleteMessage(&m), m.replyChan)
+	if err != nil {
+		return CausalToken{}, err
+	}
+	return newCausalToken(try.value), try.err
+}
+
+// SetWithVersion is Set but only if the stored version of key is
+// expectedVersion, as given by a CausalToken or GetMeta. A missing key has
+// version 0. It returns ErrVersionMismatch when the key has been written
+// since.
+func (d *Database) SetWithVersion(key string, value []byte, expectedVersion int) (CausalToken, error) {
+	return d.SetWithOptions(key, value, WriteOptions{checkVersion: true, version: expectedVersion})
+}
+
+// DeleteWithVersion is Delete but only if the stored version of key is
+// expectedVersion, as given by a CausalToken. A missing key has version 0.
+// It returns ErrVersionMismatch when the key has been written since.
+func (d *Database) DeleteWithVersion(key string, expectedVersion int) error {
+	m := dbMessageDelete{
+		key:          key,
+		checkVersion: true,
+		version:      expectedVersion,
+		replyChan:    make(chan tryValue, 1),
+	}
+	try, err := call(d, newDeleteMessage(&m), m.replyChan)
+	if err != nil {
+		return err
+	}
+	return try.err
+}
+
+// versionOf returns the version of value, or 0 when there is none.
+func versionOf(value *Value) int {
+	if value == nil {
+		return 0
+	}
+	return value.Version
 }
 
 type dbMessageType int32
@@ -164,6 +855,34 @@ const (
 	dbMessageTypeGet     dbMessageType = 2
 	dbMessageTypeDelete  dbMessageType = 3
 	dbMessageTypeClose   dbMessageType = 4
+	dbMessageTypeRaw     dbMessageType = 5
+	dbMessageTypeAddPeer dbMessageType = 6
+	dbMessageTypeLetters dbMessageType = 7
+	dbMessageTypeWatch   dbMessageType = 8
+	dbMessageTypeUnwatch dbMessageType = 9
+	dbMessageTypeDump    dbMessageType = 10
+	dbMessageTypeDelPre  dbMessageType = 11
+	dbMessageTypeCopy    dbMessageType = 12
+	dbMessageTypeNextID  dbMessageType = 13
+	dbMessageTypeBatch   dbMessageType = 14
+	dbMessageTypeGetAt   dbMessageType = 15
+	dbMessageTypeUndel   dbMessageType = 16
+	dbMessageTypeTouch   dbMessageType = 17
+	dbMessageTypeStats   dbMessageType = 18
+	dbMessageTypeHealth  dbMessageType = 19
+	dbMessageTypePause   dbMessageType = 20
+	dbMessageTypeFlush   dbMessageType = 21
+	dbMessageTypeDigests dbMessageType = 22
+	dbMessageTypeScan    dbMessageType = 23
+	dbMessageTypeList    dbMessageType = 24
+	dbMessageTypeCount   dbMessageType = 25
+	dbMessageTypeSweep   dbMessageType = 26
+	dbMessageTypeMeta    dbMessageType = 27
+	dbMessageTypeSubtree dbMessageType = 28
+	dbMessageTypeUpdate  dbMessageType = 29
+	dbMessageTypeTxn     dbMessageType = 30
+	dbMessageTypeReload  dbMessageType = 31
+	dbMessageTypeMaint   dbMessageType = 32
 )
 
 type dbMessageReceive struct {
@@ -174,25 +893,151 @@ type dbMessageReceive struct {
 type dbMessageSet struct {
 	key       string
 	value     []byte
-	errorChan chan error
+	options   WriteOptions
+	replyChan chan tryValue
 }
 
 type dbMessageGet struct {
+	key         string
+	consistency Consistency
+	after       *CausalToken
+	replyChan   chan TryGet
+}
+
+type dbMessageDelete struct {
+	key       string
+	replyChan chan tryValue
+
+	// checkVersion makes the delete fail unless the stored version is
+	// version.
+	checkVersion bool
+	version      int
+}
+
+type dbMessageRaw struct {
+	key       string
+	local     bool
+	replyChan chan tryValue
+}
+
+type dbMessageAddPeer struct {
+	peer     Peer
+	doneChan chan struct{}
+}
+
+type dbMessagePause struct {
+	peer      Peer
+	pause     bool
+	replyChan chan error
+}
+
+type dbMessageFlush struct {
+	errorChan chan error
+}
+
+type dbMessageDigests struct {
+	replyChan chan tryDigests
+}
+
+type dbMessageLetters struct {
+	replyChan chan tryDeadLetters
+}
+
+type dbMessageWatch struct {
+	watcher  *Watcher
+	doneChan chan struct{}
+}
+
+type dbMessageDump struct {
+	prefix string
+	// filter, when set, is called in the message loop and drops every
+	// delta it returns false for.
+	filter    func(key string, value *Value) bool
+	replyChan chan tryDeltas
+}
+
+type dbMessageDeletePrefix struct {
+	prefix    string
+	options   DeletePrefixOptions
+	replyChan chan tryCount
+}
+
+type dbMessageCopy struct {
+	src       string
+	dst       string
+	options   CopyOptions
+	rename    bool
+	errorChan chan error
+}
+
+type dbMessageNextID struct {
+	sequence  string
+	replyChan chan tryID
+}
+
+type dbMessageBatch struct {
+	writes    []batchWrite
+	replyChan chan tryCount
+}
+
+type dbMessageGetAt struct {
 	key       string
+	at        int64
 	replyChan chan TryGet
 }
 
-type dbMessageDelete struct {
+type dbMessageUndelete struct {
 	key       string
 	errorChan chan error
 }
 
+type dbMessageTouch struct {
+	key       string
+	ttl       time.Duration
+	errorChan chan error
+}
+
+type dbMessageStats struct {
+	replyChan chan Stats
+}
+
+type dbMessageHealth struct {
+	replyChan chan error
+}
+
 type dbMessage struct {
 	msgType    dbMessageType
 	receiveMsg *dbMessageReceive
 	setMsg     *dbMessageSet
 	getMsg     *dbMessageGet
 	deleteMsg  *dbMessageDelete
+	rawMsg     *dbMessageRaw
+	addPeerMsg *dbMessageAddPeer
+	lettersMsg *dbMessageLetters
+	watchMsg   *dbMessageWatch
+	dumpMsg    *dbMessageDump
+	delPreMsg  *dbMessageDeletePrefix
+	copyMsg    *dbMessageCopy
+	nextIDMsg  *dbMessageNextID
+	batchMsg   *dbMessageBatch
+	getAtMsg   *dbMessageGetAt
+	undelMsg   *dbMessageUndelete
+	touchMsg   *dbMessageTouch
+	statsMsg   *dbMessageStats
+	healthMsg  *dbMessageHealth
+	pauseMsg   *dbMessagePause
+	flushMsg   *dbMessageFlush
+	digestsMsg *dbMessageDigests
+	scanMsg    *dbMessageScan
+	listMsg    *dbMessageList
+	countMsg   *dbMessageCount
+	sweepMsg   *dbMessageSweep
+	metaMsg    *dbMessageMeta
+	subtreeMsg *dbMessageReplaceSubtree
+	updateMsg  *dbMessageUpdate
+	txnMsg     *dbMessageTxn
+	reloadMsg  *dbMessageReconfigure
+	maintMsg   *dbMessageMaint
 }
 
 func newReceiveMessage(data *dbMessageReceive) dbMessage {
@@ -223,6 +1068,202 @@ func newDeleteMessage(data *dbMessageDelete) dbMessage {
 	}
 }
 
+func newRawMessage(data *dbMessageRaw) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeRaw,
+		rawMsg:  data,
+	}
+}
+
+func newAddPeerMessage(data *dbMessageAddPeer) dbMessage {
+	return dbMessage{
+		msgType:    dbMessageTypeAddPeer,
+		addPeerMsg: data,
+	}
+}
+
+func newLettersMessage(data *dbMessageLetters) dbMessage {
+	return dbMessage{
+		msgType:    dbMessageTypeLetters,
+		lettersMsg: data,
+	}
+}
+
+func newWatchMessage(data *dbMessageWatch) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeWatch,
+		watchMsg: data,
+	}
+}
+
+func newUnwatchMessage(data *dbMessageWatch) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeUnwatch,
+		watchMsg: data,
+	}
+}
+
+func newDumpMessage(data *dbMessageDump) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeDump,
+		dumpMsg: data,
+	}
+}
+
+func newDeletePrefixMessage(data *dbMessageDeletePrefix) dbMessage {
+	return dbMessage{
+		msgType:   dbMessageTypeDelPre,
+		delPreMsg: data,
+	}
+}
+
+func newCopyMessage(data *dbMessageCopy) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeCopy,
+		copyMsg: data,
+	}
+}
+
+func newNextIDMessage(data *dbMessageNextID) dbMessage {
+	return dbMessage{
+		msgType:   dbMessageTypeNextID,
+		nextIDMsg: data,
+	}
+}
+
+func newBatchMessage(data *dbMessageBatch) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeBatch,
+		batchMsg: data,
+	}
+}
+
+func newGetAtMessage(data *dbMessageGetAt) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeGetAt,
+		getAtMsg: data,
+	}
+}
+
+func newUndeleteMessage(data *dbMessageUndelete) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeUndel,
+		undelMsg: data,
+	}
+}
+
+func newTouchMessage(data *dbMessageTouch) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeTouch,
+		touchMsg: data,
+	}
+}
+
+func newStatsMessage(data *dbMessageStats) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeStats,
+		statsMsg: data,
+	}
+}
+
+func newHealthMessage(data *dbMessageHealth) dbMessage {
+	return dbMessage{
+		msgType:   dbMessageTypeHealth,
+		healthMsg: data,
+	}
+}
+
+func newPauseMessage(data *dbMessagePause) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypePause,
+		pauseMsg: data,
+	}
+}
+
+func newFlushMessage(data *dbMessageFlush) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeFlush,
+		flushMsg: data,
+	}
+}
+
+func newDigestsMessage(data *dbMessageDigests) dbMessage {
+	return dbMessage{
+		msgType:    dbMessageTypeDigests,
+		digestsMsg: data,
+	}
+}
+
+func newScanMessage(data *dbMessageScan) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeScan,
+		scanMsg: data,
+	}
+}
+
+func newListMessage(data *dbMessageList) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeList,
+		listMsg: data,
+	}
+}
+
+func newCountMessage(data *dbMessageCount) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeCount,
+		countMsg: data,
+	}
+}
+
+func newSweepMessage(data *dbMessageSweep) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeSweep,
+		sweepMsg: data,
+	}
+}
+
+func newMetaMessage(data *dbMessageMeta) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeMeta,
+		metaMsg: data,
+	}
+}
+
+func newReplaceSubtreeMessage(data *dbMessageReplaceSubtree) dbMessage {
+	return dbMessage{
+		msgType:    dbMessageTypeSubtree,
+		subtreeMsg: data,
+	}
+}
+
+func newUpdateMessage(data *dbMessageUpdate) dbMessage {
+	return dbMessage{
+		msgType:   dbMessageTypeUpdate,
+		updateMsg: data,
+	}
+}
+
+func newTxnMessage(data *dbMessageTxn) dbMessage {
+	return dbMessage{
+		msgType: dbMessageTypeTxn,
+		txnMsg:  data,
+	}
+}
+
+func newReloadMessage(data *dbMessageReconfigure) dbMessage {
+	return dbMessage{
+		msgType:   dbMessageTypeReload,
+		reloadMsg: data,
+	}
+}
+
+func newMaintMessage(data *dbMessageMaint) dbMessage {
+	return dbMessage{
+		msgType:  dbMessageTypeMaint,
+		maintMsg: data,
+	}
+}
+
 func newCloseMessage() dbMessage {
 	return dbMessage{
 		msgType: dbMessageTypeClose,
@@ -230,58 +1271,320 @@ func newCloseMessage() dbMessage {
 }
 
 func dbMessageLoop(db *Database) {
+	defer db.exitLoop()
+
+	db.loadClusterConfig()
+
 	receive := func(m *dbMessageReceive) {
 		m.errorChan <- db.handleReceive(m.delta)
 	}
 
 	set := func(m *dbMessageSet) {
-		value, err := db.newValue(m.key, m.value, false)
-		if err != nil {
-			m.errorChan <- err
-			return
-		}
-		m.errorChan <- db.storage.Set(m.key, value)
+		value, err := db.setLocal(m.key, m.value, m.options)
+		m.replyChan <- tryValue{value: value, err: err}
 	}
 
 	get := func(m *dbMessageGet) {
-		value, err := db.storage.Get(m.key)
+		value, err := db.storageGet(m.key)
 		if err != nil {
 			m.replyChan <- TryGet{Error: err}
 			return
 		}
 
-		if value == nil || value.Deleted {
-			res := GetResult{HasValue: false}
-			m.replyChan <- TryGet{Result: res, Error: nil}
-		} else {
-			res := GetResult{HasValue: true, Value: value.Content}
-			m.replyChan <- TryGet{Result: res, Error: nil}
+		if m.consistency != ConsistencyLocal || !m.after.satisfiedBy(value) {
+			peers, replicas := db.peersFor(m.key)
+			go db.consistentGet(m, value, peers, replicas)
+			return
+		}
+
+		m.replyChan <- TryGet{Result: newGetResult(value), Error: nil}
+
+		if peers, _ := db.peersFor(m.key); db.options.ReadRepair && len(peers) > 0 {
+			go db.readRepair(m.key, value, peers)
 		}
 	}
 
 	delete := func(m *dbMessageDelete) {
-		value, err := db.newValue(m.key, nil, true)
+		existing, err := db.storageGetMeta(m.key)
 		if err != nil {
-			m.errorChan <- err
+			m.replyChan <- tryValue{err: err}
+			return
+		}
+		if m.checkVersion && versionOf(existing) != m.version {
+			m.replyChan <- tryValue{err: ErrVersionMismatch}
+			return
+		}
+		value := db.newValueFrom(existing, nil, true)
+		err = db.store(m.key, value, false)
+		m.replyChan <- tryValue{value: value, err: err}
+	}
+
+	raw := func(m *dbMessageRaw) {
+		value, err := db.storageGet(m.key)
+		if value != nil && !m.local && !db.replicates(m.key, value) {
+			value = nil
+		}
+		m.replyChan <- tryValue{value: value, err: err}
+	}
+
+	addPeer := func(m *dbMessageAddPeer) {
+		db.peers = append(db.peers, m.peer)
+		close(m.doneChan)
+	}
+
+	pause := func(m *dbMessagePause) {
+		if m.pause {
+			m.replyChan <- db.pausePeer(m.peer)
+		} else {
+			m.replyChan <- db.resumePeer(m.peer)
+		}
+	}
+
+	flush := func(m *dbMessageFlush) {
+		m.errorChan <- db.flushStorage()
+	}
+
+	bucketDigests := func(m *dbMessageDigests) {
+		list, err := db.currentDigests()
+		m.replyChan <- tryDigests{digests: list, err: err}
+	}
+
+	scan := func(m *dbMessageScan) {
+		m.replyChan <- db.handleScan(m)
+	}
+
+	list := func(m *dbMessageList) {
+		deltas, err := db.list(m.prefix, m.after, m.limit)
+		m.replyChan <- tryDeltas{deltas: deltas, err: err}
+	}
+
+	count := func(m *dbMessageCount) {
+		n, err := db.count(m.prefix)
+		m.replyChan <- tryCount{count: int(n), err: err}
+	}
+
+	sweep := func(m *dbMessageSweep) {
+		next, err := db.sweep()
+		m.replyChan <- trySweep{next: next, err: err}
+	}
+
+	meta := func(m *dbMessageMeta) {
+		value, err := db.storageGetMeta(m.key)
+		if value != nil && value.Content != nil {
+			header := *value
+			header.Content = nil
+			value = &header
+		}
+		m.replyChan <- tryValue{value: value, err: err}
+	}
+
+	replaceSubtree := func(m *dbMessageReplaceSubtree) {
+		m.errorChan <- db.replaceSubtree(m.prefix, m.values)
+	}
+
+	update := func(m *dbMessageUpdate) {
+		value, err := db.updateLocal(m.key, m.fn)
+		m.replyChan <- tryValue{value: value, err: err}
+	}
+
+	txn := func(m *dbMessageTxn) {
+		response, err := db.txn(m.txn)
+		m.replyChan <- tryTxn{response: response, err: err}
+	}
+
+	reload := func(m *dbMessageReconfigure) {
+		m.replyChan <- db.reconfigure(m.options)
+	}
+
+	maint := func(m *dbMessageMaint) {
+		m.replyChan <- db.maintain(m.enter, m.retryAfter)
+	}
+
+	letters := func(m *dbMessageLetters) {
+		if db.options.DeadLetters == nil {
+			m.replyChan <- tryDeadLetters{}
 			return
 		}
-		m.errorChan <- db.storage.Set(m.key, value)
+		list, err := db.options.DeadLetters.List()
+		for i := range list {
+			list[i].Delta = db.options.Redact.apply(list[i].Delta)
+		}
+		m.replyChan <- tryDeadLetters{letters: list, err: err}
 	}
 
+	watch := func(m *dbMessageWatch) {
+		db.addWatcher(m.watcher)
+		close(m.doneChan)
+	}
+
+	unwatch := func(m *dbMessageWatch) {
+		db.removeWatcher(m.watcher)
+		close(m.doneChan)
+	}
+
+	dump := func(m *dbMessageDump) {
+		deltas, err := db.dump(m.prefix)
+		if err == nil && m.filter != nil {
+			kept := deltas[:0]
+			for _, delta := range deltas {
+				if m.filter(delta.Key, delta.Value) {
+					kept = append(kept, delta)
+				}
+			}
+			deltas = kept
+		}
+		m.replyChan <- tryDeltas{deltas: deltas, err: err}
+	}
+
+	deletePrefix := func(m *dbMessageDeletePrefix) {
+		count, err := db.deletePrefix(m.prefix, m.options)
+		m.replyChan <- tryCount{count: count, err: err}
+	}
+
+	copyKey := func(m *dbMessageCopy) {
+		m.errorChan <- db.copyKey(m.src, m.dst, m.options, m.rename)
+	}
+
+	nextID := func(m *dbMessageNextID) {
+		id, err := db.nextID(m.sequence, time.Now())
+		m.replyChan <- tryID{id: id, err: err}
+	}
+
+	batch := func(m *dbMessageBatch) {
+		count := 0
+		for _, w := range m.writes {
+			var err error
+			if w.deleted {
+				var existing *Value
+				if existing, err = db.storageGetMeta(w.key); err == nil {
+					err = db.store(w.key, db.newValueFrom(existing, nil, true), false)
+				}
+			} else {
+				_, err = db.setLocal(w.key, w.value, w.options)
+			}
+			if err != nil {
+				m.replyChan <- tryCount{count: count, err: err}
+				return
+			}
+			count++
+		}
+		m.replyChan <- tryCount{count: count}
+	}
+
+	getAt := func(m *dbMessageGetAt) {
+		value, err := db.valueAt(m.key, m.at)
+		m.replyChan <- TryGet{Result: newGetResult(value), Error: err}
+	}
+
+	undelete := func(m *dbMessageUndelete) {
+		m.errorChan <- db.undelete(m.key)
+	}
+
+	touch := func(m *dbMessageTouch) {
+		m.errorChan <- db.touch(m.key, m.ttl)
+	}
+
+	stats := func(m *dbMessageStats) {
+		m.replyChan <- db.stats()
+	}
+
+	health := func(m *dbMessageHealth) {
+		// The probe must reach storage, not the negative cache.
+		db.absent.forget(healthProbeKey)
+		_, err := db.storageGet(healthProbeKey)
+		m.replyChan <- err
+	}
+
+	_, canBatch := db.storage.(BatchStorage)
+
+	// next holds a message that arrived while a group commit was collecting
+	// writes. It is handled before reading the channel again.
+	var next *dbMessage
+
 	for {
-		msg := <-db.msgChan
+		var msg dbMessage
+		if next != nil {
+			msg = *next
+			next = nil
+		} else {
+			msg = <-db.msgChan
+		}
 
+		db.activity.begin(msg)
 		switch msg.msgType {
 		case dbMessageTypeReceive:
 			receive(msg.receiveMsg)
 		case dbMessageTypeSet:
-			set(msg.setMsg)
+			// GroupCommitWindow is read per write since Reconfigure
+			// can change it while the loop runs.
+			if canBatch && db.options.GroupCommitWindow > 0 {
+				next = db.groupCommit(msg.setMsg)
+			} else {
+				set(msg.setMsg)
+			}
 		case dbMessageTypeGet:
 			get(msg.getMsg)
 		case dbMessageTypeDelete:
 			delete(msg.deleteMsg)
-		default: // Anything else treated as close.
-			break
+		case dbMessageTypeRaw:
+			raw(msg.rawMsg)
+		case dbMessageTypeAddPeer:
+			addPeer(msg.addPeerMsg)
+		case dbMessageTypeLetters:
+			letters(msg.lettersMsg)
+		case dbMessageTypeWatch:
+			watch(msg.watchMsg)
+		case dbMessageTypeUnwatch:
+			unwatch(msg.watchMsg)
+		case dbMessageTypeDump:
+			dump(msg.dumpMsg)
+		case dbMessageTypeDelPre:
+			deletePrefix(msg.delPreMsg)
+		case dbMessageTypeCopy:
+			copyKey(msg.copyMsg)
+		case dbMessageTypeNextID:
+			nextID(msg.nextIDMsg)
+		case dbMessageTypeBatch:
+			batch(msg.batchMsg)
+		case dbMessageTypeGetAt:
+			getAt(msg.getAtMsg)
+		case dbMessageTypeUndel:
+			undelete(msg.undelMsg)
+		case dbMessageTypeTouch:
+			touch(msg.touchMsg)
+		case dbMessageTypeStats:
+			stats(msg.statsMsg)
+		case dbMessageTypeHealth:
+			health(msg.healthMsg)
+		case dbMessageTypePause:
+			pause(msg.pauseMsg)
+		case dbMessageTypeFlush:
+			flush(msg.flushMsg)
+		case dbMessageTypeDigests:
+			bucketDigests(msg.digestsMsg)
+		case dbMessageTypeScan:
+			scan(msg.scanMsg)
+		case dbMessageTypeList:
+			list(msg.listMsg)
+		case dbMessageTypeCount:
+			count(msg.countMsg)
+		case dbMessageTypeSweep:
+			sweep(msg.sweepMsg)
+		case dbMessageTypeMeta:
+			meta(msg.metaMsg)
+		case dbMessageTypeSubtree:
+			replaceSubtree(msg.subtreeMsg)
+		case dbMessageTypeUpdate:
+			update(msg.updateMsg)
+		case dbMessageTypeTxn:
+			txn(msg.txnMsg)
+		case dbMessageTypeReload:
+			reload(msg.reloadMsg)
+		case dbMessageTypeMaint:
+			maint(msg.maintMsg)
+		case dbMessageTypeClose:
+			return
 		}
+		db.activity.end()
 	}
 }
@@ -0,0 +1,68 @@
+package minidkvs
+
+import "time"
+
+// KeyCounter is an optional Storage extension for backends that can count
+// live keys without handing every value to the database.
+type KeyCounter interface {
+	// CountLive returns how many keys starting with prefix are neither
+	// deleted nor expired as of the unix time now.
+	CountLive(prefix string, now int64) (int64, error)
+}
+
+type dbMessageCount struct {
+	prefix    string
+	replyChan chan tryCount
+}
+
+// Exists reports whether key has a live value, without read repair or peer
+// lookups.
+func (d *Database) Exists(key string) (bool, error) {
+	value, err := d.getRaw(key, true)
+	if err != nil {
+		return false, err
+	}
+	return isLive(value), nil
+}
+
+// Count returns how many live keys start with prefix. Storage implementing
+// KeyCounter answers directly; otherwise it needs a KeyLister and reads each
+// key.
+func (d *Database) Count(prefix string) (int64, error) {
+	m := dbMessageCount{prefix: prefix, replyChan: make(chan tryCount, 1)}
+	try, err := call(d, newCountMessage(&m), m.replyChan)
+	if err != nil {
+		return 0, err
+	}
+	return int64(try.count), try.err
+}
+
+// count does the work of Count. Only called from the message loop.
+func (d *Database) count(prefix string) (int64, error) {
+	if counter, ok := d.storage.(KeyCounter); ok {
+		var n int64
+		start := time.Now()
+		err := d.guard(func() (err error) {
+			n, err = counter.CountLive(prefix, time.Now().Unix())
+			return err
+		})
+		d.recordStorage("count", prefix, start, 0, err)
+		return n, err
+	}
+
+	keys, err := d.storageKeys(prefix)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, key := range keys {
+		value, err := d.storageGet(key)
+		if err != nil {
+			return 0, err
+		}
+		if isLive(value) {
+			n++
+		}
+	}
+	return n, nil
+}
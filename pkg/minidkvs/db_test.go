@@ -1,6 +1,15 @@
 package minidkvs
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestMemoryDatabase(t *testing.T) {
 	db, err := NewMemoryDatabase()
@@ -50,3 +59,1118 @@ func TestMemoryDatabase(t *testing.T) {
 
 	db.Close()
 }
+
+func TestOnConflict(t *testing.T) {
+	var lost [][]byte
+	onConflict := func(key string, winner, loser *Value) {
+		lost = append(lost, loser.Content)
+	}
+
+	storage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	db, err := NewDatabaseWithOptions(storage, Options{OnConflict: onConflict})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	newer := remoteDelta("k", []byte{1}, 200)
+	db.ReceiveRemote(newer)
+	db.ReceiveRemote(newer)
+	if len(lost) != 0 {
+		t.Error("Redelivered delta reported as conflict")
+	}
+
+	db.ReceiveRemote(remoteDelta("k", []byte{2}, 100))
+	if len(lost) != 1 || lost[0][0] != 2 {
+		t.Error("Discarded delta not reported as conflict")
+	}
+
+	db.ReceiveRemote(remoteDelta("k", []byte{3}, 300))
+	if len(lost) != 2 || lost[1][0] != 1 {
+		t.Error("Overwritten concurrent value not reported as conflict")
+	}
+
+	successor := remoteDelta("k", []byte{4}, 400)
+	successor.Value.Version = 2
+	db.ReceiveRemote(successor)
+	if len(lost) != 2 {
+		t.Error("Ordinary update reported as conflict")
+	}
+}
+
+func TestRejectedDeltasAreDeadLettered(t *testing.T) {
+	storage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	options := Options{MaxValueSize: 2, DeadLetters: NewMemoryDeadLetters()}
+	db, err := NewDatabaseWithOptions(storage, options)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	err = db.ReceiveRemote(remoteDelta("k", []byte{1, 2, 3}, 100))
+	if !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Oversized delta should be rejected")
+	}
+
+	if err := db.Set("k", []byte{1, 2, 3}); err != ErrValueTooLarge {
+		t.Error("Oversized local write should be rejected")
+	}
+
+	letters, err := db.DeadLetters()
+	if err != nil {
+		t.Error("Failed to list dead letters")
+	}
+	if len(letters) != 1 || letters[0].Delta.Key != "k" || letters[0].Reason == "" {
+		t.Error("Rejected delta missing from dead letters")
+	}
+
+	res, _ := db.Get("k")
+	if res.HasValue {
+		t.Error("Rejected delta was stored")
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	type settings struct {
+		Theme string
+		Size  int
+	}
+
+	var out settings
+	found, err := db.GetJSON("settings", &out)
+	if err != nil || found {
+		t.Error("Missing key should not be found or error")
+	}
+
+	if err := db.SetJSON("settings", settings{Theme: "dark", Size: 3}); err != nil {
+		t.Error("Failed to set JSON value")
+	}
+
+	found, err = db.GetJSON("settings", &out)
+	if err != nil || !found {
+		t.Error("Failed to get JSON value")
+	}
+	if out.Theme != "dark" || out.Size != 3 {
+		t.Error("JSON value has wrong content")
+	}
+
+	db.Set("broken", []byte("{"))
+	_, err = db.GetJSON("broken", &out)
+	var codecErr *CodecError
+	if !errors.As(err, &codecErr) || codecErr.Key != "broken" {
+		t.Error("Bad JSON should give a CodecError")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	w, err := db.Watch("user/")
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	db.Set("other", []byte{1})
+	db.Set("user/1", []byte{2})
+	db.Delete("user/1")
+	db.ReceiveRemote(remoteDelta("user/2", []byte{3}, 100))
+
+	change := <-w.Changes
+	if change.Key != "user/1" || change.Value.Content[0] != 2 || change.Remote {
+		t.Error("Expected local set of user/1")
+	}
+	change = <-w.Changes
+	if change.Key != "user/1" || !change.Value.Deleted {
+		t.Error("Expected delete of user/1")
+	}
+	change = <-w.Changes
+	if change.Key != "user/2" || !change.Remote {
+		t.Error("Expected remote set of user/2")
+	}
+
+	w.Close()
+	if _, ok := <-w.Changes; ok {
+		t.Error("Changes should be closed after Close")
+	}
+}
+
+func TestOrderingTokens(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	// A peer with a clock far ahead must not make the next local write older.
+	db.ReceiveRemote(remoteDelta("k", []byte{1}, time.Now().Unix()+3600))
+	remote, _ := db.GetRemote("k")
+
+	local, err := db.SetWithToken("k", []byte{2})
+	if err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if !local.Supersedes(newCausalToken(remote)) {
+		t.Error("Local write should supersede the value it replaced")
+	}
+
+	filter := NewOrderFilter()
+	if !filter.Accept("k", local) {
+		t.Error("First token should be accepted")
+	}
+	if filter.Accept("k", newCausalToken(remote)) {
+		t.Error("Older token should be discarded")
+	}
+	if filter.Accept("k", local) {
+		t.Error("Repeated token should be discarded")
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("tmp/1", []byte{1})
+	db.Set("tmp/2", []byte{2})
+	db.Set("tmp/3", []byte{3})
+	db.Delete("tmp/3")
+	db.Set("keep", []byte{4})
+
+	count, err := db.DeletePrefix("tmp/", DeletePrefixOptions{DryRun: true})
+	if err != nil || count != 2 {
+		t.Error("Dry run should count two live keys")
+	}
+	if res, _ := db.Get("tmp/1"); !res.HasValue {
+		t.Error("Dry run deleted a key")
+	}
+
+	w, err := db.Watch("")
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	defer w.Close()
+
+	count, err = db.DeletePrefix("tmp/", DeletePrefixOptions{})
+	if err != nil || count != 2 {
+		t.Error("Should delete two keys")
+	}
+	if res, _ := db.Get("tmp/2"); res.HasValue {
+		t.Error("Key under prefix was not deleted")
+	}
+	if res, _ := db.Get("keep"); !res.HasValue {
+		t.Error("Key outside prefix was deleted")
+	}
+
+	first, second := <-w.Changes, <-w.Changes
+	if first.Group == "" || first.Group != second.Group {
+		t.Error("Deletes should share a change group")
+	}
+}
+
+func TestCopyAndRename(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if err := db.Copy("missing", "b", CopyOptions{}); err != ErrKeyNotFound {
+		t.Error("Copying a missing key should fail")
+	}
+
+	db.SetWithOptions("a", []byte{1}, WriteOptions{Tags: []string{"config"}})
+
+	if err := db.Copy("a", "b", CopyOptions{}); err != nil {
+		t.Error("Failed to copy")
+	}
+	b, _ := db.GetRemote("b")
+	if b == nil || b.Content[0] != 1 || len(b.Tags) != 0 {
+		t.Error("Copy without metadata has wrong value or tags")
+	}
+
+	if err := db.Rename("a", "c", CopyOptions{PreserveMetadata: true}); err != nil {
+		t.Error("Failed to rename")
+	}
+	c, _ := db.GetRemote("c")
+	if c == nil || c.Content[0] != 1 || !c.HasTag("config") {
+		t.Error("Rename with metadata has wrong value or tags")
+	}
+	if res, _ := db.Get("a"); res.HasValue {
+		t.Error("Rename should delete the source")
+	}
+}
+
+func TestRenameIsAtomic(t *testing.T) {
+	storage := &unbatchedStorage{memory: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("a", []byte{1})
+	storage.failKey = "a"
+
+	if err := db.Rename("a", "b", CopyOptions{}); err == nil {
+		t.Fatal("Rename should fail when deleting the source fails")
+	}
+	if res, _ := db.Get("b"); res.HasValue {
+		t.Error("Failed rename should not leave the destination behind")
+	}
+	if res, _ := db.Get("a"); !res.HasValue {
+		t.Error("Failed rename should keep the source")
+	}
+}
+
+func TestWatchWithOptions(t *testing.T) {
+	storage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	filters := map[string]func(Change) bool{
+		"nonEmpty": func(c Change) bool { return len(c.Value.Content) > 0 },
+	}
+	db, err := NewDatabaseWithOptions(storage, Options{WatchFilters: filters})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.WatchWithOptions("", WatchOptions{Filter: "nope"}); err != ErrUnknownWatchFilter {
+		t.Error("Unknown filter should be rejected")
+	}
+	if _, err := db.WatchWithOptions("", WatchOptions{Pattern: "["}); err == nil {
+		t.Error("Malformed pattern should be rejected")
+	}
+
+	w, err := db.WatchWithOptions("user/", WatchOptions{Pattern: "user/*/name", Filter: "nonEmpty"})
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	defer w.Close()
+	remote, err := db.WatchWithOptions("", WatchOptions{RemoteOnly: true})
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	defer remote.Close()
+
+	db.Set("user/1/email", []byte{1})
+	db.Set("user/1/name", []byte{})
+	db.Set("user/2/name", []byte{2})
+	db.ReceiveRemote(remoteDelta("x", []byte{3}, 100))
+
+	if change := <-w.Changes; change.Key != "user/2/name" {
+		t.Error("Filtered watcher got the wrong change")
+	}
+	if change := <-remote.Changes; change.Key != "x" {
+		t.Error("Remote-only watcher got a local change")
+	}
+}
+
+func TestWatchAfterClose(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	db.Close()
+
+	if w, err := db.Watch(""); w != nil || err != ErrClosed {
+		t.Error("Watch on a closed database should fail with ErrClosed")
+	}
+}
+
+func TestCloseClosesWatchers(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	w, err := db.Watch("")
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	db.Close()
+
+	select {
+	case _, ok := <-w.Changes:
+		if ok {
+			t.Error("No change was made")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close should close every watcher's Changes channel")
+	}
+	w.Close()
+}
+
+func TestNextID(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	first, err := db.NextID("orders")
+	if err != nil {
+		t.Fatal("Failed to get ID")
+	}
+	second, _ := db.NextID("orders")
+	if len(first) != 48 || !(first < second) {
+		t.Error("IDs should be fixed width and increasing")
+	}
+
+	// Sequences used in the same millisecond must not collide.
+	now := time.Now()
+	next := func(db *Database, sequence string, now time.Time) string {
+		id, err := db.nextID(sequence, now)
+		if err != nil {
+			t.Fatal("Failed to get ID")
+		}
+		return id
+	}
+	if next(db, "invoices", now) == next(db, "payments", now) {
+		t.Error("IDs from different sequences collided")
+	}
+
+	// Clock going backwards must not reorder or repeat IDs.
+	a := next(db, "clock", now)
+	b := next(db, "clock", now.Add(-time.Hour))
+	if !(a < b) {
+		t.Error("IDs went backwards with the clock")
+	}
+
+	other, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer other.Close()
+	if next(other, "x", now) == next(db, "x", now) {
+		t.Error("IDs from different nodes collided")
+	}
+
+	db.Close()
+	if _, err := db.NextID("orders"); err != ErrClosed {
+		t.Error("Expected ErrClosed from a closed database")
+	}
+}
+
+func TestNextIDSurvivesRestartWithClockBack(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	before, err := db.NextID("orders/eu")
+	if err != nil {
+		t.Fatal("Failed to get ID")
+	}
+	db.Close()
+
+	reopened, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to reopen database")
+	}
+	defer reopened.Close()
+	after, err := reopened.nextID("orders/eu", time.Now().Add(-time.Hour))
+	if err != nil || !(before < after) {
+		t.Errorf("ID after a restart with the clock back should sort after %s, got %s", before, after)
+	}
+}
+
+func TestNamedNodeID(t *testing.T) {
+	storage, err := NewMemoryStorageWithNodeID("node-a")
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	token, err := db.SetWithOptions("k", []byte{1}, WriteOptions{})
+	if err != nil || token.ModifiedBy != "node-a" {
+		t.Error("Writes should be stamped with the chosen node ID")
+	}
+
+	empty, _ := NewMemoryStorageWithNodeID("")
+	if _, err := NewDatabase(empty); err != ErrNoNodeID {
+		t.Error("Empty node ID should be refused")
+	}
+}
+
+func BenchmarkValueWinsTie(b *testing.B) {
+	x := &Value{ModifiedAt: 100, ModifiedBy: NewNodeID()}
+	y := &Value{ModifiedAt: 100, ModifiedBy: NewNodeID()}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		valueWins(x, y)
+	}
+}
+
+func TestValueExtensions(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	extensions := map[string][]byte{"checksum": {0xab}}
+	if _, err := db.SetWithOptions("k", []byte{1}, WriteOptions{Extensions: extensions}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if err := db.Touch("k", time.Hour); err != nil {
+		t.Fatal("Failed to touch value")
+	}
+
+	var snapshot bytes.Buffer
+	if err := db.Snapshot(&snapshot); err != nil {
+		t.Fatal("Failed to snapshot")
+	}
+	restored, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer restored.Close()
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatal("Failed to restore")
+	}
+
+	value, err := restored.GetRemote("k")
+	if err != nil || value == nil {
+		t.Fatal("Restored database is missing the value")
+	}
+	if data, ok := value.Extension("checksum"); !ok || !bytes.Equal(data, []byte{0xab}) {
+		t.Error("Extension should survive touch and snapshot")
+	}
+	if _, ok := value.Extension("missing"); ok {
+		t.Error("Unknown extension should not be found")
+	}
+}
+
+func TestDeleteWithVersion(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	token, err := db.SetWithToken("k", []byte{1})
+	if err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if _, err := db.SetWithToken("k", []byte{2}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+
+	if err := db.DeleteWithVersion("k", token.Version); err != ErrVersionMismatch {
+		t.Error("Delete should fail after a concurrent update")
+	}
+	if res, _ := db.Get("k"); !res.HasValue {
+		t.Error("Failed delete should leave the value")
+	}
+
+	if err := db.DeleteWithVersion("k", token.Version+1); err != nil {
+		t.Error("Delete with the current version should succeed")
+	}
+	if res, _ := db.Get("k"); res.HasValue {
+		t.Error("Value should be deleted")
+	}
+}
+
+// closingStorage counts lifecycle calls.
+type closingStorage struct {
+	*MemoryStorage
+	opens   int
+	flushes int
+	closes  int
+}
+
+func (c *closingStorage) Open() error {
+	c.opens++
+	return nil
+}
+
+func (c *closingStorage) Flush() error {
+	c.flushes++
+	return nil
+}
+
+func (c *closingStorage) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	storage := &closingStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+
+	if storage.opens != 1 {
+		t.Error("Storage should be opened by NewDatabase")
+	}
+	if err := db.Flush(); err != nil || storage.flushes != 1 {
+		t.Error("Flush should reach storage")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Error("Failed to close database")
+	}
+	if err := db.Close(); err != nil {
+		t.Error("Closing twice should be harmless")
+	}
+	if storage.flushes != 2 || storage.closes != 1 {
+		t.Error("Storage should be flushed and closed once by Close")
+	}
+	if err := db.Set("k", []byte{1}); err != ErrClosed {
+		t.Error("Calls after Close should fail with ErrClosed")
+	}
+}
+
+func TestStorageReuse(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	db.Set("k", []byte{1})
+
+	if _, err := NewDatabase(storage); err != ErrStorageInUse {
+		t.Error("Second database over open storage should be refused")
+	}
+
+	db.Close()
+	reopened, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Storage should be reusable after Close")
+	}
+	defer reopened.Close()
+	if res, _ := reopened.Get("k"); !res.HasValue {
+		t.Error("Reopened database should see earlier writes")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "LOCK")
+	lock, err := LockFile(path)
+	if err != nil {
+		t.Fatal("Failed to take lock")
+	}
+	if _, err := LockFile(path); err != ErrStorageInUse {
+		t.Error("Second lock should be refused")
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal("Failed to unlock")
+	}
+	again, err := LockFile(path)
+	if err != nil {
+		t.Fatal("Lock should be free after Unlock")
+	}
+	again.Unlock()
+}
+
+func TestScanSnapshot(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	for _, key := range []string{"s/a", "s/b", "s/c", "s/d", "other"} {
+		if err := db.Set(key, []byte(key)); err != nil {
+			t.Fatal("Failed to set value")
+		}
+	}
+	db.Delete("s/d")
+
+	scanner, err := db.Scan("s/", ScanOptions{ChunkSize: 1})
+	if err != nil {
+		t.Fatal("Failed to start scan")
+	}
+	defer scanner.Close()
+
+	seen := []string{}
+	for scanner.Next() {
+		delta := scanner.Delta()
+		seen = append(seen, delta.Key)
+		if string(delta.Value.Content) != delta.Key {
+			t.Errorf("Scan should see %s as it was when the scan started", delta.Key)
+		}
+		if delta.Key == "s/a" {
+			db.Set("s/c", []byte("changed"))
+			db.Delete("s/b")
+			db.Set("s/bb", []byte("new"))
+		}
+	}
+	if scanner.Err() != nil {
+		t.Fatal("Scan failed")
+	}
+	if strings.Join(seen, ",") != "s/a,s/b,s/c" {
+		t.Errorf("Unexpected keys %v", seen)
+	}
+	if len(db.scans) != 0 {
+		t.Error("Finished scan should unregister itself")
+	}
+}
+
+func TestListCursorSurvivesWrites(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	for _, key := range []string{"l/a", "l/b", "l/c", "l/d", "l/e"} {
+		db.Set(key, []byte{1})
+	}
+
+	page, err := db.List("l/", "", 2)
+	if err != nil || len(page.Deltas) != 2 || page.Cursor == "" {
+		t.Fatal("Expected a full first page with a cursor")
+	}
+	seen := []string{page.Deltas[0].Key, page.Deltas[1].Key}
+
+	// Deleting a returned key and inserting before the cursor must not
+	// shift the next page.
+	db.Delete("l/a")
+	db.Set("l/aa", []byte{1})
+
+	for page.Cursor != "" {
+		if page, err = db.List("l/", page.Cursor, 2); err != nil {
+			t.Fatal("Failed to list")
+		}
+		for _, delta := range page.Deltas {
+			seen = append(seen, delta.Key)
+		}
+	}
+	if strings.Join(seen, ",") != "l/a,l/b,l/c,l/d,l/e" {
+		t.Errorf("Unexpected keys %v", seen)
+	}
+
+	if _, err := db.List("other/", page.Cursor+"bad!", 2); err != ErrBadCursor {
+		t.Error("Garbage cursor should be rejected")
+	}
+}
+
+func TestExistsAndCount(t *testing.T) {
+	memory := mustMemoryStorage(t)
+	// Hides MemoryStorage.CountLive so Count falls back to reading keys.
+	listing := struct {
+		Storage
+		KeyLister
+	}{memory, memory}
+
+	for _, storage := range []Storage{memory, listing} {
+		db, err := NewDatabase(storage)
+		if err != nil {
+			t.Fatal("Failed to create database")
+		}
+
+		db.Set("c/a", []byte{1})
+		db.Set("c/b", []byte{1})
+		db.Set("c/c", []byte{1})
+		db.Set("other", []byte{1})
+		db.Delete("c/b")
+		db.SetWithOptions("c/d", []byte{1}, WriteOptions{TTL: time.Second})
+		if err := db.Touch("c/d", 0); err != nil {
+			t.Fatal("Failed to touch")
+		}
+
+		if ok, _ := db.Exists("c/a"); !ok {
+			t.Error("Set key should exist")
+		}
+		if ok, _ := db.Exists("c/b"); ok {
+			t.Error("Deleted key should not exist")
+		}
+		if n, err := db.Count("c/"); err != nil || n != 3 {
+			t.Errorf("Expected 3 live keys but got %d", n)
+		}
+		db.Close()
+	}
+}
+
+func TestGetMeta(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if value, err := db.GetMeta("k"); err != nil || value != nil {
+		t.Error("Missing key should have no header")
+	}
+	db.Set("k", bytes.Repeat([]byte{1}, 1024))
+
+	calls := storage.calls
+	value, err := db.GetMeta("k")
+	if err != nil || value == nil || value.Version != 1 || value.Content != nil {
+		t.Fatal("Expected header without content")
+	}
+	if err := db.DeleteWithVersion("k", 1); err != nil {
+		t.Fatal("Failed to delete")
+	}
+	if storage.calls != calls {
+		t.Error("Header reads should not load content")
+	}
+	if value, _ := db.GetMeta("k"); value == nil || !value.Deleted {
+		t.Error("Header of a deleted key should show the tombstone")
+	}
+}
+
+func TestFencing(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+
+	token, err := a.SetWithOptions("lock", []byte("holder 2"), WriteOptions{Fence: 2})
+	if err != nil || token.Fence != 2 {
+		t.Fatal("Fenced write should succeed and report its fence")
+	}
+	if _, err := a.SetWithOptions("lock", []byte("holder 1"), WriteOptions{Fence: 1}); err != ErrFenced {
+		t.Error("Write with an older fence should be refused")
+	}
+	if token, err := a.SetWithToken("lock", []byte("unfenced")); err != nil || token.Fence != 2 {
+		t.Error("Unfenced write should keep the key's fence")
+	}
+
+	// A stale holder writing on a replica that hadn't seen the newer fence
+	// loses everywhere, even with a later timestamp.
+	stale := remoteDelta("lock", []byte("holder 1"), time.Now().Unix()+100)
+	stale.Value.Fence = 1
+	if err := a.ReceiveRemote(stale); err != nil {
+		t.Fatal("Failed to receive delta")
+	}
+	if res, _ := a.Get("lock"); string(res.Value) != "unfenced" {
+		t.Error("Lower fence should lose whatever its timestamp")
+	}
+}
+
+func TestView(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("user/name", []byte("ann"))
+	db.Set("user/email", []byte("ann@example.com"))
+
+	err = db.View(func(tx *ReadTxn) error {
+		name, _ := tx.Get("user/name")
+
+		db.Set("user/name", []byte("bob"))
+		db.Set("user/email", []byte("bob@example.com"))
+		db.Set("user/phone", []byte("555"))
+
+		email, _ := tx.Get("user/email")
+		again, _ := tx.Get("user/name")
+		phone, _ := tx.Get("user/phone")
+		if string(name.Value) != "ann" || string(again.Value) != "ann" || string(email.Value) != "ann@example.com" {
+			t.Error("View should not see writes made after it started")
+		}
+		if phone.HasValue {
+			t.Error("View should not see keys created after it started")
+		}
+		return errors.New("done")
+	})
+	if err == nil || err.Error() != "done" {
+		t.Error("View should return fn's error")
+	}
+	if len(db.scans) != 0 {
+		t.Error("View should unregister when fn returns")
+	}
+	if res, _ := db.Get("user/name"); string(res.Value) != "bob" {
+		t.Error("Writes made during a view should still apply")
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("app/db/host", []byte("a"))
+	db.Set("app/db/port", []byte("1"))
+	db.Set("app/name", []byte("x"))
+	db.Set("app/old", []byte("y"))
+	db.Delete("app/old")
+	db.Set("apple", []byte("z"))
+
+	children, err := db.ListChildren("app")
+	if err != nil || strings.Join(children, ",") != "db,name" {
+		t.Errorf("Unexpected children %v", children)
+	}
+
+	snapshot, err := db.SubtreeSnapshot("app/db")
+	if err != nil || len(snapshot) != 2 || string(snapshot["host"]) != "a" {
+		t.Errorf("Unexpected snapshot %v", snapshot)
+	}
+
+	watcher, err := db.Watch("app/db/")
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	defer watcher.Close()
+	before, _ := db.GetRemote("app/db/port")
+	err = db.ReplaceSubtree("app/db", map[string][]byte{"port": []byte("1"), "user": []byte("u")})
+	if err != nil {
+		t.Fatal("Failed to replace subtree")
+	}
+	if snapshot, _ := db.SubtreeSnapshot("app/db"); len(snapshot) != 2 || string(snapshot["user"]) != "u" {
+		t.Errorf("Unexpected subtree after replace %v", snapshot)
+	}
+	if after, _ := db.GetRemote("app/db/port"); after.Version != before.Version {
+		t.Error("Unchanged keys should not be rewritten")
+	}
+
+	first, second := <-watcher.Changes, <-watcher.Changes
+	if first.Group == "" || first.Group != second.Group {
+		t.Error("Replace should be one change group")
+	}
+}
+
+// unbatchedStorage is MemoryStorage without SetBatch, failing every Set of
+// failKey.
+type unbatchedStorage struct {
+	memory  *MemoryStorage
+	failKey string
+}
+
+func (u *unbatchedStorage) Get(key string) (*Value, error) { return u.memory.Get(key) }
+func (u *unbatchedStorage) Delete(key string) error        { return u.memory.Delete(key) }
+func (u *unbatchedStorage) GetNodeID() (NodeID, error)     { return u.memory.GetNodeID() }
+func (u *unbatchedStorage) Keys(prefix string) ([]string, error) {
+	return u.memory.Keys(prefix)
+}
+
+func (u *unbatchedStorage) Set(key string, value *Value) error {
+	if key == u.failKey {
+		return errors.New("disk on fire")
+	}
+	return u.memory.Set(key, value)
+}
+
+func TestReplaceSubtreeRollsBack(t *testing.T) {
+	storage := &unbatchedStorage{memory: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("app/a", []byte("1"))
+	db.Set("app/c", []byte("3"))
+	storage.failKey = "app/c"
+
+	values := map[string][]byte{"a": []byte("new"), "b": []byte("new"), "c": []byte("new")}
+	if err := db.ReplaceSubtree("app", values); err == nil {
+		t.Fatal("Replace should fail when a write fails")
+	}
+	snapshot, err := db.SubtreeSnapshot("app")
+	if err != nil || len(snapshot) != 2 || string(snapshot["a"]) != "1" || string(snapshot["c"]) != "3" {
+		t.Errorf("Failed replace should leave the subtree as it was, got %v", snapshot)
+	}
+}
+
+func TestUpdateRetries(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.SetWithVersion("k", []byte("x"), 1); err != ErrVersionMismatch {
+		t.Error("Conditional set of a missing key should expect version 0")
+	}
+
+	increment := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			n, _ = strconv.Atoi(string(old))
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Update("counter", increment); err != nil {
+				t.Error("Update should retry until it wins")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if res, _ := db.Get("counter"); string(res.Value) != "5" {
+		t.Errorf("Expected 5 increments but got %s", res.Value)
+	}
+
+	abort := errors.New("abort")
+	if err := db.Update("counter", func([]byte) ([]byte, error) { return nil, abort }); err != abort {
+		t.Error("Update should return fn's error")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("2"))
+
+	resp, err := db.Txn().
+		If(CompareVersion("a", "=", 1), CompareValue("b", "=", []byte("2"))).
+		Then(OpPut("a", []byte("10")), OpDelete("b"), OpGet("a")).
+		Else(OpGet("b")).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		t.Fatal("Expected comparisons to hold")
+	}
+	if len(resp.Gets) != 1 || string(resp.Gets[0].Value) != "10" {
+		t.Error("Get should see earlier writes in the same branch")
+	}
+	if res, _ := db.Get("b"); res.HasValue {
+		t.Error("Expected b to be deleted")
+	}
+
+	resp, err = db.Txn().
+		If(CompareVersion("a", "=", 1)).
+		Then(OpPut("a", []byte("11"))).
+		Else(OpGet("a")).
+		Commit()
+	if err != nil || resp.Succeeded {
+		t.Fatal("Expected stale version comparison to fail")
+	}
+	if len(resp.Gets) != 1 || string(resp.Gets[0].Value) != "10" {
+		t.Error("Else branch should have run")
+	}
+
+	if _, err := db.Txn().If(CompareVersion("a", "~", 1)).Commit(); !errors.Is(err, ErrBadCompare) {
+		t.Error("Expected ErrBadCompare for an unknown operator")
+	}
+}
+
+func TestReadOnlyTxnWritesNothing(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	batches := storage.batches
+	if _, err := db.Txn().Then(OpGet("a")).Commit(); err != nil {
+		t.Fatal("Failed to commit")
+	}
+	if storage.batches != batches {
+		t.Error("Transaction without writes should not touch storage")
+	}
+	if _, ok := db.Stats().Storage["set_batch"]; ok {
+		t.Error("Transaction without writes should not count a batch")
+	}
+}
+
+func TestTxnRollsBack(t *testing.T) {
+	storage := &unbatchedStorage{memory: mustMemoryStorage(t), failKey: "c"}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("a", []byte("1"))
+	_, err = db.Txn().Then(OpPut("a", []byte("2")), OpPut("b", []byte("2")), OpPut("c", []byte("2"))).Commit()
+	if err == nil {
+		t.Fatal("Commit should fail when a write fails")
+	}
+	if res, _ := db.Get("a"); string(res.Value) != "1" {
+		t.Error("Failed commit should put back the old value")
+	}
+	if res, _ := db.Get("b"); res.HasValue {
+		t.Error("Failed commit should remove keys it created")
+	}
+}
+
+func TestClusterSettings(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	db, err := NewDatabaseWithOptions(storage, Options{MaxValueSize: 4, ClusterSettings: true})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+
+	config := db.ClusterConfig()
+	if err := config.Set(SettingMaxValueSize, 8); err != nil {
+		t.Fatal("Failed to set cluster setting")
+	}
+	if err := db.Set("k", []byte("123456")); err != nil {
+		t.Error("Cluster setting should raise the limit")
+	}
+	db.Close()
+
+	db, err = NewDatabaseWithOptions(storage, Options{MaxValueSize: 4, ClusterSettings: true})
+	if err != nil {
+		t.Fatal("Failed to reopen database")
+	}
+	defer db.Close()
+	if err := db.Set("k", []byte("1234567")); err != nil {
+		t.Error("Cluster setting should apply after a restart")
+	}
+
+	db.Delete(ClusterConfigPrefix + SettingMaxValueSize)
+	if err := db.Set("k", []byte("123456")); err != ErrValueTooLarge {
+		t.Error("Deleting the setting should restore the configured limit")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{MaxValueSize: 4})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if err := db.Set("k", []byte("123456")); err != ErrValueTooLarge {
+		t.Error("Expected the configured limit")
+	}
+
+	options, err := db.RuntimeOptions()
+	if err != nil || options.MaxValueSize != 4 {
+		t.Fatal("Expected the configured runtime options")
+	}
+	options.MaxValueSize = 8
+	if err := db.Reconfigure(options); err != nil {
+		t.Fatal("Failed to reconfigure")
+	}
+	if err := db.Set("k", []byte("123456")); err != nil {
+		t.Error("Reconfigured limit should apply straight away")
+	}
+}
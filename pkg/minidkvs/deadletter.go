@@ -0,0 +1,114 @@
+package minidkvs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDeltaRejected is returned by ReceiveRemote when a delta fails validation.
+// The returned error wraps it with the reason.
+var ErrDeltaRejected = errors.New("minidkvs: delta rejected")
+
+// ErrFenced is returned by writes whose WriteOptions.Fence is lower than one
+// the key has already seen.
+var ErrFenced = errors.New("minidkvs: write fenced by a newer token")
+
+// ErrValueTooLarge is returned by writes whose content exceeds
+// Options.MaxValueSize.
+var ErrValueTooLarge = errors.New("minidkvs: value too large")
+
+// DeadLetter is a delta that was rejected, kept so operators can work out why
+// nodes disagree.
+type DeadLetter struct {
+	Delta      *Delta
+	Reason     string
+	RejectedAt int64
+}
+
+// DeadLetterStore is interface for persisting rejected deltas. Like Storage it
+// is only ever called from the database's message loop.
+type DeadLetterStore interface {
+	Add(letter DeadLetter) error
+	List() ([]DeadLetter, error)
+}
+
+// MemoryDeadLetters is a pure-memory implementation of DeadLetterStore.
+type MemoryDeadLetters struct {
+	letters []DeadLetter
+}
+
+// Add appends to the in-memory list.
+func (m *MemoryDeadLetters) Add(letter DeadLetter) error {
+	m.letters = append(m.letters, letter)
+	return nil
+}
+
+// List returns a copy of every dead letter, oldest first.
+func (m *MemoryDeadLetters) List() ([]DeadLetter, error) {
+	return append([]DeadLetter(nil), m.letters...), nil
+}
+
+// NewMemoryDeadLetters is ctor for MemoryDeadLetters.
+func NewMemoryDeadLetters() *MemoryDeadLetters {
+	return &MemoryDeadLetters{}
+}
+
+// tryDeadLetters wraps a list of dead letters and includes error obj.
+type tryDeadLetters struct {
+	letters []DeadLetter
+	err     error
+}
+
+// DeadLetters returns every delta rejected so far. It returns nothing when
+// Options.DeadLetters is not set.
+func (d *Database) DeadLetters() ([]DeadLetter, error) {
+	m := dbMessageLetters{replyChan: make(chan tryDeadLetters, 1)}
+	try, err := call(d, newLettersMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	return try.letters, try.err
+}
+
+// validateDelta checks a delta from a peer and returns why it is unacceptable,
+// or an empty string when it is fine.
+func (d *Database) validateDelta(delta *Delta) string {
+	if delta.Key == "" {
+		return "empty key"
+	}
+	if delta.Value == nil {
+		return "missing value"
+	}
+	if delta.Value.Generation < d.options.Generation {
+		return fmt.Sprintf("delta is from generation %d, cluster is at %d", delta.Value.Generation, d.options.Generation)
+	}
+	if !d.pinnedTo(delta.Key, d.nodeID) {
+		return "key is pinned to other nodes"
+	}
+	if ns := d.namespace(delta.Key); ns.Mode == SingleWriter && delta.Value.ModifiedBy != ns.Writer {
+		return fmt.Sprintf("key is only written by %s", ns.Writer)
+	}
+	if d.options.MaxValueSize > 0 && len(delta.Value.Content) > d.options.MaxValueSize {
+		return fmt.Sprintf("value is %d bytes, limit is %d", len(delta.Value.Content), d.options.MaxValueSize)
+	}
+	if d.options.ValidateDelta != nil {
+		if err := d.options.ValidateDelta(delta); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// reject records delta in the dead-letter store, if there is one, and returns
+// the error for the sender.
+func (d *Database) reject(delta *Delta, reason string) error {
+	d.rejected++
+	if d.options.DeadLetters != nil {
+		letter := DeadLetter{Delta: delta, Reason: reason, RejectedAt: time.Now().Unix()}
+		if err := d.options.DeadLetters.Add(letter); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDeltaRejected, reason)
+}
@@ -0,0 +1,131 @@
+package minidkvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DiffKind says how a key differs between two replicas.
+type DiffKind int32
+
+const (
+	// DiffMissingLeft means only the right replica has the key.
+	DiffMissingLeft DiffKind = 0
+	// DiffMissingRight means only the left replica has the key.
+	DiffMissingRight DiffKind = 1
+	// DiffVersion means both have the same content from different writes.
+	DiffVersion DiffKind = 2
+	// DiffContent means the replicas disagree on the content.
+	DiffContent DiffKind = 3
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffMissingLeft:
+		return "missing-left"
+	case DiffMissingRight:
+		return "missing-right"
+	case DiffVersion:
+		return "version"
+	case DiffContent:
+		return "content"
+	}
+	return "unknown"
+}
+
+// KeyDiff is one key on which two replicas disagree. Left or Right is nil when
+// that side doesn't have the key.
+type KeyDiff struct {
+	Key   string
+	Kind  DiffKind
+	Left  *Value
+	Right *Value
+}
+
+// DiffDatabases snapshots two databases and compares them key by key.
+func DiffDatabases(left, right *Database) ([]KeyDiff, error) {
+	var l, r bytes.Buffer
+	if err := left.Snapshot(&l); err != nil {
+		return nil, err
+	}
+	if err := right.Snapshot(&r); err != nil {
+		return nil, err
+	}
+	return DiffSnapshots(&l, &r)
+}
+
+// DiffSnapshots compares two snapshots written by Snapshot and returns every
+// differing key, sorted by key. Deleted keys count as present, so a tombstone
+// on one side and nothing on the other is a difference.
+func DiffSnapshots(left, right io.Reader) ([]KeyDiff, error) {
+	l, err := readSnapshot(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := readSnapshot(right)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []KeyDiff{}
+	for key, lv := range l {
+		rv, ok := r[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, KeyDiff{Key: key, Kind: DiffMissingRight, Left: lv})
+		case lv.Deleted != rv.Deleted || !bytes.Equal(lv.Content, rv.Content):
+			diffs = append(diffs, KeyDiff{Key: key, Kind: DiffContent, Left: lv, Right: rv})
+		case !sameWrite(lv, rv) || lv.Version != rv.Version:
+			diffs = append(diffs, KeyDiff{Key: key, Kind: DiffVersion, Left: lv, Right: rv})
+		}
+	}
+	for key, rv := range r {
+		if _, ok := l[key]; !ok {
+			diffs = append(diffs, KeyDiff{Key: key, Kind: DiffMissingLeft, Right: rv})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// WriteDiffReport prints diffs one per line, followed by a summary count.
+func WriteDiffReport(w io.Writer, diffs []KeyDiff) error {
+	describe := func(v *Value) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("v%d@%d by %s (%d bytes, deleted=%t)",
+			v.Version, v.ModifiedAt, v.ModifiedBy, len(v.Content), v.Deleted)
+	}
+
+	for _, diff := range diffs {
+		_, err := fmt.Fprintf(w, "%-13s %s\n  left:  %s\n  right: %s\n",
+			diff.Kind, diff.Key, describe(diff.Left), describe(diff.Right))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d differing keys\n", len(diffs))
+	return err
+}
+
+// readSnapshot loads a snapshot into memory keyed by key.
+func readSnapshot(r io.Reader) (map[string]*Value, error) {
+	values := make(map[string]*Value)
+	decoder := json.NewDecoder(r)
+	for {
+		var delta Delta
+		err := decoder.Decode(&delta)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[delta.Key] = delta.Value
+	}
+}
@@ -0,0 +1,96 @@
+package minidkvs
+
+import "encoding/binary"
+
+// digests holds one hash per bucket of the keyspace for
+// Options.DigestBuckets. A bucket's digest is the XOR of the hashes of every
+// key in it, so a write updates it by removing the old value's hash and adding
+// the new one. Only used from the message loop.
+type digests struct {
+	buckets []uint64
+
+	// ready is set once the initial scan has run. Until then writes don't
+	// need to update anything since the scan will see them.
+	ready bool
+}
+
+// DigestBucket returns which of the Options.DigestBuckets buckets key
+// belongs to: its KeyHash modulo the number of buckets.
+func (d *Database) DigestBucket(key string) int {
+	return d.bucket(key, d.options.DigestBuckets)
+}
+
+func (d *Database) bucket(key string, n int) int {
+	return int(d.KeyHash(key) % uint64(n))
+}
+
+// entryHash hashes everything about a stored value that replicas must agree
+// on. A nil value hashes to zero so that it drops out of the XOR.
+func (d *Database) entryHash(key string, value *Value) uint64 {
+	if value == nil {
+		return 0
+	}
+	buf := make([]byte, 0, len(key)+len(value.ModifiedBy)+17)
+	buf = append(buf, key...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(value.Version))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(value.ModifiedAt))
+	buf = append(buf, value.ModifiedBy...)
+	if value.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return d.hasher().Hash64(buf)
+}
+
+// Digests returns the digest of each of the Options.DigestBuckets buckets.
+// Two replicas holding the same data have the same digests, so transports can
+// exchange them to find which buckets differ without sending keys. The first
+// call scans every key, which needs a KeyLister storage; after that digests
+// are kept up to date by writes.
+func (d *Database) Digests() ([]uint64, error) {
+	m := dbMessageDigests{replyChan: make(chan tryDigests, 1)}
+	try, err := call(d, newDigestsMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	return try.digests, try.err
+}
+
+type tryDigests struct {
+	digests []uint64
+	err     error
+}
+
+// currentDigests does the work of Digests. Only called from the message loop.
+func (d *Database) currentDigests() ([]uint64, error) {
+	n := d.options.DigestBuckets
+	if n <= 0 {
+		return nil, nil
+	}
+
+	if !d.digests.ready {
+		keys, err := d.storageKeys("")
+		if err != nil {
+			return nil, err
+		}
+		buckets := make([]uint64, n)
+		for _, key := range keys {
+			value, err := d.storageGetMeta(key)
+			if err != nil {
+				return nil, err
+			}
+			buckets[d.bucket(key, n)] ^= d.entryHash(key, value)
+		}
+		d.digests = digests{buckets: buckets, ready: true}
+	}
+
+	return append([]uint64(nil), d.digests.buckets...), nil
+}
+
+// digestWrite updates the digest for key being changed from old to value.
+func (d *Database) digestWrite(key string, old, value *Value) {
+	if d.digests.ready {
+		d.digests.buckets[d.bucket(key, len(d.digests.buckets))] ^= d.entryHash(key, old) ^ d.entryHash(key, value)
+	}
+}
@@ -0,0 +1,12 @@
+package minidkvs
+
+import "expvar"
+
+// PublishExpvar publishes Stats under name in expvar, so they show up at
+// /debug/vars on the default HTTP mux. Stats are gathered whenever the
+// variable is read. Like expvar.Publish it panics if name is already taken.
+func (d *Database) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return d.Stats()
+	}))
+}
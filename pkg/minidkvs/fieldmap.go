@@ -0,0 +1,112 @@
+package minidkvs
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// FieldMap stores records as observed-remove maps of fields. Every write of a
+// field is kept under its own key prefix+record+"/"+field+"/"+tag with a fresh
+// tag, and replaces only the writes of that field it has seen. Deleting a
+// field likewise removes only the writes it has seen, so a field set on one
+// node while deleted on another survives. Concurrent sets of one field are
+// both kept and read as the last writer's. Record and field are path-escaped
+// in the key, so either may contain "/".
+type FieldMap struct {
+	db     *Database
+	prefix string
+}
+
+// NewFieldMap is ctor for FieldMap.
+func NewFieldMap(db *Database, prefix string) *FieldMap {
+	return &FieldMap{db: db, prefix: prefix}
+}
+
+// recordPrefix is the prefix of every write of every field of record.
+func (m *FieldMap) recordPrefix(record string) string {
+	return m.prefix + url.PathEscape(record) + "/"
+}
+
+// fieldPrefix is the prefix of every write of one field of record.
+func (m *FieldMap) fieldPrefix(record, field string) string {
+	return m.recordPrefix(record) + url.PathEscape(field) + "/"
+}
+
+// SetField sets one field of record, replacing the writes of it seen so far.
+func (m *FieldMap) SetField(record, field string, value []byte) error {
+	prefix := m.fieldPrefix(record, field)
+	seen, err := m.db.dumpLive(prefix)
+	if err != nil {
+		return err
+	}
+	ops := []TxnOp{OpPut(prefix+uuid.New().String(), value)}
+	for _, delta := range seen {
+		ops = append(ops, OpDelete(delta.Key))
+	}
+	_, err = m.db.Txn().Then(ops...).Commit()
+	return err
+}
+
+// DeleteField removes the writes of one field of record seen so far.
+func (m *FieldMap) DeleteField(record, field string) error {
+	seen, err := m.db.dumpLive(m.fieldPrefix(record, field))
+	if err != nil || len(seen) == 0 {
+		return err
+	}
+	ops := make([]TxnOp, len(seen))
+	for i, delta := range seen {
+		ops[i] = OpDelete(delta.Key)
+	}
+	_, err = m.db.Txn().Then(ops...).Commit()
+	return err
+}
+
+// GetField returns one field of record and whether it is set. It needs a
+// KeyLister storage.
+func (m *FieldMap) GetField(record, field string) ([]byte, bool, error) {
+	fields, err := m.fields(m.fieldPrefix(record, field), m.recordPrefix(record))
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := fields[field]
+	return value, ok, nil
+}
+
+// GetMap returns every field of record, read at one consistent point. A record
+// with no fields gives an empty map. It needs a KeyLister storage.
+func (m *FieldMap) GetMap(record string) (map[string][]byte, error) {
+	prefix := m.recordPrefix(record)
+	return m.fields(prefix, prefix)
+}
+
+// fields reads the live writes under prefix, which starts with recordPrefix,
+// and keeps the last writer's value of each field.
+func (m *FieldMap) fields(prefix, recordPrefix string) (map[string][]byte, error) {
+	deltas, err := m.db.dumpLive(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	winners := make(map[string]*Value)
+	for _, delta := range deltas {
+		escaped, tag, ok := strings.Cut(delta.Key[len(recordPrefix):], "/")
+		if !ok || strings.Contains(tag, "/") {
+			continue
+		}
+		field, err := url.PathUnescape(escaped)
+		if err != nil {
+			return nil, &CodecError{Key: delta.Key, Err: err}
+		}
+		if current, ok := winners[field]; !ok || valueWins(delta.Value, current) {
+			winners[field] = delta.Value
+		}
+	}
+
+	fields := make(map[string][]byte, len(winners))
+	for field, value := range winners {
+		fields[field] = value.Content
+	}
+	return fields, nil
+}
@@ -0,0 +1,76 @@
+package minidkvs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFieldMapMerges(t *testing.T) {
+	a, _ := NewMemoryDatabase()
+	defer a.Close()
+	b, _ := NewMemoryDatabase()
+	defer b.Close()
+
+	usersA, usersB := NewFieldMap(a, "users/"), NewFieldMap(b, "users/")
+	usersA.SetField("1", "name", []byte("ann"))
+	usersA.SetField("1", "email", []byte("ann@example.com"))
+	syncAll(t, a, b)
+
+	usersA.SetField("1", "name", []byte("anne"))
+	usersB.SetField("1", "phone", []byte("555"))
+	usersB.DeleteField("1", "email")
+	syncAll(t, a, b)
+
+	for _, users := range []*FieldMap{usersA, usersB} {
+		record, err := users.GetMap("1")
+		if err != nil {
+			t.Fatal("Failed to read record")
+		}
+		if len(record) != 2 || string(record["name"]) != "anne" || string(record["phone"]) != "555" {
+			t.Errorf("Unexpected record %q", record)
+		}
+	}
+}
+
+func TestFieldMapSetWinsOverConcurrentDelete(t *testing.T) {
+	a, _ := NewMemoryDatabase()
+	defer a.Close()
+	b, _ := NewMemoryDatabase()
+	defer b.Close()
+
+	usersA, usersB := NewFieldMap(a, "users/"), NewFieldMap(b, "users/")
+	usersA.SetField("1", "name", []byte("ann"))
+	syncAll(t, a, b)
+
+	// The delete is the later write, so last-writer-wins would drop the field.
+	usersA.SetField("1", "name", []byte("anne"))
+	time.Sleep(1100 * time.Millisecond)
+	usersB.DeleteField("1", "name")
+	syncAll(t, a, b)
+
+	for _, users := range []*FieldMap{usersA, usersB} {
+		if value, ok, err := users.GetField("1", "name"); err != nil || !ok || string(value) != "anne" {
+			t.Errorf("Set should survive a delete that didn't see it, got %q", value)
+		}
+	}
+}
+
+func TestFieldMapEscapesRecordAndField(t *testing.T) {
+	db, _ := NewMemoryDatabase()
+	defer db.Close()
+
+	users := NewFieldMap(db, "users/")
+	users.SetField("1", "a/b", []byte("x"))
+	users.SetField("1/2", "c", []byte("y"))
+
+	record, err := users.GetMap("1")
+	if err != nil {
+		t.Fatal("Failed to read record")
+	}
+	if len(record) != 1 || string(record["a/b"]) != "x" {
+		t.Errorf("Record should hold only its own field, got %q", record)
+	}
+	if value, ok, _ := users.GetField("1/2", "c"); !ok || string(value) != "y" {
+		t.Error("Record with a slash should be readable")
+	}
+}
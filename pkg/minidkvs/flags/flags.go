@@ -0,0 +1,172 @@
+// Package flags is a replicated feature-flag store on top of minidkvs. Flag
+// definitions are JSON values under a prefix, so any node can change them and
+// every node picks the change up as it replicates.
+package flags
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graeme-hill/minidkvs/pkg/minidkvs"
+)
+
+// Flag defines who a feature is on for.
+type Flag struct {
+	// Enabled is the kill switch. When false the flag is off for everyone
+	// regardless of rules and rollout.
+	Enabled bool `json:"enabled"`
+
+	// Rules are tried in order and the first that matches the subject
+	// decides.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Rollout is the percentage, 0 to 100, of the remaining subjects the
+	// flag is on for. Each subject always lands in the same place for a
+	// given flag, on every node. A plain boolean flag uses 100.
+	Rollout int `json:"rollout"`
+}
+
+// Rule matches subjects whose Attribute is one of Values.
+type Rule struct {
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+	Enabled   bool     `json:"enabled"`
+}
+
+// Subject is who a flag is evaluated for.
+type Subject struct {
+	// ID seeds percentage rollouts, typically a user or device ID.
+	ID         string
+	Attributes map[string]string
+}
+
+// Flags evaluates the flags stored under a prefix, keeping them up to date
+// through a watcher. It is safe for concurrent use.
+type Flags struct {
+	db     *minidkvs.Database
+	prefix string
+
+	mu    sync.RWMutex
+	flags map[string]definition
+
+	watcher *minidkvs.Watcher
+	done    chan struct{}
+}
+
+// definition is a loaded Flag with the expiry of the value it came from.
+// Expiry doesn't produce a change, so Enabled checks it on every call.
+type definition struct {
+	Flag
+	expiresAt int64
+}
+
+// listPage is how many definitions New reads per List call.
+const listPage = 256
+
+// New loads every flag stored under prefix and keeps them reloaded until
+// Close. It needs a KeyLister storage.
+func New(db *minidkvs.Database, prefix string) (*Flags, error) {
+	watcher, err := db.Watch(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Flags{
+		db:      db,
+		prefix:  prefix,
+		flags:   make(map[string]definition),
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+
+	// The watcher is started first so no change between the load and the
+	// reload loop is missed.
+	cursor := ""
+	for {
+		page, err := db.List(prefix, cursor, listPage)
+		if err != nil {
+			f.watcher.Close()
+			return nil, err
+		}
+		for _, delta := range page.Deltas {
+			f.apply(delta.Key, delta.Value)
+		}
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+
+	go func() {
+		defer close(f.done)
+		for change := range f.watcher.Changes {
+			f.apply(change.Key, change.Value)
+		}
+	}()
+	return f, nil
+}
+
+// Define stores flag under name. Every node watching the prefix reloads it.
+func (f *Flags) Define(name string, flag Flag) error {
+	return f.db.SetJSON(f.prefix+name, flag)
+}
+
+// Remove deletes the flag, which then evaluates as off.
+func (f *Flags) Remove(name string) error {
+	return f.db.Delete(f.prefix + name)
+}
+
+// Enabled reports whether the named flag is on for subject. Unknown flags,
+// expired flags and flags whose stored definition isn't valid JSON are off.
+func (f *Flags) Enabled(name string, subject Subject) bool {
+	f.mu.RLock()
+	flag, ok := f.flags[name]
+	f.mu.RUnlock()
+	if !ok || !flag.Enabled || (flag.expiresAt != 0 && flag.expiresAt <= time.Now().Unix()) {
+		return false
+	}
+
+	for _, rule := range flag.Rules {
+		value, ok := subject.Attributes[rule.Attribute]
+		if !ok {
+			continue
+		}
+		for _, v := range rule.Values {
+			if v == value {
+				return rule.Enabled
+			}
+		}
+	}
+
+	return bucket(name, subject.ID) < flag.Rollout
+}
+
+// Close stops reloading. Enabled keeps answering from the last definitions.
+func (f *Flags) Close() {
+	f.watcher.Close()
+	<-f.done
+}
+
+// apply updates the flag stored at key to value.
+func (f *Flags) apply(key string, value *minidkvs.Value) {
+	name := strings.TrimPrefix(key, f.prefix)
+
+	var flag Flag
+	live := value != nil && !value.Deleted && !value.Expired(time.Now().Unix()) &&
+		json.Unmarshal(value.Content, &flag) == nil
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if live {
+		f.flags[name] = definition{Flag: flag, expiresAt: value.ExpiresAt}
+	} else {
+		delete(f.flags, name)
+	}
+}
+
+// bucket places id in 0 to 99 for the named flag. Hashing the name too keeps
+// the same subjects from getting every flag at a low rollout.
+func bucket(name, id string) int {
+	return int(minidkvs.XXHash64([]byte(name+"\x00"+id)) % 100)
+}
@@ -0,0 +1,123 @@
+package flags
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/graeme-hill/minidkvs/pkg/minidkvs"
+)
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestFlags(t *testing.T) {
+	db, err := minidkvs.NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.SetJSON("flags/dark-mode", Flag{Enabled: true, Rollout: 100})
+
+	f, err := New(db, "flags/")
+	if err != nil {
+		t.Fatal("Failed to load flags")
+	}
+	defer f.Close()
+
+	anyone := Subject{ID: "u1"}
+	if !f.Enabled("dark-mode", anyone) {
+		t.Error("Boolean flag should be on")
+	}
+	if f.Enabled("missing", anyone) {
+		t.Error("Unknown flag should be off")
+	}
+
+	f.Define("beta", Flag{
+		Enabled: true,
+		Rules:   []Rule{{Attribute: "plan", Values: []string{"free"}, Enabled: false}},
+		Rollout: 50,
+	})
+	loaded := func() bool {
+		for i := 0; i < 100; i++ {
+			if f.Enabled("beta", Subject{ID: fmt.Sprint(i)}) {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitFor(loaded) {
+		t.Fatal("Defined flag should be reloaded")
+	}
+
+	on := 0
+	for i := 0; i < 1000; i++ {
+		subject := Subject{ID: fmt.Sprint(i)}
+		if f.Enabled("beta", subject) {
+			on++
+		}
+		if f.Enabled("beta", subject) != f.Enabled("beta", subject) {
+			t.Fatal("Rollout should be stable per subject")
+		}
+		subject.Attributes = map[string]string{"plan": "free"}
+		if f.Enabled("beta", subject) {
+			t.Fatal("Targeting rule should override rollout")
+		}
+	}
+	if on < 400 || on > 600 {
+		t.Errorf("Expected about half of subjects but got %d", on)
+	}
+
+	f.Define("dark-mode", Flag{Enabled: false, Rollout: 100})
+	if !waitFor(func() bool { return !f.Enabled("dark-mode", anyone) }) {
+		t.Error("Kill switch should turn the flag off")
+	}
+}
+
+func TestExpiredFlagsAreOff(t *testing.T) {
+	db, err := minidkvs.NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	expiring := func(key string, expiresAt int64) *minidkvs.Delta {
+		return &minidkvs.Delta{Key: key, Value: &minidkvs.Value{
+			Version:    1,
+			ModifiedBy: minidkvs.NewNodeID(),
+			ModifiedAt: now,
+			ExpiresAt:  expiresAt,
+			Content:    []byte(`{"enabled":true,"rollout":100}`),
+		}}
+	}
+	db.ReceiveRemote(expiring("flags/old", now-1))
+	db.ReceiveRemote(expiring("flags/soon", now+1))
+
+	f, err := New(db, "flags/")
+	if err != nil {
+		t.Fatal("Failed to load flags")
+	}
+	defer f.Close()
+
+	anyone := Subject{ID: "u1"}
+	if f.Enabled("old", anyone) {
+		t.Error("Flag that had already expired should be off")
+	}
+	if !f.Enabled("soon", anyone) {
+		t.Error("Flag should be on until it expires")
+	}
+	time.Sleep(time.Until(time.Unix(now+2, 0)))
+	if f.Enabled("soon", anyone) {
+		t.Error("Flag should be off once it expires")
+	}
+}
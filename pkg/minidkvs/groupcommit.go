@@ -0,0 +1,78 @@
+package minidkvs
+
+import "time"
+
+// BatchStorage is an optional Storage extension for backends that can store
+// several values at once more cheaply than one at a time, typically with a
+// single fsync. SetBatch must store all of the deltas or, when it returns an
+// error, none of them.
+type BatchStorage interface {
+	SetBatch(deltas []Delta) error
+}
+
+// groupCommit collects local writes for up to Options.GroupCommitWindow,
+// starting with first, and stores them with one SetBatch. Only called from the
+// message loop. Any other message arriving in the window ends the group early
+// and is returned to be handled next, so operations still run in the order
+// they were sent. If SetBatch fails every write in the group fails.
+func (d *Database) groupCommit(first *dbMessageSet) *dbMessage {
+	group := []*dbMessageSet{first}
+	var next *dbMessage
+
+	timer := time.NewTimer(d.options.GroupCommitWindow)
+	defer timer.Stop()
+
+collect:
+	for {
+		select {
+		case msg := <-d.msgChan:
+			if msg.msgType != dbMessageTypeSet {
+				next = &msg
+				break collect
+			}
+			group = append(group, msg.setMsg)
+		case <-timer.C:
+			break collect
+		}
+	}
+
+	results := make([]tryValue, len(group))
+	staged := make(map[string]*Value)
+	deltas := []Delta{}
+
+	for i, m := range group {
+		existing, ok := staged[m.key]
+		if !ok {
+			var err error
+			if existing, err = d.storageGet(m.key); err != nil {
+				results[i].err = err
+				continue
+			}
+		}
+
+		value, err := d.prepareLocal(existing, m.value, m.options)
+		if err == nil {
+			err = d.checkWriter(m.key)
+		}
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		staged[m.key] = value
+		results[i].value = value
+		deltas = append(deltas, Delta{Key: m.key, Value: value})
+	}
+
+	err := d.storageSetBatch(deltas)
+	for i, m := range group {
+		if results[i].err == nil && err != nil {
+			results[i] = tryValue{err: err}
+		}
+		if results[i].err == nil {
+			results[i].err = d.stored(Change{Key: m.key, Value: results[i].value, Actor: m.options.Actor})
+		}
+		m.replyChan <- results[i]
+	}
+
+	return next
+}
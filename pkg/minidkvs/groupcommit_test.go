@@ -0,0 +1,121 @@
+package minidkvs
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStorage counts SetBatch calls on top of MemoryStorage.
+type countingStorage struct {
+	*MemoryStorage
+	batches int
+}
+
+func (c *countingStorage) SetBatch(deltas []Delta) error {
+	c.batches++
+	return c.MemoryStorage.SetBatch(deltas)
+}
+
+func TestGroupCommit(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: mustMemoryStorage(t)}
+	options := Options{GroupCommitWindow: 50 * time.Millisecond}
+	db, err := NewDatabaseWithOptions(storage, options)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Set("k", []byte{byte(i)}); err != nil {
+				t.Error("Failed to set value")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	value, _ := db.GetRemote("k")
+	if value == nil || value.Version != 10 {
+		t.Error("Every grouped write should bump the version")
+	}
+	if storage.batches >= 10 {
+		t.Error("Writes should have been grouped into fewer batches")
+	}
+}
+
+func TestReconfigureGroupCommit(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	options, _ := db.RuntimeOptions()
+	options.GroupCommitWindow = 10 * time.Millisecond
+	if err := db.Reconfigure(options); err != nil {
+		t.Fatal("Failed to reconfigure")
+	}
+	if err := db.Set("k", []byte("v")); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if storage.batches == 0 {
+		t.Error("Reconfigured group commit window should apply to later writes")
+	}
+}
+
+func (c *countingStorage) Metrics() map[string]OpStats {
+	return map[string]OpStats{"set_batch": {Count: int64(c.batches)}}
+}
+
+func TestStats(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("k", []byte{1, 2, 3})
+	db.Get("k")
+
+	stats := db.Stats()
+	set := stats.Storage["set"]
+	if set.Count != 1 || set.Bytes != 3 || set.Errors != 0 {
+		t.Error("Set should be counted once with its bytes")
+	}
+	if stats.Storage["get"].Count != 2 {
+		t.Error("Set and Get should each read storage once")
+	}
+	if _, ok := stats.Backend["set_batch"]; !ok {
+		t.Error("Backend metrics should be included")
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.AddPeer(failingPeer{})
+	db.ReceiveRemote(&Delta{Key: "bad"})
+	// expvar names can't be reused, so make it unique per run.
+	name := "minidkvs_test_" + string(db.NodeID())
+	db.PublishExpvar(name)
+
+	var stats Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatal("Published stats should be JSON")
+	}
+	if stats.InFlight != 1 || stats.Peers != 1 || stats.Rejected != 1 {
+		t.Errorf("Unexpected published stats %+v", stats)
+	}
+}
@@ -0,0 +1,120 @@
+package minidkvs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+)
+
+// Hasher is the hash function used for digest buckets. Every node in a
+// cluster must use the same one. Implement it to match the placement of an
+// existing consistent-hash ring.
+type Hasher interface {
+	Hash64(data []byte) uint64
+}
+
+// HasherFunc adapts a function to Hasher.
+type HasherFunc func(data []byte) uint64
+
+// Hash64 calls f.
+func (f HasherFunc) Hash64(data []byte) uint64 {
+	return f(data)
+}
+
+// DefaultHasher is used when Options.Hasher is nil. It is XXHash64.
+var DefaultHasher Hasher = HasherFunc(XXHash64)
+
+// FNV64a is 64-bit FNV-1a as a Hasher.
+var FNV64a Hasher = HasherFunc(func(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+})
+
+// KeyHash hashes key with DefaultHasher.
+func KeyHash(key string) uint64 {
+	return XXHash64([]byte(key))
+}
+
+// KeyHash hashes key with the database's Hasher.
+func (d *Database) KeyHash(key string) uint64 {
+	return d.hasher().Hash64([]byte(key))
+}
+
+func (d *Database) hasher() Hasher {
+	if d.options.Hasher == nil {
+		return DefaultHasher
+	}
+	return d.options.Hasher
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 is the 64-bit xxHash of data with a zero seed.
+func XXHash64(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+
+	if n >= 32 {
+		// Variables rather than constants so that the sums wrap.
+		prime1, prime2 := xxPrime1, xxPrime2
+		v1 := prime1 + prime2
+		v2 := prime2
+		v3 := uint64(0)
+		v4 := -prime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:32]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
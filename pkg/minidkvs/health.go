@@ -0,0 +1,92 @@
+package minidkvs
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultHealthTimeout is how long the HTTP health endpoints wait for the
+// message loop to answer.
+const DefaultHealthTimeout = 2 * time.Second
+
+// healthProbeKey is read from storage to check that it answers. Its value
+// doesn't matter.
+const healthProbeKey = ReservedPrefix + "health-probe"
+
+// Health is the result of a health check.
+type Health struct {
+	// LoopResponsive is true if the message loop answered in time.
+	LoopResponsive bool
+
+	// StorageReachable is true if a read from storage succeeded.
+	StorageReachable bool
+
+	// StorageError says why storage isn't reachable.
+	StorageError string `json:",omitempty"`
+}
+
+// Live reports whether the process should be left running. A stuck message
+// loop never recovers, so that is the only thing that makes a node not live.
+func (h Health) Live() bool {
+	return h.LoopResponsive
+}
+
+// Ready reports whether the node should receive traffic.
+func (h Health) Ready() bool {
+	return h.LoopResponsive && h.StorageReachable
+}
+
+// Health checks that the message loop answers within timeout and that storage
+// can be read. It never blocks for longer than timeout.
+func (d *Database) Health(timeout time.Duration) Health {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Buffered so a loop that answers after we gave up doesn't block.
+	m := dbMessageHealth{replyChan: make(chan error, 1)}
+
+	select {
+	case d.msgChan <- newHealthMessage(&m):
+	case <-timer.C:
+		return Health{}
+	case <-d.stopped:
+		return Health{}
+	}
+
+	select {
+	case err := <-m.replyChan:
+		health := Health{LoopResponsive: true, StorageReachable: err == nil}
+		if err != nil {
+			health.StorageError = err.Error()
+		}
+		return health
+	case <-timer.C:
+		return Health{}
+	case <-d.stopped:
+		return Health{}
+	}
+}
+
+// HealthHandler serves /healthz (liveness) and /readyz (readiness) for
+// orchestrators like Kubernetes. Both answer 200 when healthy and 503 when
+// not, with the Health as a JSON body.
+func (d *Database) HealthHandler() http.Handler {
+	check := func(ok func(Health) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			health := d.Health(DefaultHealthTimeout)
+			w.Header().Set("Content-Type", "application/json")
+			if ok(health) {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(&health)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", check(Health.Live))
+	mux.Handle("/readyz", check(Health.Ready))
+	return mux
+}
@@ -0,0 +1,40 @@
+package minidkvs
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: mustMemoryStorage(t)}
+	db, err := NewDatabaseWithOptions(storage, Options{})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	handler := db.HealthHandler()
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if status("/healthz") != 200 || status("/readyz") != 200 {
+		t.Error("Healthy node should pass both checks")
+	}
+
+	storage.broken = true
+	if status("/healthz") != 200 {
+		t.Error("Broken storage should not fail liveness")
+	}
+	if status("/readyz") != 503 {
+		t.Error("Broken storage should fail readiness")
+	}
+
+	stuck := &Database{msgChan: make(chan dbMessage)}
+	if health := stuck.Health(10 * time.Millisecond); health.Live() {
+		t.Error("Unresponsive loop should not be live")
+	}
+}
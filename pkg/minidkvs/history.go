@@ -0,0 +1,150 @@
+package minidkvs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrHistoryDisabled is returned by operations that need version history when
+// Options.HistoryRetention is zero or the Storage doesn't keep history.
+var ErrHistoryDisabled = errors.New("minidkvs: version history not enabled")
+
+// HistoryStorage is an optional Storage extension for keeping past versions of
+// each key.
+type HistoryStorage interface {
+	// AppendHistory adds a version to the end of the key's history.
+	AppendHistory(key string, v *Value) error
+	// GetHistory returns the key's versions in the order they were applied.
+	GetHistory(key string) ([]Value, error)
+	// TrimHistory drops the oldest drop versions of the key's history.
+	TrimHistory(key string, drop int) error
+}
+
+// history returns the storage as HistoryStorage if history is enabled.
+func (d *Database) history() (HistoryStorage, bool) {
+	if d.options.HistoryRetention <= 0 {
+		return nil, false
+	}
+	history, ok := d.storage.(HistoryStorage)
+	return history, ok
+}
+
+// recordHistory appends a newly stored version and prunes versions that fell
+// out of the retention window. The newest version older than the window is
+// kept since it is still the answer for reads at the start of the window.
+func (d *Database) recordHistory(key string, value *Value) error {
+	history, ok := d.history()
+	if !ok {
+		return nil
+	}
+	if err := history.AppendHistory(key, value); err != nil {
+		return err
+	}
+
+	versions, err := history.GetHistory(key)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-d.options.HistoryRetention).Unix()
+	drop := 0
+	for drop+1 < len(versions) && versions[drop+1].ModifiedAt <= cutoff {
+		drop++
+	}
+	if drop == 0 {
+		return nil
+	}
+	return history.TrimHistory(key, drop)
+}
+
+// GetAt returns the value key had at the given time, as far back as
+// Options.HistoryRetention reaches. Only versions this node has stored count,
+// so a write that arrived from a peer later than ts may still be returned if
+// it was made before ts.
+func (d *Database) GetAt(key string, ts time.Time) (GetResult, error) {
+	m := dbMessageGetAt{key: key, at: ts.Unix(), replyChan: make(chan TryGet, 1)}
+	try, err := call(d, newGetAtMessage(&m), m.replyChan)
+	if err != nil {
+		return GetResult{}, err
+	}
+	return try.Result, try.Error
+}
+
+// valueAt finds the latest stored version of key modified no later than at.
+// Only called from the message loop.
+func (d *Database) valueAt(key string, at int64) (*Value, error) {
+	history, ok := d.history()
+	if !ok {
+		return nil, ErrHistoryDisabled
+	}
+
+	versions, err := history.GetHistory(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Value
+	for i := range versions {
+		if versions[i].ModifiedAt <= at && (found == nil || valueWins(&versions[i], found)) {
+			found = &versions[i]
+		}
+	}
+	return found, nil
+}
+
+// Undelete brings back the last version of a deleted key that wasn't a
+// tombstone, with its tags, as a new write so that it replicates and wins over
+// the delete everywhere. The version keeps its expiry, so it doesn't outlive
+// its TTL. It needs version history reaching back to before the delete. A key
+// that isn't deleted, including one that has only expired, is left alone. It
+// returns ErrKeyNotFound when history has no earlier version, or when that
+// version has expired since.
+func (d *Database) Undelete(key string) error {
+	m := dbMessageUndelete{key: key, errorChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newUndeleteMessage(&m), m.errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// undelete does the work of Undelete. Only called from the message loop.
+func (d *Database) undelete(key string) error {
+	history, ok := d.history()
+	if !ok {
+		return ErrHistoryDisabled
+	}
+
+	current, err := d.storageGet(key)
+	if err != nil {
+		return err
+	}
+	if current != nil && !current.Deleted {
+		return nil
+	}
+
+	versions, err := history.GetHistory(key)
+	if err != nil {
+		return err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Deleted {
+			continue
+		}
+		if versions[i].Expired(time.Now().Unix()) {
+			return ErrKeyNotFound
+		}
+
+		value, err := d.newValue(key, versions[i].Content, false)
+		if err != nil {
+			return err
+		}
+		value.Tags = versions[i].Tags
+		value.Extensions = versions[i].Extensions
+		value.ExpiresAt = versions[i].ExpiresAt
+		return d.store(key, value, false)
+	}
+
+	return ErrKeyNotFound
+}
@@ -0,0 +1,113 @@
+package minidkvs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetAt(t *testing.T) {
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{HistoryRetention: time.Hour})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	db.ReceiveRemote(remoteDelta("k", []byte{1}, now-7200))
+	db.ReceiveRemote(remoteDelta("k", []byte{2}, now-600))
+	db.ReceiveRemote(remoteDelta("k", []byte{3}, now-60))
+
+	res, err := db.GetAt("k", time.Unix(now-300, 0))
+	if err != nil || !res.HasValue || res.Value[0] != 2 {
+		t.Error("GetAt returned the wrong version")
+	}
+
+	res, err = db.GetAt("k", time.Unix(now-3000, 0))
+	if err != nil || !res.HasValue || res.Value[0] != 1 {
+		t.Error("Newest version before the window should be kept")
+	}
+
+	res, err = db.GetAt("k", time.Unix(now-9000, 0))
+	if err != nil || res.HasValue {
+		t.Error("Nothing existed before the first version")
+	}
+
+	storage := mustMemoryStorage(t)
+	pruned, err := NewDatabaseWithOptions(storage, Options{HistoryRetention: time.Hour})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer pruned.Close()
+	pruned.ReceiveRemote(remoteDelta("k", []byte{1}, now-9000))
+	pruned.ReceiveRemote(remoteDelta("k", []byte{2}, now-7200))
+	pruned.ReceiveRemote(remoteDelta("k", []byte{3}, now-60))
+	if versions, _ := storage.GetHistory("k"); len(versions) != 2 || versions[0].Content[0] != 2 {
+		t.Error("Versions superseded before the window should be pruned")
+	}
+
+	plain, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer plain.Close()
+	if _, err := plain.GetAt("k", time.Now()); err != ErrHistoryDisabled {
+		t.Error("GetAt without retention should fail")
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{HistoryRetention: time.Hour})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if err := db.Undelete("missing"); err != ErrKeyNotFound {
+		t.Error("Undeleting a key with no history should fail")
+	}
+
+	db.SetWithOptions("k", []byte{1}, WriteOptions{Tags: []string{"config"}})
+	db.Set("k", []byte{2})
+	db.Delete("k")
+	before, _ := db.GetRemote("k")
+
+	if err := db.Undelete("k"); err != nil {
+		t.Fatal("Failed to undelete")
+	}
+
+	after, _ := db.GetRemote("k")
+	if after.Deleted || after.Content[0] != 2 {
+		t.Error("Undelete should restore the last live version")
+	}
+	if after.Version <= before.Version || !valueWins(after, before) {
+		t.Error("Undelete should be a new write that beats the delete")
+	}
+
+	expired := remoteDelta("e", []byte{3}, time.Now().Unix())
+	expired.Value.ExpiresAt = time.Now().Unix() - 1
+	db.ReceiveRemote(expired)
+	if err := db.Undelete("e"); err != nil {
+		t.Fatal("Undeleting an expired key should do nothing")
+	}
+	if res, _ := db.Get("e"); res.HasValue {
+		t.Error("Undelete should not bring back an expired key that was never deleted")
+	}
+
+	db.SetWithOptions("ttl", []byte{4}, WriteOptions{TTL: time.Hour})
+	set, _ := db.GetRemote("ttl")
+	db.Delete("ttl")
+	if err := db.Undelete("ttl"); err != nil {
+		t.Fatal("Failed to undelete")
+	}
+	if restored, _ := db.GetRemote("ttl"); restored.ExpiresAt != set.ExpiresAt {
+		t.Error("Undelete should keep the version's expiry")
+	}
+
+	lapsed := remoteDelta("lapsed", []byte{5}, time.Now().Unix())
+	lapsed.Value.ExpiresAt = time.Now().Unix() - 1
+	db.ReceiveRemote(lapsed)
+	db.Delete("lapsed")
+	if err := db.Undelete("lapsed"); err != ErrKeyNotFound {
+		t.Error("Undeleting a version that has since expired should fail")
+	}
+}
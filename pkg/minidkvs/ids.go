@@ -0,0 +1,105 @@
+package minidkvs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// IDSequencePrefix is reserved for the high-water marks of NextID sequences,
+// stored at prefix+sequence+"/"+nodeID with the sequence path-escaped.
+const IDSequencePrefix = ReservedPrefix + "ids/"
+
+// idLeaseMillis is how far ahead of the IDs it hands out a sequence stores
+// its high-water mark, so that only about one ID a second costs a write.
+const idLeaseMillis = 1000
+
+// idSequence is the state behind one NextID sequence. Every ID handed out
+// has millis below limit, which is stored.
+type idSequence struct {
+	millis  int64
+	counter int
+	limit   int64
+}
+
+type tryID struct {
+	id  string
+	err error
+}
+
+// maxIDCounter is how many IDs a sequence can hand out per millisecond before
+// it borrows from the next one.
+const maxIDCounter = 0xffff
+
+// NextID returns an ID that is unique across the cluster without any
+// coordination, as 48 hex characters: milliseconds since the epoch, a counter
+// and a hash of this node's ID and the sequence. IDs from one sequence on one
+// node sort in the order they were issued, and other IDs sort roughly by
+// time. Each sequence has its own counter, and the hash keeps IDs from
+// different sequences apart even when their counters match. A sequence keeps
+// a high-water mark under IDSequencePrefix, so it doesn't repeat IDs after a
+// restart even if the clock has gone back.
+func (d *Database) NextID(sequence string) (string, error) {
+	m := dbMessageNextID{sequence: sequence, replyChan: make(chan tryID, 1)}
+	try, err := call(d, newNextIDMessage(&m), m.replyChan)
+	if err != nil {
+		return "", err
+	}
+	return try.id, try.err
+}
+
+// nextID does the work of NextID. Only called from the message loop. The
+// sequence never goes backwards, even if the clock does.
+func (d *Database) nextID(sequence string, now time.Time) (string, error) {
+	key := IDSequencePrefix + url.PathEscape(sequence) + "/" + d.nodeID.String()
+	seq, ok := d.sequences[sequence]
+	if !ok {
+		limit, err := d.loadIDLimit(key)
+		if err != nil {
+			return "", err
+		}
+		// Every ID handed out before had millis below limit, so the next
+		// one starts at it unless the clock is already past it.
+		seq = &idSequence{millis: limit - 1, counter: maxIDCounter, limit: limit}
+		d.sequences[sequence] = seq
+	}
+
+	millis := now.UnixNano() / int64(time.Millisecond)
+	if millis > seq.millis {
+		seq.millis = millis
+		seq.counter = 0
+	} else if seq.counter < maxIDCounter {
+		seq.counter++
+	} else {
+		seq.millis++
+		seq.counter = 0
+	}
+
+	if seq.millis >= seq.limit {
+		limit := seq.millis + idLeaseMillis
+		if _, err := d.setLocal(key, []byte(strconv.FormatInt(limit, 10)), WriteOptions{}); err != nil {
+			return "", err
+		}
+		seq.limit = limit
+	}
+
+	sourceHash := sha256.Sum256([]byte(string(d.nodeID) + "\x00" + sequence))
+	return fmt.Sprintf("%012x%04x%s", seq.millis, seq.counter, hex.EncodeToString(sourceHash[:16])), nil
+}
+
+// loadIDLimit reads the stored high-water mark at key, zero if there is none.
+// Only called from the message loop.
+func (d *Database) loadIDLimit(key string) (int64, error) {
+	value, err := d.storageGet(key)
+	if err != nil || !isLive(value) {
+		return 0, err
+	}
+	limit, err := strconv.ParseInt(string(value.Content), 10, 64)
+	if err != nil {
+		return 0, &CodecError{Key: key, Err: err}
+	}
+	return limit, nil
+}
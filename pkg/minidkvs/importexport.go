@@ -0,0 +1,387 @@
+package minidkvs
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FileFormat is a file format read by Import and written by Export.
+type FileFormat int32
+
+const (
+	// FormatCSV is rows of key,value. Values are stored as their text.
+	// Exports add metadata columns after those two, and a header row; an
+	// import reads that layout back, with its deleted and expires_at columns.
+	FormatCSV FileFormat = 0
+	// FormatJSONL is one {"key": ..., "value": ...} object per line. On
+	// import, string values are stored as their text and anything else as
+	// its JSON, a "valueBase64" field is stored as its bytes and a record
+	// with "deleted": true deletes the key and "expiresAt" becomes a TTL.
+	// Exports add metadata fields.
+	FormatJSONL FileFormat = 1
+	// FormatRedisRDB is a Redis RDB dump, import only. String keys are
+	// loaded with their expiry as a TTL and other types are skipped.
+	FormatRedisRDB FileFormat = 2
+	// FormatEtcdJSON is the output of `etcdctl get --prefix "" -w json`,
+	// import only. Keys and values are stored as their bytes.
+	FormatEtcdJSON FileFormat = 3
+)
+
+// DefaultImportBatchSize is used when ImportOptions.BatchSize is zero.
+const DefaultImportBatchSize = 500
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	Format FileFormat
+
+	// BatchSize is how many records are written per trip through the
+	// message loop.
+	BatchSize int
+
+	// Tags are added to every imported value.
+	Tags []string
+
+	// Progress is called after each batch with the number imported so far.
+	Progress func(imported int)
+}
+
+// batchWrite is one local write applied as part of a batch.
+type batchWrite struct {
+	key     string
+	value   []byte
+	deleted bool
+	options WriteOptions
+}
+
+// etcdResponse is the part of an etcdctl JSON range response an import uses.
+type etcdResponse struct {
+	Kvs []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+// importRecord is one line of a JSONL import.
+type importRecord struct {
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value"`
+	ValueBase64 []byte          `json:"valueBase64"`
+	Deleted     bool            `json:"deleted"`
+	ExpiresAt   int64           `json:"expiresAt"`
+}
+
+// importTTL turns an exported expiry time into the TTL to write with. It
+// reports false for a record that has already expired and should be skipped.
+func importTTL(expiresAt int64) (time.Duration, bool) {
+	if expiresAt == 0 {
+		return 0, true
+	}
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	return ttl, ttl > 0
+}
+
+// Import bulk-loads key/value pairs from r. Every record becomes an ordinary
+// local write, with fresh version and node metadata, so imported data
+// replicates like anything else. It returns how many records were written.
+// On a malformed record the error names the record number and everything
+// before it has been written.
+func (d *Database) Import(r io.Reader, options ImportOptions) (int, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultImportBatchSize
+	}
+
+	next, err := importReader(r, options.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	batch := make([]batchWrite, 0, options.BatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		m := dbMessageBatch{writes: batch, replyChan: make(chan tryCount, 1)}
+		try, err := call(d, newBatchMessage(&m), m.replyChan)
+		if err != nil {
+			return err
+		}
+		imported += try.count
+		batch = make([]batchWrite, 0, options.BatchSize)
+		if try.err == nil && options.Progress != nil {
+			options.Progress(imported)
+		}
+		return try.err
+	}
+
+	for record := 1; ; record++ {
+		write, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return imported, flushErr
+			}
+			return imported, fmt.Errorf("minidkvs: import record %d: %w", record, err)
+		}
+
+		write.options.Tags = options.Tags
+		batch = append(batch, write)
+		if len(batch) == options.BatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+
+	return imported, flush()
+}
+
+// importReader returns a function that reads one record, with its TTL if the
+// format has one, per call and io.EOF at the end.
+func importReader(r io.Reader, format FileFormat) (func() (batchWrite, error), error) {
+	switch format {
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		first := true
+		return func() (batchWrite, error) {
+			for {
+				row, err := reader.Read()
+				if err != nil {
+					return batchWrite{}, err
+				}
+				if first && strings.Join(row, ",") == strings.Join(exportCSVHeader, ",") {
+					first = false
+					continue
+				}
+				first = false
+
+				switch len(row) {
+				case 2:
+					return batchWrite{key: row[0], value: []byte(row[1])}, nil
+				case len(exportCSVHeader):
+				default:
+					return batchWrite{}, fmt.Errorf("%d fields, want 2 or %d", len(row), len(exportCSVHeader))
+				}
+				deleted, err := strconv.ParseBool(row[5])
+				if err != nil {
+					return batchWrite{}, fmt.Errorf("deleted: %w", err)
+				}
+				expires, err := strconv.ParseInt(row[7], 10, 64)
+				if err != nil {
+					return batchWrite{}, fmt.Errorf("expires_at: %w", err)
+				}
+				ttl, live := importTTL(expires)
+				if !live {
+					continue
+				}
+				write := batchWrite{key: row[0], deleted: deleted, options: WriteOptions{TTL: ttl}}
+				if !deleted {
+					write.value = []byte(row[1])
+				}
+				return write, nil
+			}
+		}, nil
+
+	case FormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 64*1024*1024)
+		return func() (batchWrite, error) {
+			for scanner.Scan() {
+				line := scanner.Bytes()
+				if len(line) == 0 {
+					continue
+				}
+
+				var record importRecord
+				if err := json.Unmarshal(line, &record); err != nil {
+					return batchWrite{}, err
+				}
+				if record.Key == "" {
+					return batchWrite{}, errors.New("missing key")
+				}
+
+				ttl, live := importTTL(record.ExpiresAt)
+				if !live {
+					continue
+				}
+
+				write := batchWrite{key: record.Key, deleted: record.Deleted, options: WriteOptions{TTL: ttl}}
+				var text string
+				switch {
+				case record.Deleted:
+				case record.Value == nil && record.ValueBase64 != nil:
+					write.value = record.ValueBase64
+				case json.Unmarshal(record.Value, &text) == nil:
+					write.value = []byte(text)
+				default:
+					write.value = []byte(record.Value)
+				}
+				return write, nil
+			}
+			if err := scanner.Err(); err != nil {
+				return batchWrite{}, err
+			}
+			return batchWrite{}, io.EOF
+		}, nil
+
+	case FormatRedisRDB:
+		return rdbRecords(r)
+
+	case FormatEtcdJSON:
+		var response etcdResponse
+		if err := json.NewDecoder(r).Decode(&response); err != nil {
+			return nil, err
+		}
+		i := 0
+		return func() (batchWrite, error) {
+			if i == len(response.Kvs) {
+				return batchWrite{}, io.EOF
+			}
+			kv := response.Kvs[i]
+			i++
+			if len(kv.Key) == 0 {
+				return batchWrite{}, errors.New("missing key")
+			}
+			return batchWrite{key: string(kv.Key), value: kv.Value}, nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("minidkvs: unknown file format %d", format)
+}
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	Format FileFormat
+
+	// Prefix limits the export to keys starting with it.
+	Prefix string
+
+	// ModifiedSince limits the export to values modified at or after this
+	// unix time. Zero exports everything.
+	ModifiedSince int64
+
+	// IncludeDeleted exports tombstones and expired values too.
+	IncludeDeleted bool
+
+	// Redact, when set, replaces content before it is written. A redacted
+	// export can't be used to restore the data.
+	Redact Redactor
+}
+
+// exportRecord is one line of a JSONL export. Content that isn't valid UTF-8
+// goes in ValueBase64 instead of Value.
+type exportRecord struct {
+	Key         string            `json:"key"`
+	Value       *string           `json:"value,omitempty"`
+	ValueBase64 []byte            `json:"valueBase64,omitempty"`
+	Version     int               `json:"version"`
+	ModifiedBy  NodeID            `json:"modifiedBy"`
+	ModifiedAt  int64             `json:"modifiedAt"`
+	Deleted     bool              `json:"deleted,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	ExpiresAt   int64             `json:"expiresAt,omitempty"`
+	Extensions  map[string][]byte `json:"extensions,omitempty"`
+	Actor       string            `json:"actor,omitempty"`
+}
+
+var exportCSVHeader = []string{"key", "value", "version", "modified_by", "modified_at", "deleted", "tags", "expires_at"}
+
+// Export writes keys with their metadata to w, sorted by key, as they are
+// scanned, so the whole dump is never held in memory. The JSONL form can be
+// fed back to Import, which restores content, deletions and expiry but not
+// the rest of the metadata.
+// It needs a KeyLister storage.
+func (d *Database) Export(w io.Writer, options ExportOptions) (int, error) {
+	var write func(delta *Delta) error
+	var finish func() error
+
+	switch options.Format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(exportCSVHeader); err != nil {
+			return 0, err
+		}
+		write = func(delta *Delta) error {
+			v := delta.Value
+			return writer.Write([]string{
+				delta.Key,
+				string(v.Content),
+				strconv.Itoa(v.Version),
+				v.ModifiedBy.String(),
+				strconv.FormatInt(v.ModifiedAt, 10),
+				strconv.FormatBool(v.Deleted),
+				strings.Join(v.Tags, ";"),
+				strconv.FormatInt(v.ExpiresAt, 10),
+			})
+		}
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		write = func(delta *Delta) error {
+			v := delta.Value
+			record := exportRecord{
+				Key:        delta.Key,
+				Version:    v.Version,
+				ModifiedBy: v.ModifiedBy,
+				ModifiedAt: v.ModifiedAt,
+				Deleted:    v.Deleted,
+				Tags:       v.Tags,
+				Extensions: v.Extensions,
+				ExpiresAt:  v.ExpiresAt,
+				Actor:      v.Actor,
+			}
+			if utf8.Valid(v.Content) {
+				text := string(v.Content)
+				record.Value = &text
+			} else {
+				record.ValueBase64 = v.Content
+			}
+			return encoder.Encode(&record)
+		}
+		finish = func() error { return nil }
+
+	default:
+		return 0, fmt.Errorf("minidkvs: unknown file format %d", options.Format)
+	}
+
+	scanner, err := d.Scan(options.Prefix, ScanOptions{IncludeDeleted: true})
+	if err != nil {
+		return 0, err
+	}
+	defer scanner.Close()
+
+	exported := 0
+	for scanner.Next() {
+		delta := scanner.Delta()
+		if !isLive(delta.Value) && !options.IncludeDeleted {
+			continue
+		}
+		if delta.Value.ModifiedAt < options.ModifiedSince {
+			continue
+		}
+		if err := write(options.Redact.apply(&delta)); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	if err := scanner.Err(); err != nil {
+		return exported, err
+	}
+	return exported, finish()
+}
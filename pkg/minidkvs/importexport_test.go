@@ -0,0 +1,322 @@
+package minidkvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImport(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	var progress []int
+	options := ImportOptions{
+		Format:    FormatCSV,
+		BatchSize: 2,
+		Progress:  func(n int) { progress = append(progress, n) },
+	}
+	count, err := db.Import(strings.NewReader("a,1\nb,2\nc,3\n"), options)
+	if err != nil || count != 3 {
+		t.Error("CSV import should write three records")
+	}
+	if len(progress) != 2 || progress[1] != 3 {
+		t.Error("Progress should be reported per batch")
+	}
+
+	jsonl := `{"key": "d", "value": "text"}` + "\n" + `{"key": "e", "value": {"n": 1}}` + "\n"
+	count, err = db.Import(strings.NewReader(jsonl), ImportOptions{Format: FormatJSONL})
+	if err != nil || count != 2 {
+		t.Error("JSONL import should write two records")
+	}
+
+	if res, _ := db.Get("d"); string(res.Value) != "text" {
+		t.Error("String value should be stored as text")
+	}
+	if res, _ := db.Get("e"); string(res.Value) != `{"n": 1}` {
+		t.Error("Object value should be stored as JSON")
+	}
+	if v, _ := db.GetRemote("a"); v == nil || v.Version != 1 || v.ModifiedAt == 0 {
+		t.Error("Imported value should have write metadata")
+	}
+
+	count, err = db.Import(strings.NewReader("f,1\nbroken\n"), ImportOptions{Format: FormatCSV})
+	if err == nil || count != 1 {
+		t.Error("Malformed record should stop the import after earlier records")
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.SetWithOptions("app/a", []byte("one"), WriteOptions{Tags: []string{"config"}})
+	db.Set("app/b", []byte{0xff})
+	db.Set("app/c", []byte("gone"))
+	db.Delete("app/c")
+	db.Set("other", []byte("x"))
+	db.ReceiveRemote(remoteDelta("app/old", []byte("old"), 100))
+
+	var buf bytes.Buffer
+	options := ExportOptions{Format: FormatJSONL, Prefix: "app/", ModifiedSince: 1000}
+	count, err := db.Export(&buf, options)
+	if err != nil || count != 2 {
+		t.Fatal("Export should skip deleted, old and unprefixed keys")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], `"value":"one"`) || !strings.Contains(lines[0], `"tags":["config"]`) {
+		t.Error("Export record missing value or tags: " + lines[0])
+	}
+	if !strings.Contains(lines[1], `"valueBase64"`) {
+		t.Error("Binary value should be exported as base64")
+	}
+
+	target, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer target.Close()
+	if _, err := target.Import(strings.NewReader(lines[0]), ImportOptions{Format: FormatJSONL}); err != nil {
+		t.Error("Exported JSONL should import")
+	}
+	if res, _ := target.Get("app/a"); string(res.Value) != "one" {
+		t.Error("Round trip through export and import lost the value")
+	}
+
+	buf.Reset()
+	count, err = db.Export(&buf, ExportOptions{Format: FormatCSV, IncludeDeleted: true})
+	if err != nil || count != 5 {
+		t.Error("CSV export should include every key")
+	}
+	if !strings.HasPrefix(buf.String(), "key,value,version") {
+		t.Error("CSV export should start with a header")
+	}
+}
+
+func TestExportRedactsTaggedValues(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.SetWithOptions("email", []byte("a@example.com"), WriteOptions{Tags: []string{"pii"}})
+	db.Set("colour", []byte("blue"))
+
+	var buf bytes.Buffer
+	options := ExportOptions{Format: FormatJSONL, Redact: RedactTagged("pii")}
+	if _, err := db.Export(&buf, options); err != nil {
+		t.Fatal("Failed to export")
+	}
+	if strings.Contains(buf.String(), "a@example.com") || !strings.Contains(buf.String(), "[redacted]") {
+		t.Error("Tagged value should be redacted")
+	}
+	if !strings.Contains(buf.String(), "blue") {
+		t.Error("Untagged value should be exported as is")
+	}
+	if res, _ := db.Get("email"); string(res.Value) != "a@example.com" {
+		t.Error("Redaction should not change the stored value")
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("binary", []byte{0xff, 0x00})
+	db.Set("gone", []byte("x"))
+	db.Delete("gone")
+	db.SetWithOptions("ttl", []byte("soon"), WriteOptions{TTL: time.Hour})
+	expired := remoteDelta("expired", []byte("old"), time.Now().Unix())
+	expired.Value.ExpiresAt = time.Now().Unix() - 10
+	db.ReceiveRemote(expired)
+
+	var buf bytes.Buffer
+	if count, err := db.Export(&buf, ExportOptions{Format: FormatJSONL}); err != nil || count != 2 {
+		t.Error("Export should skip tombstones and expired values by default")
+	}
+
+	for _, format := range []FileFormat{FormatJSONL, FormatCSV} {
+		buf.Reset()
+		if _, err := db.Export(&buf, ExportOptions{Format: format, IncludeDeleted: true}); err != nil {
+			t.Fatal("Failed to export")
+		}
+
+		target, err := NewMemoryDatabase()
+		if err != nil {
+			t.Fatal("Failed to create database")
+		}
+		defer target.Close()
+		target.Set("gone", []byte("stale"))
+
+		if count, err := target.Import(&buf, ImportOptions{Format: format}); err != nil || count != 3 {
+			t.Fatalf("Full export in format %d should import everything but the expired key", format)
+		}
+		if format == FormatJSONL {
+			if res, _ := target.Get("binary"); !bytes.Equal(res.Value, []byte{0xff, 0x00}) {
+				t.Error("Binary value should survive the round trip")
+			}
+		}
+		if res, _ := target.Get("gone"); res.HasValue {
+			t.Error("Exported tombstone should delete the key on import")
+		}
+		if v, _ := target.GetRemote("ttl"); v == nil || v.ExpiresAt == 0 || v.ExpiresAt > time.Now().Add(time.Hour).Unix()+1 {
+			t.Error("Exported expiry should become a TTL on import")
+		}
+		if v, _ := target.GetRemote("expired"); v != nil {
+			t.Error("Already expired record should be skipped")
+		}
+	}
+}
+
+// rdbString encodes a short RDB string.
+func rdbString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func TestImportRedisRDB(t *testing.T) {
+	future := make([]byte, 8)
+	binary.LittleEndian.PutUint64(future, uint64(time.Now().Add(time.Hour).UnixMilli()))
+	past := make([]byte, 8)
+	binary.LittleEndian.PutUint64(past, uint64(time.Now().Add(-time.Hour).UnixMilli()))
+
+	var rdb []byte
+	rdb = append(rdb, "REDIS0011"...)
+	rdb = append(append(append(rdb, rdbOpAux), rdbString("redis-ver")...), rdbString("7.2.0")...)
+	// FUNCTION2 (0xf5) as saved by Redis 7 with a library loaded.
+	rdb = append(append(rdb, 0xf5), rdbString("#!lua name=lib")...)
+	rdb = append(rdb, rdbOpSelectDB, 0, rdbOpResizeDB, 5, 2)
+	// FREQ (0xf9) as saved under an LFU maxmemory policy, then IDLE (0xf8).
+	rdb = append(rdb, 0xf9, 5, 0xf8, 10)
+	rdb = append(append(append(rdb, rdbTypeString), rdbString("plain")...), rdbString("hello")...)
+	rdb = append(append(append(append(rdb, rdbOpExpireMS), future...), rdbTypeString), rdbString("counter")...)
+	rdb = append(rdb, 0xc1, 0xd2, 0x04)
+	rdb = append(append(rdb, rdbTypeString), rdbString("lzf")...)
+	rdb = append(rdb, 0xc3, 6, 9, 2, 'a', 'b', 'c', 0x80, 2)
+	rdb = append(append(append(append(rdb, rdbOpExpireMS), past...), rdbTypeString), rdbString("gone")...)
+	rdb = append(rdb, rdbString("x")...)
+	rdb = append(append(append(rdb, rdbTypeList), rdbString("list")...), 2)
+	rdb = append(append(rdb, rdbString("a")...), rdbString("b")...)
+	// A stream with one listpack node and a consumer group with one
+	// pending entry owned by one consumer.
+	id := bytes.Repeat([]byte{1}, 16)
+	rdb = append(append(rdb, rdbTypeStream3), rdbString("stream")...)
+	rdb = append(append(append(rdb, 1), rdbString(string(id))...), rdbString("listpack")...)
+	rdb = append(rdb, 1, 2, 3, 2, 0, 0, 0, 1)
+	rdb = append(append(append(rdb, 1), rdbString("group")...), 2, 3, 1)
+	rdb = append(append(append(append(rdb, 1), id...), make([]byte, 8)...), 1)
+	rdb = append(append(append(rdb, 1), rdbString("consumer")...), make([]byte, 16)...)
+	rdb = append(append(rdb, 1), id...)
+	// A hash with field expiries, then a module value.
+	rdb = append(append(rdb, rdbTypeHashMeta), rdbString("hash")...)
+	rdb = append(append(rdb, make([]byte, 8)...), 1, 5)
+	rdb = append(append(rdb, rdbString("f")...), rdbString("v")...)
+	rdb = append(append(rdb, rdbTypeModule2), rdbString("module")...)
+	rdb = append(append(rdb, 9, rdbModuleOpUInt, 7, rdbModuleOpString), rdbString("s")...)
+	rdb = append(rdb, rdbModuleOpEOF)
+	rdb = append(rdb, rdbOpEOF)
+	sum := ^crc64.Update(^uint64(0), rdbCRCTable, rdb)
+	rdb = binary.LittleEndian.AppendUint64(rdb, sum)
+
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	count, err := db.Import(bytes.NewReader(rdb), ImportOptions{Format: FormatRedisRDB})
+	if err != nil || count != 3 {
+		t.Fatalf("Expected three string keys but got %d, %v", count, err)
+	}
+	for key, want := range map[string]string{"plain": "hello", "counter": "1234", "lzf": "abcabcabc"} {
+		if res, _ := db.Get(key); string(res.Value) != want {
+			t.Errorf("Expected %s to be %q but got %q", key, want, res.Value)
+		}
+	}
+	if ttl, _ := db.TTL("counter"); ttl <= 0 {
+		t.Error("Expiry should be imported as a TTL")
+	}
+	if res, _ := db.Get("list"); res.HasValue {
+		t.Error("Non-string keys should be skipped")
+	}
+	if res, _ := db.Get("stream"); res.HasValue {
+		t.Error("Stream keys should be skipped")
+	}
+
+	rdb[len(rdb)-1] ^= 0xff
+	if _, err := db.Import(bytes.NewReader(rdb), ImportOptions{Format: FormatRedisRDB}); err == nil {
+		t.Error("Expected a checksum mismatch")
+	}
+}
+
+func TestImportRedisRDBCorrupt(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	dumps := map[string][]byte{
+		// A string claiming 2^64-1 bytes.
+		"huge length": append([]byte("REDIS0011\x00\x01k\x81"), bytes.Repeat([]byte{0xff}, 8)...),
+		// A string claiming nearly 512MB that isn't there.
+		"short data": append([]byte("REDIS0011\x00\x01k\x80"), 0x1f, 0xff, 0xff, 0xff, 'x'),
+		// LZF claiming to expand 4 bytes to 1GB.
+		"lzf size": []byte("REDIS0011\x00\x01k\xc3\x04\x80\x40\x00\x00\x00\x00abc"),
+		// MODULE_AUX (0xf7) can't be skipped without the module.
+		"module aux": []byte("REDIS0011\xf7\x01"),
+		// A pre-release module value (type 6) has no opcodes to skip by.
+		"module pre-GA": []byte("REDIS0011\x06\x03mod\x01"),
+	}
+	for name, dump := range dumps {
+		if _, err := db.Import(bytes.NewReader(dump), ImportOptions{Format: FormatRedisRDB}); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+
+	_, err = db.Import(bytes.NewReader(dumps["module pre-GA"]), ImportOptions{Format: FormatRedisRDB})
+	if err == nil || !strings.Contains(err.Error(), "unsupported RDB value type 6") || !strings.Contains(err.Error(), `"mod"`) {
+		t.Errorf("Unsupported type should be named with its key, got %v", err)
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	if sum := ^crc64.Update(^uint64(0), rdbCRCTable, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected the CRC-64/Jones check value but got %#x", sum)
+	}
+}
+
+func TestImportEtcdJSON(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	// etcdctl get --prefix "" -w json, with base64 keys and values.
+	dump := `{"header":{"cluster_id":1,"member_id":2,"revision":3,"raft_term":2},
+		"kvs":[{"key":"L2FwcC9wb3J0","create_revision":2,"mod_revision":2,"version":1,"value":"ODA4MA=="},
+		{"key":"L2FwcC9uYW1l","create_revision":3,"mod_revision":3,"version":1,"value":"ZWRnZQ=="}],"count":2}`
+	count, err := db.Import(strings.NewReader(dump), ImportOptions{Format: FormatEtcdJSON})
+	if err != nil || count != 2 {
+		t.Fatalf("Expected two keys but got %d, %v", count, err)
+	}
+	if res, _ := db.Get("/app/port"); string(res.Value) != "8080" {
+		t.Errorf("Expected 8080 but got %q", res.Value)
+	}
+	if res, _ := db.Get("/app/name"); string(res.Value) != "edge" {
+		t.Errorf("Expected edge but got %q", res.Value)
+	}
+}
@@ -0,0 +1,119 @@
+package minidkvs
+
+import "strconv"
+
+// InboundOffsetPrefix is reserved for the source offsets of InboundBridges,
+// stored at prefix+name+"/"+partition.
+const InboundOffsetPrefix = ReservedPrefix + "inbound/"
+
+// FeedRecord is one change read from an external feed, such as a Kafka
+// message or a row from Postgres logical replication.
+type FeedRecord struct {
+	// Partition and Offset locate the record in the feed. Offsets must
+	// increase within a partition. Feeds without partitions leave it empty.
+	Partition string
+	Offset    int64
+
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// Feed is interface for an external change feed. Adapting a consumer client
+// is usually a few lines mapping its messages to FeedRecords.
+type Feed interface {
+	// Next blocks until the next record is available.
+	Next() (FeedRecord, error)
+}
+
+// InboundOptions configures an InboundBridge.
+type InboundOptions struct {
+	// KeyPrefix is prepended to every key from the feed.
+	KeyPrefix string
+}
+
+// InboundBridge writes the records of an external feed into a Database. Each
+// record's write and its offset are stored in one transaction, so a record
+// delivered again, as at-least-once feeds do after a restart, is skipped.
+// Offsets replicate, so only one node should consume a given feed at a time,
+// but any node can take over from where another stopped.
+type InboundBridge struct {
+	db      *Database
+	name    string
+	options InboundOptions
+}
+
+// NewInboundBridge is ctor for InboundBridge. Name identifies the feed; its
+// offsets are kept under InboundOffsetPrefix+name.
+func NewInboundBridge(db *Database, name string, options InboundOptions) *InboundBridge {
+	return &InboundBridge{db: db, name: name, options: options}
+}
+
+// Offset returns the offset of the last record applied from partition, or -1
+// if there is none, so a consumer can resume from the one after it.
+func (b *InboundBridge) Offset(partition string) (int64, error) {
+	res, err := b.db.Get(b.offsetKey(partition))
+	if err != nil || !res.HasValue {
+		return -1, err
+	}
+	offset, err := strconv.ParseInt(string(res.Value), 10, 64)
+	if err != nil {
+		return -1, &CodecError{Key: b.offsetKey(partition), Err: err}
+	}
+	return offset, nil
+}
+
+// Apply writes one record unless a record at or after its offset was already
+// applied. It reports whether the record was written.
+func (b *InboundBridge) Apply(record FeedRecord) (bool, error) {
+	offsetKey := b.offsetKey(record.Partition)
+	for {
+		res, err := b.db.Get(offsetKey)
+		if err != nil {
+			return false, err
+		}
+		if res.HasValue {
+			applied, err := strconv.ParseInt(string(res.Value), 10, 64)
+			if err != nil {
+				return false, &CodecError{Key: offsetKey, Err: err}
+			}
+			if record.Offset <= applied {
+				return false, nil
+			}
+		}
+
+		write := OpPut(b.options.KeyPrefix+record.Key, record.Value)
+		if record.Deleted {
+			write = OpDelete(b.options.KeyPrefix + record.Key)
+		}
+		resp, err := b.db.Txn().
+			If(CompareValue(offsetKey, "=", res.Value)).
+			Then(write, OpPut(offsetKey, []byte(strconv.FormatInt(record.Offset, 10)))).
+			Commit()
+		if err != nil {
+			return false, err
+		}
+		if resp.Succeeded {
+			return true, nil
+		}
+		// The offset moved since it was read; check it again.
+	}
+}
+
+// Consume applies records from feed until Next or a write fails, and returns
+// that error.
+func (b *InboundBridge) Consume(feed Feed) error {
+	for {
+		record, err := feed.Next()
+		if err != nil {
+			return err
+		}
+		if _, err := b.Apply(record); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *InboundBridge) offsetKey(partition string) string {
+	return InboundOffsetPrefix + b.name + "/" + partition
+}
@@ -0,0 +1,221 @@
+package minidkvs
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+// ipcErrors are the errors that keep their identity across IPC, so that
+// errors.Is works on the client the same as in process.
+var ipcErrors = []error{
+	ErrClosed, ErrInternal, ErrTimeout, ErrStorageUnavailable, ErrDeltaRejected,
+	ErrValueTooLarge, ErrVersionMismatch, ErrKeyNotFound, ErrStaleRead,
+	ErrConsistencyUnavailable, ErrFenced, ErrNotWriter, ErrLowSpace, ErrMaintenance,
+}
+
+// IPCArgs is the request of an IPC call. It is only exported because net/rpc
+// requires it.
+type IPCArgs struct {
+	Key   string
+	Value []byte
+	Read  ReadOptions
+	Write WriteOptions
+	Delta *Delta
+}
+
+// IPCReply is the response of an IPC call. It is only exported because net/rpc
+// requires it.
+type IPCReply struct {
+	Result GetResult
+	Token  CausalToken
+	Value  *Value
+}
+
+// ipcService exposes a Database to net/rpc.
+type ipcService struct {
+	db *Database
+}
+
+func (s *ipcService) Get(args IPCArgs, reply *IPCReply) (err error) {
+	reply.Result, err = s.db.GetWithOptions(args.Key, args.Read)
+	return err
+}
+
+func (s *ipcService) Set(args IPCArgs, reply *IPCReply) (err error) {
+	reply.Token, err = s.db.SetWithOptions(args.Key, args.Value, args.Write)
+	return err
+}
+
+func (s *ipcService) Delete(args IPCArgs, reply *IPCReply) (err error) {
+	reply.Token, err = s.db.DeleteWithToken(args.Key)
+	return err
+}
+
+func (s *ipcService) GetRemote(args IPCArgs, reply *IPCReply) (err error) {
+	reply.Value, err = s.db.GetRemote(args.Key)
+	return err
+}
+
+func (s *ipcService) ReceiveRemote(args IPCArgs, reply *IPCReply) error {
+	return s.db.ReceiveRemote(args.Delta)
+}
+
+// ServeIPC lets other processes use the database through IPCClient, typically
+// over a Unix domain socket from ListenIPC, so that sidecar tools such as a
+// CLI or a backup agent can run against a live embedded node. It blocks until
+// l is closed.
+func (d *Database) ServeIPC(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Database", &ipcService{db: d}); err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// ListenIPC listens on a Unix domain socket at path for ServeIPC. Only the
+// user running the process may connect; use ListenUnix for other modes.
+func ListenIPC(path string) (net.Listener, error) {
+	return ListenUnix(path, 0600)
+}
+
+// ListenUnix listens on a Unix domain socket at path with the file mode set to
+// mode, so that filesystem permissions decide which local users may connect.
+// It serves ServeIPC, or HTTP such as HealthHandler through http.Serve, for
+// co-located clients that shouldn't go through TCP. A socket left behind by a
+// process that died is removed first.
+//
+// The mode is set just after the socket is created. To close that window,
+// put the socket in a directory that only permitted users can enter.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode.Perm()); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// IPCClient talks to a Database served by ServeIPC in another process. It has
+// the same read and write methods as Database, and is a Peer.
+type IPCClient struct {
+	client *rpc.Client
+}
+
+// DialIPC connects to a Unix domain socket served by ServeIPC.
+func DialIPC(path string) (*IPCClient, error) {
+	client, err := rpc.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &IPCClient{client: client}, nil
+}
+
+// Close closes the connection. The served database stays open.
+func (c *IPCClient) Close() error {
+	return c.client.Close()
+}
+
+// Get is Database.Get.
+func (c *IPCClient) Get(key string) (GetResult, error) {
+	return c.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions is Database.GetWithOptions.
+func (c *IPCClient) GetWithOptions(key string, options ReadOptions) (GetResult, error) {
+	var reply IPCReply
+	err := c.call("Get", IPCArgs{Key: key, Read: options}, &reply)
+	return reply.Result, err
+}
+
+// Set is Database.Set.
+func (c *IPCClient) Set(key string, value []byte) error {
+	_, err := c.SetWithOptions(key, value, WriteOptions{})
+	return err
+}
+
+// SetWithOptions is Database.SetWithOptions.
+func (c *IPCClient) SetWithOptions(key string, value []byte, options WriteOptions) (CausalToken, error) {
+	var reply IPCReply
+	err := c.call("Set", IPCArgs{Key: key, Value: value, Write: options}, &reply)
+	return reply.Token, err
+}
+
+// Delete is Database.Delete.
+func (c *IPCClient) Delete(key string) error {
+	_, err := c.DeleteWithToken(key)
+	return err
+}
+
+// DeleteWithToken is Database.DeleteWithToken.
+func (c *IPCClient) DeleteWithToken(key string) (CausalToken, error) {
+	var reply IPCReply
+	err := c.call("Delete", IPCArgs{Key: key}, &reply)
+	return reply.Token, err
+}
+
+// GetRemote is Database.GetRemote.
+func (c *IPCClient) GetRemote(key string) (*Value, error) {
+	var reply IPCReply
+	err := c.call("GetRemote", IPCArgs{Key: key}, &reply)
+	return reply.Value, err
+}
+
+// ReceiveRemote is Database.ReceiveRemote.
+func (c *IPCClient) ReceiveRemote(delta *Delta) error {
+	return c.call("ReceiveRemote", IPCArgs{Delta: delta}, &IPCReply{})
+}
+
+func (c *IPCClient) call(method string, args IPCArgs, reply *IPCReply) error {
+	err := c.client.Call("Database."+method, args, reply)
+	if serverErr, ok := err.(rpc.ServerError); ok {
+		return ipcError(string(serverErr))
+	}
+	return err
+}
+
+// ipcError turns an error message from the server back into an error wrapping
+// the matching sentinel, if there is one.
+func ipcError(msg string) error {
+	for _, sentinel := range ipcErrors {
+		if msg == sentinel.Error() {
+			return sentinel
+		}
+		if strings.HasPrefix(msg, sentinel.Error()+": ") {
+			return &ipcWrapped{msg: msg, sentinel: sentinel}
+		}
+	}
+	return errors.New(msg)
+}
+
+// ipcWrapped is a server error that wrapped a sentinel.
+type ipcWrapped struct {
+	msg      string
+	sentinel error
+}
+
+func (e *ipcWrapped) Error() string { return e.msg }
+func (e *ipcWrapped) Unwrap() error { return e.sentinel }
@@ -0,0 +1,94 @@
+package minidkvs
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPC(t *testing.T) {
+	// Unix socket paths are short, so avoid the long t.TempDir path.
+	dir, err := os.MkdirTemp("", "minidkvs")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.sock")
+
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{MaxValueSize: 4})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	listener, err := ListenIPC(path)
+	if err != nil {
+		t.Fatal("Failed to listen")
+	}
+	defer listener.Close()
+	go db.ServeIPC(listener)
+
+	client, err := DialIPC(path)
+	if err != nil {
+		t.Fatal("Failed to dial")
+	}
+	defer client.Close()
+
+	if err := client.Set("k", []byte{1}); err != nil {
+		t.Fatal("Failed to set over IPC")
+	}
+	if res, _ := db.Get("k"); !res.HasValue || res.Value[0] != 1 {
+		t.Error("Write over IPC should reach the database")
+	}
+
+	db.Set("other", []byte{2})
+	if res, err := client.Get("other"); err != nil || !res.HasValue || res.Value[0] != 2 {
+		t.Error("Read over IPC should see the database")
+	}
+
+	if err := client.Set("big", []byte("too large")); err != ErrValueTooLarge {
+		t.Error("Sentinel errors should survive IPC")
+	}
+	if err := client.ReceiveRemote(&Delta{Key: "", Value: &Value{}}); !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Wrapped sentinel errors should survive IPC")
+	}
+
+	for _, sentinel := range []error{ErrFenced, ErrNotWriter, ErrLowSpace, ErrMaintenance} {
+		if err := ipcError(sentinel.Error()); err != sentinel {
+			t.Errorf("%v should survive IPC", sentinel)
+		}
+	}
+}
+
+func TestListenUnixPermissions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidkvs")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "http.sock")
+
+	// A socket file left behind by a dead process.
+	stale, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal("Failed to listen")
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenUnix(path, 0660)
+	if err != nil {
+		t.Fatal("Stale socket should be replaced")
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0660 {
+		t.Error("Socket should have the requested mode")
+	}
+	if _, err := ListenUnix(path, 0660); err == nil {
+		t.Error("Live socket should not be replaced")
+	}
+}
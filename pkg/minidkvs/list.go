@@ -0,0 +1,84 @@
+package minidkvs
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrBadCursor is returned by List when the cursor wasn't made by List for the
+// same prefix.
+var ErrBadCursor = errors.New("minidkvs: invalid cursor")
+
+// Page is one page of List results.
+type Page struct {
+	Deltas []Delta
+	// Cursor fetches the next page. It is empty on the last page.
+	Cursor string
+}
+
+type dbMessageList struct {
+	prefix    string
+	after     string
+	limit     int
+	replyChan chan tryDeltas
+}
+
+// List returns up to limit live keys under prefix in key order, starting after
+// cursor. Pass an empty cursor for the first page. Cursors name the last key
+// returned rather than a position, so keys inserted or deleted between pages
+// don't cause later keys to be skipped or repeated. Keys inserted behind the
+// cursor are not seen. It needs a KeyLister storage.
+func (d *Database) List(prefix, cursor string, limit int) (Page, error) {
+	after := ""
+	if cursor != "" {
+		key, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !strings.HasPrefix(string(key), prefix) {
+			return Page{}, ErrBadCursor
+		}
+		after = string(key)
+	}
+	if limit <= 0 {
+		limit = DefaultScanChunkSize
+	}
+
+	// Ask for one extra so the last page is known to be last.
+	m := dbMessageList{prefix: prefix, after: after, limit: limit + 1, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(d, newListMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return Page{}, err
+	}
+
+	page := Page{Deltas: try.deltas}
+	if len(try.deltas) > limit {
+		page.Deltas = try.deltas[:limit]
+		last := page.Deltas[limit-1].Key
+		page.Cursor = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	return page, nil
+}
+
+// list does the work of List. Only called from the message loop.
+func (d *Database) list(prefix, after string, limit int) ([]Delta, error) {
+	keys, err := d.storageKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := []Delta{}
+	i := sort.Search(len(keys), func(i int) bool { return keys[i] > after })
+	for ; i < len(keys) && len(deltas) < limit; i++ {
+		value, err := d.storageGet(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		if isLive(value) {
+			deltas = append(deltas, Delta{Key: keys[i], Value: value})
+		}
+	}
+	return deltas, nil
+}
@@ -0,0 +1,74 @@
+package minidkvs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// ErrStorageInUse is returned by NewDatabase when another open Database in
+// this process already uses the Storage, or by LockFile when another process
+// holds the lock.
+var ErrStorageInUse = errors.New("minidkvs: storage is in use by another database")
+
+// storagesInUse holds every Storage with an open Database in this process.
+var storagesInUse = struct {
+	sync.Mutex
+	m map[Storage]bool
+}{m: make(map[Storage]bool)}
+
+// claimStorage marks storage as used by a Database. Storage whose dynamic
+// type can't be a map key is not tracked.
+func claimStorage(storage Storage) error {
+	if !reflect.TypeOf(storage).Comparable() {
+		return nil
+	}
+	storagesInUse.Lock()
+	defer storagesInUse.Unlock()
+
+	if storagesInUse.m[storage] {
+		return ErrStorageInUse
+	}
+	storagesInUse.m[storage] = true
+	return nil
+}
+
+// releaseStorage undoes claimStorage so the Storage can be reopened.
+func releaseStorage(storage Storage) {
+	if !reflect.TypeOf(storage).Comparable() {
+		return
+	}
+	storagesInUse.Lock()
+	defer storagesInUse.Unlock()
+	delete(storagesInUse.m, storage)
+}
+
+// FileLock is an exclusive lock on a file, for backends keeping data in a
+// directory to stop a second process opening it. Take it in
+// StorageOpener.Open and release it in Close.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile creates path if needed and locks it, failing with ErrStorageInUse
+// when another process holds it. On Unix the lock is released by the OS if
+// the process dies; elsewhere the file itself is the lock and has to be
+// removed by hand after a crash.
+func LockFile(path string) (*FileLock, error) {
+	file, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock. Calling it again does nothing.
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	l.file = nil
+	return err
+}
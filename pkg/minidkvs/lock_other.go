@@ -0,0 +1,20 @@
+//go:build !unix
+
+package minidkvs
+
+import "os"
+
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, ErrStorageInUse
+	}
+	return file, err
+}
+
+func unlockFile(file *os.File) error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file.Name())
+}
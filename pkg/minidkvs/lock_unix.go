@@ -0,0 +1,30 @@
+//go:build unix
+
+package minidkvs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrStorageInUse
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) error {
+	// Closing the descriptor drops the flock. The file is left in place so
+	// that a waiting process never locks a file that is about to vanish.
+	return file.Close()
+}
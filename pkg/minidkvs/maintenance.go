@@ -0,0 +1,105 @@
+package minidkvs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMaintenance is matched by the MaintenanceError that writes fail with
+// while the node is in maintenance.
+var ErrMaintenance = errors.New("minidkvs: node is in maintenance")
+
+// MaintenanceError is returned for writes, local or from peers, while the
+// node is in maintenance. RetryAfter is the operator's estimate of when to try
+// again, suitable for a Retry-After header.
+type MaintenanceError struct {
+	RetryAfter time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	return ErrMaintenance.Error() + ", retry after " + e.RetryAfter.String()
+}
+
+// Is makes errors.Is(err, ErrMaintenance) true.
+func (e *MaintenanceError) Is(target error) bool {
+	return target == ErrMaintenance
+}
+
+// maintenance is the state of a node in maintenance.
+type maintenance struct {
+	retryAfter time.Duration
+
+	// paused are the peers paused by EnterMaintenance, as opposed to ones
+	// that were already paused, so that ExitMaintenance only resumes these.
+	paused []Peer
+}
+
+type dbMessageMaint struct {
+	enter      bool
+	retryAfter time.Duration
+	replyChan  chan error
+}
+
+// EnterMaintenance puts the node into maintenance, for example while its
+// storage backend is upgraded. Reads are still served. Writes fail with a
+// MaintenanceError carrying retryAfter, and every peer is paused so nothing
+// replicates either way. Entering again only updates retryAfter.
+func (d *Database) EnterMaintenance(retryAfter time.Duration) error {
+	return d.setMaintenance(true, retryAfter)
+}
+
+// ExitMaintenance ends maintenance, accepting writes again and resuming the
+// peers EnterMaintenance paused, which sends them what was written here in
+// the meantime. Peers paused before maintenance stay paused.
+func (d *Database) ExitMaintenance() error {
+	return d.setMaintenance(false, 0)
+}
+
+func (d *Database) setMaintenance(enter bool, retryAfter time.Duration) error {
+	m := dbMessageMaint{enter: enter, retryAfter: retryAfter, replyChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newMaintMessage(&m), m.replyChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// maintain is the in-loop half of EnterMaintenance and ExitMaintenance.
+func (d *Database) maintain(enter bool, retryAfter time.Duration) error {
+	if enter {
+		if d.maintenance != nil {
+			d.maintenance.retryAfter = retryAfter
+			return nil
+		}
+		m := &maintenance{retryAfter: retryAfter}
+		for _, peer := range d.activePeers() {
+			if err := d.pausePeer(peer); err != nil {
+				return err
+			}
+			m.paused = append(m.paused, peer)
+		}
+		d.maintenance = m
+		return nil
+	}
+
+	if d.maintenance == nil {
+		return nil
+	}
+	paused := d.maintenance.paused
+	d.maintenance = nil
+	for _, peer := range paused {
+		// A peer removed during maintenance is already gone.
+		if err := d.resumePeer(peer); err != nil && err != ErrUnknownPeer {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMaintenance fails a write while the node is in maintenance.
+func (d *Database) checkMaintenance() error {
+	if d.maintenance != nil {
+		return &MaintenanceError{RetryAfter: d.maintenance.retryAfter}
+	}
+	return nil
+}
@@ -1,12 +1,21 @@
 package minidkvs
 
-import "github.com/google/uuid"
+import (
+	"sort"
+	"strings"
+)
 
 // MemoryStorage is a pure-memory implementation of Storage interface. Mainly
 // just meant for testing.
 type MemoryStorage struct {
-	data   map[string]Value
-	nodeID uuid.UUID
+	data    map[string]Value
+	history map[string][]Value
+	nodeID  NodeID
+	schema  int
+
+	// expiring is the ExpiryIndex: ExpiresAt of each value that has one and
+	// still has content. It is scanned in full, which is fine for testing.
+	expiring map[string]int64
 }
 
 // Get reads from in-memory map.
@@ -18,33 +27,143 @@ func (m *MemoryStorage) Get(key string) (*Value, error) {
 	return &val, nil
 }
 
+// GetMeta reads from in-memory map, leaving out Content.
+func (m *MemoryStorage) GetMeta(key string) (*Value, error) {
+	val, ok := m.data[key]
+	if !ok {
+		return nil, nil
+	}
+	val.Content = nil
+	return &val, nil
+}
+
 // Set upserts value.
 func (m *MemoryStorage) Set(key string, value *Value) error {
 	m.data[key] = *value
+	m.indexExpiry(key, value)
+	return nil
+}
+
+// SetBatch upserts several values.
+func (m *MemoryStorage) SetBatch(deltas []Delta) error {
+	for _, delta := range deltas {
+		m.data[delta.Key] = *delta.Value
+		m.indexExpiry(delta.Key, delta.Value)
+	}
 	return nil
 }
 
 // Delete deletes value. Missing key is no-op.
 func (m *MemoryStorage) Delete(key string) error {
 	delete(m.data, key)
+	delete(m.expiring, key)
+	return nil
+}
+
+func (m *MemoryStorage) indexExpiry(key string, value *Value) {
+	if value.ExpiresAt != 0 && len(value.Content) > 0 {
+		m.expiring[key] = value.ExpiresAt
+	} else {
+		delete(m.expiring, key)
+	}
+}
+
+// NextExpiry returns the earliest expiry of a value that still has content.
+func (m *MemoryStorage) NextExpiry() (int64, error) {
+	var next int64
+	for _, at := range m.expiring {
+		if next == 0 || at < next {
+			next = at
+		}
+	}
+	return next, nil
+}
+
+// ExpiredKeys returns keys with content that expired at or before now.
+func (m *MemoryStorage) ExpiredKeys(now int64, limit int) ([]string, error) {
+	keys := []string{}
+	for key, at := range m.expiring {
+		if len(keys) == limit {
+			break
+		}
+		if at <= now {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Keys lists keys with the given prefix in sorted order.
+func (m *MemoryStorage) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// CountLive counts keys with the given prefix that aren't deleted or expired.
+func (m *MemoryStorage) CountLive(prefix string, now int64) (int64, error) {
+	var n int64
+	for key, value := range m.data {
+		if strings.HasPrefix(key, prefix) && !value.Deleted && !value.Expired(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// AppendHistory adds a version to the end of the key's history.
+func (m *MemoryStorage) AppendHistory(key string, value *Value) error {
+	m.history[key] = append(m.history[key], *value)
+	return nil
+}
+
+// GetHistory returns a copy of the key's history, oldest first.
+func (m *MemoryStorage) GetHistory(key string) ([]Value, error) {
+	return append([]Value(nil), m.history[key]...), nil
+}
+
+// TrimHistory drops the oldest versions of the key's history.
+func (m *MemoryStorage) TrimHistory(key string, drop int) error {
+	m.history[key] = m.history[key][drop:]
+	if len(m.history[key]) == 0 {
+		delete(m.history, key)
+	}
 	return nil
 }
 
 // GetNodeID returns the unique identifier for this node.
-func (m *MemoryStorage) GetNodeID() (*uuid.UUID, error) {
-	return &m.nodeID, nil
+func (m *MemoryStorage) GetNodeID() (NodeID, error) {
+	return m.nodeID, nil
+}
+
+// SchemaVersion returns the version set by SetSchemaVersion.
+func (m *MemoryStorage) SchemaVersion() (int, error) {
+	return m.schema, nil
 }
 
-// NewMemoryStorage is ctor for MemoryStorage.
+// SetSchemaVersion records the schema version.
+func (m *MemoryStorage) SetSchemaVersion(version int) error {
+	m.schema = version
+	return nil
+}
+
+// NewMemoryStorage is ctor for MemoryStorage with a random node ID.
 func NewMemoryStorage() (*MemoryStorage, error) {
-	nodeID, err := uuid.NewRandom()
-	if err != nil {
-		return nil, err
-	}
+	return NewMemoryStorageWithNodeID(NewNodeID())
+}
 
+// NewMemoryStorageWithNodeID is ctor for MemoryStorage with a chosen node ID.
+func NewMemoryStorageWithNodeID(nodeID NodeID) (*MemoryStorage, error) {
 	storage := &MemoryStorage{
-		data:   make(map[string]Value),
-		nodeID: nodeID,
+		data:     make(map[string]Value),
+		history:  make(map[string][]Value),
+		nodeID:   nodeID,
+		expiring: make(map[string]int64),
 	}
 
 	return storage, nil
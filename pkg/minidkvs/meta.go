@@ -0,0 +1,49 @@
+package minidkvs
+
+import "time"
+
+// MetaStorage is an optional Storage extension for backends that keep value
+// headers apart from content, so that reads which only need versions and
+// timestamps don't load large payloads.
+type MetaStorage interface {
+	// GetMeta is Get without Content.
+	GetMeta(key string) (*Value, error)
+}
+
+type dbMessageMeta struct {
+	key       string
+	replyChan chan tryValue
+}
+
+// GetMeta returns the stored value of key without its Content, including
+// tombstones and expired values, or nil when the key was never written. It is
+// meant for version checks before a write.
+func (d *Database) GetMeta(key string) (*Value, error) {
+	m := dbMessageMeta{key: key, replyChan: make(chan tryValue, 1)}
+	try, err := call(d, newMetaMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	return try.value, try.err
+}
+
+// storageGetMeta reads key's header through MetaStorage when the storage has
+// it, otherwise through Get. Content may or may not be set.
+func (d *Database) storageGetMeta(key string) (*Value, error) {
+	meta, ok := d.storage.(MetaStorage)
+	if !ok {
+		return d.storageGet(key)
+	}
+	if value, ok := d.absent.get(key); ok {
+		return value, nil
+	}
+
+	var value *Value
+	start := time.Now()
+	err := d.guard(func() (err error) {
+		value, err = meta.GetMeta(key)
+		return err
+	})
+	d.recordStorage("get_meta", key, start, 0, err)
+	return value, err
+}
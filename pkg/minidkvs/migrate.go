@@ -0,0 +1,94 @@
+package minidkvs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrMigrationsUnsupported is returned when Options.Migrations is set but the
+// Storage doesn't implement SchemaStorage.
+var ErrMigrationsUnsupported = errors.New("minidkvs: storage has no schema version")
+
+// ErrSchemaTooNew is returned when the storage was migrated by a newer build
+// than this one, whose migrations don't go that far.
+var ErrSchemaTooNew = errors.New("minidkvs: storage schema is newer than the latest migration")
+
+// SchemaStorage is an optional Storage extension for backends that record
+// which Migration the stored data was last brought up to. A new store is at
+// version 0.
+type SchemaStorage interface {
+	SchemaVersion() (int, error)
+	SetSchemaVersion(version int) error
+}
+
+// Migration upgrades stored data to schema Version. Migrations are listed in
+// Options.Migrations in increasing Version order, and every one newer than
+// the storage's schema version runs when the Database opens, before anything
+// else can use the storage. The storage's version is updated after each one,
+// so a failed migration is retried on the next open.
+type Migration struct {
+	Version int
+	Name    string
+
+	// Migrate rewrites whatever it needs to directly in storage. Its writes
+	// don't replicate or reach watchers.
+	Migrate func(storage Storage) error
+}
+
+// migrate runs the pending Options.Migrations, after taking a backup to
+// Options.MigrationBackup. Only called before the message loop starts.
+func (d *Database) migrate() error {
+	migrations := d.options.Migrations
+	if len(migrations) == 0 {
+		return nil
+	}
+	schema, ok := d.storage.(SchemaStorage)
+	if !ok {
+		return ErrMigrationsUnsupported
+	}
+
+	current, err := schema.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > migrations[len(migrations)-1].Version {
+		return ErrSchemaTooNew
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if d.options.MigrationBackup != nil {
+		deltas, err := d.dump("")
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := writeSnapshot(&buf, deltas); err != nil {
+			return err
+		}
+		if _, err := writeBackup(d.options.MigrationBackup, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range pending {
+		if err := m.Migrate(d.storage); err != nil {
+			return fmt.Errorf("minidkvs: migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		if err := schema.SetSchemaVersion(m.Version); err != nil {
+			return err
+		}
+	}
+
+	// What was read for the backup may no longer be what is stored.
+	d.absent = newNegativeCache(d.options.NegativeCacheTTL)
+	return nil
+}
@@ -0,0 +1,223 @@
+package minidkvs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorCheckpointPrefix is reserved for the checkpoints of Mirrors. Each is
+// stored at prefix+name+"/"+nodeID so mirrors on different nodes don't share
+// one.
+const MirrorCheckpointPrefix = ReservedPrefix + "mirror/"
+
+// Defaults used when the MirrorOptions fields are zero.
+const (
+	DefaultMirrorCheckpointInterval = time.Second
+	DefaultMirrorReplayWindow       = time.Minute
+	DefaultMirrorRetryBackoff       = 100 * time.Millisecond
+	DefaultMirrorMaxBackoff         = 10 * time.Second
+)
+
+// MirrorTarget is interface for an external system that a Mirror keeps a copy
+// in, such as a Redis, a Postgres table or an S3 bucket. Both methods may be
+// called more than once for the same write, so they must be idempotent, which
+// a plain upsert and delete are.
+type MirrorTarget interface {
+	Put(key string, value []byte) error
+	Delete(key string) error
+}
+
+// MirrorOptions configures a Mirror.
+type MirrorOptions struct {
+	// Prefix limits the mirror to keys under it.
+	Prefix string
+
+	// CheckpointInterval is how often progress is saved.
+	CheckpointInterval time.Duration
+
+	// ReplayWindow is how far before the checkpoint a restarted mirror
+	// starts replaying, to cover writes that replicated here late with
+	// older timestamps.
+	ReplayWindow time.Duration
+
+	// RetryBackoff is the wait after the first failure to apply a change.
+	// It doubles with each retry up to MaxBackoff.
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	// OnError is called with every failure, including ones that are
+	// retried.
+	OnError func(err error)
+}
+
+// Mirror copies every change in a Database, local or replicated, into a
+// MirrorTarget, so a minidkvs cluster can front a legacy system during a
+// migration. Changes are applied one at a time in the order they reach this
+// node and a failed change is retried until it succeeds, so later changes
+// wait behind it. Progress is checkpointed in the Database, and a mirror made
+// again under the same name replays from the checkpoint, so it should be made
+// before peers are added. Deleted and expired keys are deleted from the
+// target.
+type Mirror struct {
+	db        *Database
+	target    MirrorTarget
+	options   MirrorOptions
+	key       string
+	watcher   *Watcher
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// mark is the newest ModifiedAt applied and saved when it was last
+	// checkpointed. Only used by the mirror's goroutine.
+	mark      int64
+	saved     int64
+	lastSaved time.Time
+}
+
+// NewMirror is ctor for Mirror. It replays everything changed since the
+// checkpoint saved under name, or everything when there is none, and then
+// follows changes until Close. Replaying needs a KeyLister storage.
+func NewMirror(db *Database, name string, target MirrorTarget, options MirrorOptions) (*Mirror, error) {
+	if options.CheckpointInterval <= 0 {
+		options.CheckpointInterval = DefaultMirrorCheckpointInterval
+	}
+	if options.ReplayWindow <= 0 {
+		options.ReplayWindow = DefaultMirrorReplayWindow
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = DefaultMirrorRetryBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultMirrorMaxBackoff
+	}
+
+	m := &Mirror{
+		db:      db,
+		target:  target,
+		options: options,
+		key:     MirrorCheckpointPrefix + name + "/" + db.NodeID().String(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	res, err := db.Get(m.key)
+	if err != nil {
+		return nil, err
+	}
+	if res.HasValue {
+		if m.mark, err = strconv.ParseInt(string(res.Value), 10, 64); err != nil {
+			return nil, &CodecError{Key: m.key, Err: err}
+		}
+		m.saved = m.mark
+	}
+
+	// Watch before scanning so nothing written in between is missed. What
+	// both see is applied twice, which the target tolerates.
+	if m.watcher, err = db.Watch(options.Prefix); err != nil {
+		return nil, err
+	}
+	from := int64(0)
+	if m.mark > 0 {
+		from = m.mark - int64(options.ReplayWindow/time.Second)
+	}
+	scanner, err := db.Scan(options.Prefix, ScanOptions{IncludeDeleted: true})
+	if err != nil {
+		m.watcher.Close()
+		return nil, err
+	}
+
+	go m.run(scanner, from)
+	return m, nil
+}
+
+// Close stops mirroring, saves the checkpoint and waits for the change in
+// flight. Changes not yet applied are replayed by the next Mirror.
+func (m *Mirror) Close() {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.watcher.Close()
+	})
+	<-m.done
+}
+
+func (m *Mirror) run(scanner *Scanner, from int64) {
+	defer close(m.done)
+	defer m.checkpoint(true)
+
+	for scanner.Next() {
+		delta := scanner.Delta()
+		if delta.Value.ModifiedAt >= from && !m.apply(delta.Key, delta.Value) {
+			scanner.Close()
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		m.fail(err)
+	}
+
+	for change := range m.watcher.Changes {
+		if !m.apply(change.Key, change.Value) {
+			return
+		}
+	}
+}
+
+// apply writes one value to the target, retrying until it succeeds. It
+// returns false if the mirror was closed first.
+func (m *Mirror) apply(key string, value *Value) bool {
+	if strings.HasPrefix(key, MirrorCheckpointPrefix) {
+		return true
+	}
+
+	backoff := m.options.RetryBackoff
+	for {
+		var err error
+		if isLive(value) {
+			err = m.target.Put(key, value.Content)
+		} else {
+			err = m.target.Delete(key)
+		}
+		if err == nil {
+			break
+		}
+
+		m.fail(err)
+		select {
+		case <-time.After(backoff):
+		case <-m.stop:
+			return false
+		}
+		if backoff *= 2; backoff > m.options.MaxBackoff {
+			backoff = m.options.MaxBackoff
+		}
+	}
+
+	if value.ModifiedAt > m.mark {
+		m.mark = value.ModifiedAt
+	}
+	m.checkpoint(false)
+	return true
+}
+
+// checkpoint saves the mark if it moved and, unless final, the interval has
+// passed.
+func (m *Mirror) checkpoint(final bool) {
+	if m.mark == m.saved || (!final && time.Since(m.lastSaved) < m.options.CheckpointInterval) {
+		return
+	}
+	if err := m.db.Set(m.key, []byte(strconv.FormatInt(m.mark, 10))); err != nil {
+		m.fail(err)
+		return
+	}
+	m.saved = m.mark
+	m.lastSaved = time.Now()
+}
+
+func (m *Mirror) fail(err error) {
+	if m.options.OnError != nil {
+		m.options.OnError(err)
+	}
+}
@@ -0,0 +1,129 @@
+package minidkvs
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNotWriter is returned for a local write to a SingleWriter namespace on a
+// node other than its Writer.
+var ErrNotWriter = errors.New("minidkvs: node is not the namespace's writer")
+
+// ReplicationMode is how a namespace resolves concurrent writes.
+type ReplicationMode int
+
+const (
+	// LastWriterWins keeps the newer of two conflicting writes. It is the
+	// default and how keys outside any namespace behave.
+	LastWriterWins ReplicationMode = iota
+
+	// MergeValues combines conflicting live values with Namespace.Merge and
+	// stores the result as a new write, so nothing either side wrote is lost.
+	// Deletes still resolve by last-writer-wins.
+	MergeValues
+
+	// SingleWriter only accepts writes made by Namespace.Writer, so there is
+	// never anything to resolve. Other nodes serve reads and reject local
+	// writes with ErrNotWriter. This is the choice for data that must not
+	// conflict; there is no consensus protocol to fail over the writer.
+	SingleWriter
+)
+
+// Namespace configures replication for the keys under one prefix of
+// Options.Namespaces.
+type Namespace struct {
+	Mode ReplicationMode
+
+	// Merge combines two values for MergeValues. It must be commutative,
+	// associative and idempotent, so that every node reaches the same result
+	// whatever order it sees writes in.
+	Merge func(a, b []byte) []byte
+
+	// Writer is the node that owns a SingleWriter namespace.
+	Writer NodeID
+
+	// Replicas, when between zero and len(Nodes), keeps each key on only that
+	// many of Nodes, chosen by rendezvous hashing of the key. Placement is
+	// enforced like Options.Pins.
+	Replicas int
+	Nodes    []NodeID
+}
+
+// namespace returns the settings for key: the longest matching prefix of
+// Options.Namespaces, or the zero Namespace when none matches.
+func (d *Database) namespace(key string) Namespace {
+	longest := -1
+	var ns Namespace
+	for prefix, n := range d.options.Namespaces {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			ns = n
+		}
+	}
+	return ns
+}
+
+// checkWriter fails a local write to key when this node isn't allowed to make
+// it.
+func (d *Database) checkWriter(key string) error {
+	if err := d.checkMaintenance(); err != nil {
+		return err
+	}
+	if ns := d.namespace(key); ns.Mode == SingleWriter && ns.Writer != d.nodeID {
+		return ErrNotWriter
+	}
+	return nil
+}
+
+// placedOn reports whether key's namespace keeps a replica on node.
+func (d *Database) placedOn(key string, node NodeID) bool {
+	ns := d.namespace(key)
+	if ns.Replicas <= 0 || ns.Replicas >= len(ns.Nodes) {
+		return true
+	}
+
+	nodes := append([]NodeID(nil), ns.Nodes...)
+	weight := func(n NodeID) uint64 { return d.KeyHash(key + "\x00" + string(n)) }
+	sort.Slice(nodes, func(i, j int) bool {
+		if wi, wj := weight(nodes[i]), weight(nodes[j]); wi != wj {
+			return wi > wj
+		}
+		return nodes[i] < nodes[j]
+	})
+	for _, n := range nodes[:ns.Replicas] {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeReceived resolves incoming against existing for a MergeValues
+// namespace. When the merge gives something neither side has it is stored as
+// a local write that beats both, so it replicates back. Only called from the
+// message loop.
+func (d *Database) mergeReceived(key string, existing, incoming *Value, merge func(a, b []byte) []byte) error {
+	merged := merge(existing.Content, incoming.Content)
+	winner := existing
+	if valueWins(incoming, existing) {
+		winner = incoming
+	}
+
+	if bytes.Equal(merged, winner.Content) {
+		if winner == incoming {
+			return d.store(key, incoming, true)
+		}
+		return nil
+	}
+
+	value := d.newValueFrom(existing, merged, false)
+	if !valueWins(value, incoming) {
+		value.ModifiedAt = incoming.ModifiedAt + 1
+	}
+	value.Tags = winner.Tags
+	value.ExpiresAt = winner.ExpiresAt
+	value.Extensions = winner.Extensions
+	return d.store(key, value, false)
+}
@@ -0,0 +1,26 @@
+package minidkvs
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrNoNodeID is returned when Storage gives an empty node ID.
+var ErrNoNodeID = errors.New("minidkvs: storage returned an empty node ID")
+
+// NodeID identifies a node. Every write is stamped with the ID of the node
+// that made it and ties between concurrent writes are broken by comparing
+// IDs, so each node needs a different one. Any non-empty string works, such
+// as a hostname; NewNodeID makes a random UUID.
+type NodeID string
+
+// NewNodeID returns a random UUID as a NodeID.
+func NewNodeID() NodeID {
+	return NodeID(uuid.New().String())
+}
+
+// String returns the ID as is.
+func (id NodeID) String() string {
+	return string(id)
+}
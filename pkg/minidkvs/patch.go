@@ -0,0 +1,355 @@
+package minidkvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ErrPatchFailed is wrapped by errors from Patch when the patch can't be
+// applied to the stored value. The value is left as it was.
+var ErrPatchFailed = errors.New("minidkvs: patch failed")
+
+// PatchFormat selects how Patch reads its patch.
+type PatchFormat int
+
+const (
+	// MergePatch is JSON Merge Patch (RFC 7386): an object whose members
+	// replace the value's, with null removing them.
+	MergePatch PatchFormat = iota
+	// JSONPatch is JSON Patch (RFC 6902): an array of add, remove,
+	// replace, move, copy and test operations.
+	JSONPatch
+)
+
+// Patch applies patch to the JSON value under key in one step of the message
+// loop, so concurrent patches on this node never lose each other's changes. A
+// missing key patches null. Numbers are kept as written, so integers too large
+// for a float64 survive. The patched value replicates like any write; as with
+// Set, concurrent patches on different nodes are last-writer-wins.
+func (d *Database) Patch(key string, patch []byte, format PatchFormat) error {
+	_, err := d.update(key, func(current []byte) ([]byte, error) {
+		var doc interface{}
+		if current != nil {
+			if err := decodeJSON(current, &doc); err != nil {
+				return nil, &CodecError{Key: key, Err: err}
+			}
+		}
+
+		var err error
+		switch format {
+		case MergePatch:
+			var p interface{}
+			if err = decodeJSON(patch, &p); err == nil {
+				doc = mergePatch(doc, p)
+			}
+		case JSONPatch:
+			var ops []patchOp
+			if err = json.Unmarshal(patch, &ops); err == nil {
+				doc, err = applyJSONPatch(doc, ops)
+			}
+		default:
+			err = fmt.Errorf("unknown patch format %d", format)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPatchFailed, err)
+		}
+		return json.Marshal(doc)
+	})
+	return err
+}
+
+// decodeJSON is json.Unmarshal with numbers decoded as json.Number rather than
+// float64, which would round large integers.
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// jsonEqual compares two decoded JSON values as RFC 6902 test does, with
+// numbers equal when their values are, however they are written.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okX := new(big.Float).SetString(string(a))
+		y, okY := new(big.Float).SetString(string(b))
+		return okX && okY && x.Cmp(y) == 0
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, value := range a {
+			other, ok := b[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// mergePatch applies an RFC 7386 merge patch.
+func mergePatch(doc, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(target, name)
+		} else {
+			target[name] = mergePatch(target[name], value)
+		}
+	}
+	return target
+}
+
+// patchOp is one RFC 6902 operation.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies RFC 6902 operations in order. Any failure abandons
+// the whole patch.
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for _, op := range ops {
+		var value interface{}
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			if op.Value == nil {
+				return nil, fmt.Errorf("%s %q needs a value", op.Op, op.Path)
+			}
+			if err := decodeJSON(op.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, value)
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, op.Path); err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "move":
+			var moved interface{}
+			if doc, moved, err = pointerRemove(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = pointerGet(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, deepCopy(copied))
+			}
+		case "test":
+			var found interface{}
+			if found, err = pointerGet(doc, op.Path); err == nil && !jsonEqual(found, value) {
+				err = fmt.Errorf("test %q failed", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// splitPointer turns an RFC 6901 JSON Pointer into its reference tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("bad pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of length n. end allows
+// "-" and n itself, for adding at the end.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("bad array index %q", token)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = node[token]; !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("%q is not a container", pointer)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at pointer. Arrays are rebuilt, so
+// the parent is updated with the new slice.
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return addAt(doc, tokens, value)
+}
+
+func addAt(node interface{}, tokens []string, value interface{}) (interface{}, error) {
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if last {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", token)
+		}
+		updated, err := addAt(child, tokens[1:], value)
+		n[token] = updated
+		return n, err
+	case []interface{}:
+		i, err := arrayIndex(token, len(n), last)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		n[i], err = addAt(n[i], tokens[1:], value)
+		return n, err
+	}
+	return nil, fmt.Errorf("cannot add below a value that isn't an object or array")
+}
+
+// pointerRemove returns doc without the value at pointer, and that value.
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	return removeAt(doc, tokens)
+}
+
+func removeAt(node interface{}, tokens []string) (interface{}, interface{}, error) {
+	token, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("no member %q", token)
+		}
+		if last {
+			delete(n, token)
+			return n, child, nil
+		}
+		updated, removed, err := removeAt(child, tokens[1:])
+		n[token] = updated
+		return n, removed, err
+	case []interface{}:
+		i, err := arrayIndex(token, len(n), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := n[i]
+			return append(n[:i], n[i+1:]...), removed, nil
+		}
+		var removed interface{}
+		n[i], removed, err = removeAt(n[i], tokens[1:])
+		return n, removed, err
+	}
+	return nil, nil, fmt.Errorf("cannot remove below a value that isn't an object or array")
+}
+
+// deepCopy copies a decoded JSON value so copy ops don't alias.
+func deepCopy(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(n))
+		for k, e := range n {
+			c[k] = deepCopy(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(n))
+		for i, e := range n {
+			c[i] = deepCopy(e)
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,78 @@
+package minidkvs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	get := func() string {
+		res, _ := db.Get("doc")
+		return string(res.Value)
+	}
+
+	if err := db.Patch("doc", []byte(`{"a":1,"b":{"c":2}}`), MergePatch); err != nil {
+		t.Fatal("Failed to merge patch a missing key")
+	}
+	db.Patch("doc", []byte(`{"a":null,"b":{"d":3}}`), MergePatch)
+	if got := get(); got != `{"b":{"c":2,"d":3}}` {
+		t.Errorf("Unexpected merge result %s", got)
+	}
+
+	ops := `[
+		{"op":"add","path":"/list","value":[1,3]},
+		{"op":"add","path":"/list/1","value":2},
+		{"op":"add","path":"/list/-","value":4},
+		{"op":"replace","path":"/b/c","value":"x"},
+		{"op":"move","from":"/b/d","path":"/d"},
+		{"op":"copy","from":"/list","path":"/copy"},
+		{"op":"remove","path":"/copy/0"},
+		{"op":"test","path":"/d","value":3}
+	]`
+	if err := db.Patch("doc", []byte(ops), JSONPatch); err != nil {
+		t.Fatalf("Failed to apply JSON patch: %v", err)
+	}
+	want := `{"b":{"c":"x"},"copy":[2,3,4],"d":3,"list":[1,2,3,4]}`
+	if got := get(); got != want {
+		t.Errorf("Unexpected patch result %s", got)
+	}
+
+	failing := `[{"op":"remove","path":"/d"},{"op":"test","path":"/b/c","value":"y"}]`
+	if err := db.Patch("doc", []byte(failing), JSONPatch); !errors.Is(err, ErrPatchFailed) {
+		t.Error("Failed test op should fail the patch")
+	}
+	if got := get(); got != want {
+		t.Error("Failed patch should leave the value alone")
+	}
+}
+
+func TestPatchKeepsLargeIntegers(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("doc", []byte(`{"id":12345678901234567890,"n":1}`))
+	if err := db.Patch("doc", []byte(`{"name":"x"}`), MergePatch); err != nil {
+		t.Fatal("Failed to merge patch")
+	}
+	if res, _ := db.Get("doc"); string(res.Value) != `{"id":12345678901234567890,"n":1,"name":"x"}` {
+		t.Errorf("Unrelated patch changed the document: %s", res.Value)
+	}
+
+	test := `[{"op":"test","path":"/n","value":1.0},{"op":"add","path":"/big","value":98765432109876543210}]`
+	if err := db.Patch("doc", []byte(test), JSONPatch); err != nil {
+		t.Fatal("Test op should compare numbers by value")
+	}
+	if res, _ := db.Get("doc"); !strings.Contains(string(res.Value), `"big":98765432109876543210`) {
+		t.Errorf("Added integer was rounded: %s", res.Value)
+	}
+}
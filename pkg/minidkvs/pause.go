@@ -0,0 +1,115 @@
+package minidkvs
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrUnknownPeer is returned when pausing or resuming a peer that was never
+// added with AddPeer.
+var ErrUnknownPeer = errors.New("minidkvs: unknown peer")
+
+// PausePeer stops replicating with peer without removing it. A paused peer is
+// not asked for values by read repair or consistent reads and is not sent
+// repairs, but it still counts as a replica, so reads needing it fail with
+// ErrConsistencyUnavailable. Keys written while it is paused are remembered
+// and sent to it by ResumePeer. Pausing a paused peer does nothing.
+func (d *Database) PausePeer(peer Peer) error {
+	return d.setPaused(peer, true)
+}
+
+// ResumePeer undoes PausePeer and sends peer the latest version of every key
+// written while it was paused. Delivery is best-effort and happens in the
+// background, the same as read repair.
+func (d *Database) ResumePeer(peer Peer) error {
+	return d.setPaused(peer, false)
+}
+
+func (d *Database) setPaused(peer Peer, pause bool) error {
+	m := dbMessagePause{peer: peer, pause: pause, replyChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newPauseMessage(&m), m.replyChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// knowsPeer reports whether peer was added with AddPeer.
+func (d *Database) knowsPeer(peer Peer) bool {
+	for _, p := range d.peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// activePeers returns a copy of the peers that aren't paused. Only called from
+// the message loop.
+func (d *Database) activePeers() []Peer {
+	peers := make([]Peer, 0, len(d.peers))
+	for _, peer := range d.peers {
+		if _, paused := d.paused[peer]; !paused {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// hint remembers that key changed for every paused peer. Only called from the
+// message loop.
+func (d *Database) hint(key string) {
+	for _, keys := range d.paused {
+		keys[key] = struct{}{}
+	}
+}
+
+// pausePeer is the in-loop half of PausePeer.
+func (d *Database) pausePeer(peer Peer) error {
+	if !d.knowsPeer(peer) {
+		return ErrUnknownPeer
+	}
+	if _, paused := d.paused[peer]; !paused {
+		d.paused[peer] = make(map[string]struct{})
+	}
+	return nil
+}
+
+// resumePeer is the in-loop half of ResumePeer. The hinted keys are read here
+// so the peer gets the versions current at resume time, then pushed from a
+// goroutine so a slow peer doesn't hold up the loop.
+func (d *Database) resumePeer(peer Peer) error {
+	if !d.knowsPeer(peer) {
+		return ErrUnknownPeer
+	}
+	keys, paused := d.paused[peer]
+	if !paused {
+		return nil
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	deltas := make([]*Delta, 0, len(sorted))
+	for _, key := range sorted {
+		value, err := d.storageGet(key)
+		if err != nil {
+			return err
+		}
+		if value != nil && d.replicates(key, value) && d.pinnedToPeer(key, peer) {
+			deltas = append(deltas, &Delta{Key: key, Value: value})
+		}
+	}
+
+	delete(d.paused, peer)
+
+	go func() {
+		for _, delta := range deltas {
+			peer.ReceiveRemote(delta)
+		}
+	}()
+	return nil
+}
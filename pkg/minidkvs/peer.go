@@ -0,0 +1,153 @@
+package minidkvs
+
+import "errors"
+
+// ErrConsistencyUnavailable is returned by reads when fewer replicas answered
+// than the requested consistency level needs.
+var ErrConsistencyUnavailable = errors.New("minidkvs: not enough replicas available for requested consistency")
+
+// Consistency is the number of replicas a read must hear from.
+type Consistency int32
+
+const (
+	// ConsistencyLocal reads only this node's replica.
+	ConsistencyLocal Consistency = 0
+	// ConsistencyQuorum needs a majority of replicas (this node included).
+	ConsistencyQuorum Consistency = 1
+	// ConsistencyAll needs every replica to answer.
+	ConsistencyAll Consistency = 2
+)
+
+// Peer is interface for talking to another node holding a replica of the
+// database. *Database satisfies it so that nodes in the same process can be
+// wired together directly.
+type Peer interface {
+	GetRemote(key string) (*Value, error)
+	ReceiveRemote(delta *Delta) error
+}
+
+// tryValue wraps a raw Value read from storage and includes error obj.
+type tryValue struct {
+	value *Value
+	err   error
+}
+
+// GetRemote returns the raw stored Value for key including tombstones and
+// metadata. Missing keys, and values excluded by Options.ReplicateFilter, give
+// a nil Value and nil error. It is meant for peers rather than application
+// code, which should use Get.
+func (d *Database) GetRemote(key string) (*Value, error) {
+	return d.getRaw(key, false)
+}
+
+// getRaw reads the stored Value for key. Local reads skip
+// Options.ReplicateFilter.
+func (d *Database) getRaw(key string, local bool) (*Value, error) {
+	m := dbMessageRaw{key: key, local: local, replyChan: make(chan tryValue, 1)}
+	try, err := call(d, newRawMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	return try.value, try.err
+}
+
+// AddPeer registers another replica of the database.
+func (d *Database) AddPeer(peer Peer) {
+	m := dbMessageAddPeer{peer: peer, doneChan: make(chan struct{})}
+	wait(d, newAddPeerMessage(&m), m.doneChan)
+}
+
+// readRepair compares the local version of key with every peer and pushes the
+// winning version to whichever replicas (including this one) are stale. It is
+// best-effort: peers that fail to answer are skipped and picked up by the next
+// read.
+func (d *Database) readRepair(key string, local *Value, peers []Peer) {
+	remote, answered, winner := fetchFromPeers(key, local, peers)
+
+	if winner == nil {
+		return
+	}
+
+	delta := &Delta{Key: key, Value: winner}
+
+	if winner != local {
+		d.ReceiveRemote(delta)
+	}
+
+	if !d.replicates(key, winner) {
+		return
+	}
+
+	for i, peer := range peers {
+		if !d.pinnedToPeer(key, peer) {
+			continue
+		}
+		if answered[i] && (remote[i] == nil || valueWins(winner, remote[i])) {
+			peer.ReceiveRemote(delta)
+		}
+	}
+}
+
+// fetchFromPeers asks every peer for its version of key. It returns each
+// peer's value, whether that peer answered at all, and the overall winner
+// among local and the remote values.
+func fetchFromPeers(key string, local *Value, peers []Peer) ([]*Value, []bool, *Value) {
+	remote := make([]*Value, len(peers))
+	answered := make([]bool, len(peers))
+	winner := local
+
+	for i, peer := range peers {
+		value, err := peer.GetRemote(key)
+		if err != nil {
+			continue
+		}
+		remote[i] = value
+		answered[i] = true
+		if value != nil && (winner == nil || valueWins(value, winner)) {
+			winner = value
+		}
+	}
+
+	return remote, answered, winner
+}
+
+// consistentGet serves a read above ConsistencyLocal, or one whose causal
+// token the local replica can't satisfy. Replicas counts every replica,
+// including paused peers, which are left out of peers and so never answer.
+// It runs outside the message loop since it waits on peers. A newer remote
+// version is applied locally so that the next local read sees it too.
+func (d *Database) consistentGet(m *dbMessageGet, local *Value, peers []Peer, replicas int) {
+	_, answered, winner := fetchFromPeers(m.key, local, peers)
+
+	responses := 1
+	for _, ok := range answered {
+		if ok {
+			responses++
+		}
+	}
+
+	// A local read only came here to find a replica that has caught up
+	// with its token, so any number of answers will do.
+	needed := replicas
+	switch m.consistency {
+	case ConsistencyLocal:
+		needed = 1
+	case ConsistencyQuorum:
+		needed = replicas/2 + 1
+	}
+	if responses < needed {
+		m.replyChan <- TryGet{Error: ErrConsistencyUnavailable}
+		return
+	}
+
+	if !m.after.satisfiedBy(winner) {
+		m.replyChan <- TryGet{Error: ErrStaleRead}
+		return
+	}
+
+	m.replyChan <- TryGet{Result: newGetResult(winner), Error: nil}
+
+	if winner != local {
+		d.ReceiveRemote(&Delta{Key: m.key, Value: winner})
+	}
+}
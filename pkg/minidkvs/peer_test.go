@@ -0,0 +1,701 @@
+package minidkvs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it is true or a second has passed. Used for
+// behaviour that happens asynchronously in the background.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func remoteDelta(key string, content []byte, modifiedAt int64) *Delta {
+	return &Delta{
+		Key: key,
+		Value: &Value{
+			Version:    1,
+			ModifiedBy: NewNodeID(),
+			ModifiedAt: modifiedAt,
+			Content:    content,
+		},
+	}
+}
+
+func newReadRepairPair(t *testing.T) (*Database, *Database) {
+	a, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{ReadRepair: true})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	a.AddPeer(b)
+	return a, b
+}
+
+func mustMemoryStorage(t *testing.T) *MemoryStorage {
+	storage, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	return storage
+}
+
+// syncAll copies everything each database has to the other, standing in for
+// replication.
+func syncAll(t *testing.T, a, b *Database) {
+	var ab, ba bytes.Buffer
+	if err := a.Snapshot(&ab); err != nil || b.Snapshot(&ba) != nil {
+		t.Fatal("Failed to snapshot")
+	}
+	if err := b.Restore(&ab); err != nil || a.Restore(&ba) != nil {
+		t.Fatal("Failed to restore")
+	}
+}
+
+func TestReadRepairPullsNewerValue(t *testing.T) {
+	a, b := newReadRepairPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.ReceiveRemote(remoteDelta("k", []byte{1}, 100))
+	b.ReceiveRemote(remoteDelta("k", []byte{2}, 200))
+
+	res, err := a.Get("k")
+	if err != nil || res.Value[0] != 1 {
+		t.Error("First read should return the local value")
+	}
+
+	repaired := waitFor(func() bool {
+		res, err := a.Get("k")
+		return err == nil && res.HasValue && res.Value[0] == 2
+	})
+	if !repaired {
+		t.Error("Local replica was not repaired from peer")
+	}
+}
+
+func TestReadRepairPushesToStalePeer(t *testing.T) {
+	a, b := newReadRepairPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.ReceiveRemote(remoteDelta("k", []byte{1}, 200))
+	b.ReceiveRemote(remoteDelta("k", []byte{2}, 100))
+
+	if _, err := a.Get("k"); err != nil {
+		t.Error("Failed to get value")
+	}
+
+	repaired := waitFor(func() bool {
+		res, err := b.Get("k")
+		return err == nil && res.HasValue && res.Value[0] == 1
+	})
+	if !repaired {
+		t.Error("Stale peer was not repaired")
+	}
+}
+
+// failingPeer is a Peer that is never reachable.
+type failingPeer struct{}
+
+func (failingPeer) GetRemote(key string) (*Value, error) {
+	return nil, errors.New("unreachable")
+}
+
+func (failingPeer) ReceiveRemote(delta *Delta) error {
+	return errors.New("unreachable")
+}
+
+func TestQuorumReadReturnsNewestValue(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	defer b.Close()
+	a.AddPeer(b)
+	a.AddPeer(failingPeer{})
+
+	a.ReceiveRemote(remoteDelta("k", []byte{1}, 100))
+	b.ReceiveRemote(remoteDelta("k", []byte{2}, 200))
+
+	res, err := a.GetWithOptions("k", ReadOptions{Consistency: ConsistencyQuorum})
+	if err != nil {
+		t.Error("Quorum read failed with 2 of 3 replicas up")
+	}
+	if !res.HasValue || res.Value[0] != 2 {
+		t.Error("Quorum read did not return newest value")
+	}
+
+	_, err = a.GetWithOptions("k", ReadOptions{Consistency: ConsistencyAll})
+	if err != ErrConsistencyUnavailable {
+		t.Error("All read should fail when a peer is unreachable")
+	}
+}
+
+func TestSessionReadsOwnWritesAcrossNodes(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	defer b.Close()
+
+	session := NewSession()
+	if err := session.Set(a, "k", []byte{1}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+
+	_, err = session.Get(b, "k")
+	if err != ErrStaleRead {
+		t.Error("Read from a node without the write should be stale")
+	}
+
+	b.AddPeer(a)
+	res, err := session.Get(b, "k")
+	if err != nil {
+		t.Error("Read should be served via the peer that has the write")
+	}
+	if !res.HasValue || res.Value[0] != 1 {
+		t.Error("Session did not read its own write")
+	}
+
+	b.AddPeer(failingPeer{})
+	session.Set(a, "k2", []byte{2})
+	if res, err := session.Get(b, "k2"); err != nil || !res.HasValue {
+		t.Error("An unreachable peer should not fail a read another peer can serve")
+	}
+}
+
+func TestReplicateFilterByTag(t *testing.T) {
+	filter := func(key string, value *Value) bool {
+		return !value.HasTag("local")
+	}
+	options := Options{ReadRepair: true, ReplicateFilter: filter}
+	a, err := NewDatabaseWithOptions(mustMemoryStorage(t), options)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	defer b.Close()
+	a.AddPeer(b)
+
+	a.SetWithOptions("secret", []byte{1}, WriteOptions{Tags: []string{"local"}})
+	a.SetWithOptions("shared", []byte{2}, WriteOptions{Tags: []string{"config"}})
+
+	value, err := a.GetRemote("secret")
+	if err != nil || value != nil {
+		t.Error("Local-only value should not be visible to peers")
+	}
+	value, err = a.GetRemote("shared")
+	if err != nil || value == nil || !value.HasTag("config") {
+		t.Error("Shared value should be visible with its tags")
+	}
+
+	a.Get("secret")
+	a.Get("shared")
+	if !waitFor(func() bool { res, _ := b.Get("shared"); return res.HasValue }) {
+		t.Error("Shared value was not repaired onto peer")
+	}
+	if res, _ := b.Get("secret"); res.HasValue {
+		t.Error("Local-only value was pushed to peer")
+	}
+}
+
+func TestDiffDatabases(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	defer b.Close()
+
+	same := remoteDelta("same", []byte{1}, 100)
+	a.ReceiveRemote(same)
+	b.ReceiveRemote(same)
+	a.Set("only-a", []byte{1})
+	b.Set("only-b", []byte{1})
+	a.Set("content", []byte{1})
+	b.Set("content", []byte{2})
+	a.Set("version", []byte{1})
+	b.Set("version", []byte{1})
+
+	diffs, err := DiffDatabases(a, b)
+	if err != nil {
+		t.Fatal("Failed to diff")
+	}
+
+	expected := []struct {
+		key  string
+		kind DiffKind
+	}{
+		{"content", DiffContent},
+		{"only-a", DiffMissingRight},
+		{"only-b", DiffMissingLeft},
+		{"version", DiffVersion},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatal("Wrong number of differences")
+	}
+	for i, e := range expected {
+		if diffs[i].Key != e.key || diffs[i].Kind != e.kind {
+			t.Error("Unexpected difference for " + diffs[i].Key)
+		}
+	}
+
+	var report bytes.Buffer
+	if err := WriteDiffReport(&report, diffs); err != nil || !strings.Contains(report.String(), "4 differing keys") {
+		t.Error("Report missing summary")
+	}
+}
+
+func TestPausePeerQueuesHints(t *testing.T) {
+	a, b := newReadRepairPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.PausePeer(b); err != nil {
+		t.Fatal("Failed to pause peer")
+	}
+	if err := a.Set("k", []byte{1}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+
+	if _, err := a.GetWithOptions("k", ReadOptions{Consistency: ConsistencyAll}); err != ErrConsistencyUnavailable {
+		t.Error("Paused peer should not answer reads")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if res, _ := b.Get("k"); res.HasValue {
+		t.Error("Paused peer should not be repaired")
+	}
+
+	if err := a.ResumePeer(b); err != nil {
+		t.Fatal("Failed to resume peer")
+	}
+	caughtUp := waitFor(func() bool {
+		res, err := b.Get("k")
+		return err == nil && res.HasValue && res.Value[0] == 1
+	})
+	if !caughtUp {
+		t.Error("Resumed peer did not get writes made while it was paused")
+	}
+
+	if err := a.PausePeer(failingPeer{}); err != ErrUnknownPeer {
+		t.Error("Pausing a peer that was never added should fail")
+	}
+}
+
+func TestDeltaSealerRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	sealer, err := NewDeltaSealer(key)
+	if err != nil {
+		t.Fatal("Failed to create sealer")
+	}
+
+	delta := remoteDelta("secret/k", []byte("plaintext"), 100)
+	sealed, err := sealer.Seal(delta)
+	if err != nil {
+		t.Fatal("Failed to seal delta")
+	}
+	if bytes.Contains(sealed, []byte("plaintext")) || bytes.Contains(sealed, []byte("secret/k")) {
+		t.Error("Sealed delta should not contain the key or content")
+	}
+
+	opened, err := sealer.Open(sealed)
+	if err != nil || opened.Key != "secret/k" || string(opened.Value.Content) != "plaintext" {
+		t.Error("Opened delta should match the original")
+	}
+
+	other, _ := NewDeltaSealer(bytes.Repeat([]byte{8}, 32))
+	if _, err := other.Open(sealed); err != ErrSealBroken {
+		t.Error("Opening with the wrong key should fail")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := sealer.Open(sealed); err != ErrSealBroken {
+		t.Error("Opening a tampered delta should fail")
+	}
+}
+
+func TestPinnedKeysStayOnAllowedNodes(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+
+	pins := map[string][]NodeID{"eu/": {a.NodeID()}}
+	b, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{
+		ReadRepair:  true,
+		Pins:        pins,
+		DeadLetters: NewMemoryDeadLetters(),
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+	b.AddPeer(a)
+
+	if err := b.ReceiveRemote(remoteDelta("eu/user", []byte{1}, 100)); !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Node outside the pin should reject the delta")
+	}
+	if err := b.ReceiveRemote(remoteDelta("us/user", []byte{1}, 100)); err != nil {
+		t.Error("Unpinned key should be accepted")
+	}
+
+	if !b.pinnedToPeer("eu/user", a) || b.pinnedToPeer("eu/user", failingPeer{}) {
+		t.Error("Only the listed peer should be allowed the pinned key")
+	}
+}
+
+func TestResumeSkipsPinnedKeys(t *testing.T) {
+	b, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+
+	storage := mustMemoryStorage(t)
+	id, _ := storage.GetNodeID()
+	a, err := NewDatabaseWithOptions(storage, Options{Pins: map[string][]NodeID{"eu/": {id}}})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	a.AddPeer(b)
+
+	a.PausePeer(b)
+	a.Set("eu/user", []byte{1})
+	a.Set("us/user", []byte{1})
+	a.ResumePeer(b)
+
+	if !waitFor(func() bool { res, _ := b.Get("us/user"); return res.HasValue }) {
+		t.Fatal("Expected the unpinned key to be pushed on resume")
+	}
+	if res, _ := b.Get("eu/user"); res.HasValue {
+		t.Error("Pinned key should not be pushed to a node outside the pin")
+	}
+}
+
+func TestConsistentReadOfPinnedKeyFromOtherNode(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	a.Set("eu/user", []byte{1})
+	a.Set("us/user", []byte{1})
+
+	b, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{Pins: map[string][]NodeID{"eu/": {a.NodeID()}}})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+	b.AddPeer(a)
+
+	quorum := ReadOptions{Consistency: ConsistencyQuorum}
+	if res, _ := b.GetWithOptions("eu/user", quorum); res.HasValue {
+		t.Error("Node outside the pin should not be handed the pinned value")
+	}
+	if res, err := b.GetWithOptions("us/user", quorum); err != nil || !res.HasValue {
+		t.Error("Unpinned key should be readable at quorum")
+	}
+}
+
+func TestConsistentReadOfPinnedKeyCountsOnlyPinnedPeers(t *testing.T) {
+	a, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	a.Set("eu/user", []byte{1})
+
+	storage := mustMemoryStorage(t)
+	id, _ := storage.GetNodeID()
+	pins := map[string][]NodeID{"eu/": {a.NodeID(), id}}
+	b, err := NewDatabaseWithOptions(storage, Options{Pins: pins})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+	b.AddPeer(a)
+	b.AddPeer(failingPeer{})
+
+	all := ReadOptions{Consistency: ConsistencyAll}
+	if res, err := b.GetWithOptions("eu/user", all); err != nil || !res.HasValue {
+		t.Errorf("Peer outside the pin should not count as a replica, got %v", err)
+	}
+	if _, err := b.GetWithOptions("us/user", all); err != ErrConsistencyUnavailable {
+		t.Error("Unpinned key should still need every peer")
+	}
+}
+
+func TestOldGenerationDeltasAreRejected(t *testing.T) {
+	old, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer old.Close()
+	old.Set("k", []byte("stale"))
+
+	wiped, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{ReadRepair: true, Generation: 1})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer wiped.Close()
+	wiped.AddPeer(old)
+
+	stale, _ := old.GetRemote("k")
+	if err := wiped.ReceiveRemote(&Delta{Key: "k", Value: stale}); !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Delta from an older generation should be rejected")
+	}
+
+	if _, err := wiped.SetWithOptions("fresh", []byte{1}, WriteOptions{}); err != nil {
+		t.Fatal("Failed to set value")
+	}
+	if value, _ := wiped.GetRemote("fresh"); value.Generation != 1 {
+		t.Error("Local writes should be stamped with the generation")
+	}
+	if err := old.ReceiveRemote(&Delta{Key: "fresh", Value: &Value{Version: 1, ModifiedBy: "x", ModifiedAt: 1, Generation: 1}}); err != nil {
+		t.Error("Newer generations should be accepted")
+	}
+}
+
+func TestTombstoneWindowBlocksStaleResurrection(t *testing.T) {
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{TombstoneWindow: time.Hour})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	db.ReceiveRemote(remoteDelta("k", []byte{1}, now-3*3600))
+	deleted := remoteDelta("k", nil, now-2*3600)
+	deleted.Value.Deleted = true
+	db.ReceiveRemote(deleted)
+
+	// Newer than the delete but written long ago by a peer that was offline.
+	if err := db.ReceiveRemote(remoteDelta("k", []byte{2}, now-2*3600+1)); !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Stale write should not undelete the key")
+	}
+	if res, _ := db.Get("k"); res.HasValue {
+		t.Error("Key should still be deleted")
+	}
+
+	if err := db.ReceiveRemote(remoteDelta("k", []byte{3}, now)); err != nil {
+		t.Error("Recent write should recreate the key")
+	}
+	if res, _ := db.Get("k"); !res.HasValue || res.Value[0] != 3 {
+		t.Error("Recent write should be readable")
+	}
+}
+
+func TestDigests(t *testing.T) {
+	newDB := func() *Database {
+		db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{DigestBuckets: 16})
+		if err != nil {
+			t.Fatal("Failed to create database")
+		}
+		return db
+	}
+	a, b := newDB(), newDB()
+	defer a.Close()
+	defer b.Close()
+
+	for i, key := range []string{"a", "b", "c", "d"} {
+		delta := remoteDelta(key, []byte{byte(i)}, 100)
+		a.ReceiveRemote(delta)
+		b.ReceiveRemote(delta)
+	}
+
+	// a scans now and is maintained incrementally from here; b scans last.
+	if _, err := a.Digests(); err != nil {
+		t.Fatal("Failed to get digests")
+	}
+	late := remoteDelta("e", []byte{9}, 200)
+	a.ReceiveRemote(late)
+	a.ReceiveRemote(remoteDelta("a", []byte{7}, 300))
+
+	digestsA, _ := a.Digests()
+	digestsB, _ := b.Digests()
+	if equalDigests(digestsA, digestsB) {
+		t.Error("Replicas with different data should have different digests")
+	}
+
+	b.ReceiveRemote(late)
+	aValue, _ := a.GetRemote("a")
+	b.ReceiveRemote(&Delta{Key: "a", Value: aValue})
+	digestsB, _ = b.Digests()
+	if !equalDigests(digestsA, digestsB) {
+		t.Error("Incremental digests should match a full scan of the same data")
+	}
+}
+
+func equalDigests(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestXXHash64(t *testing.T) {
+	vectors := map[string]uint64{
+		"":     0xef46db3751d8e999,
+		"a":    0xd24ec4f1a98c6e5b,
+		"asdf": 0x415872f599cea71e,
+		"Call me Ishmael. Some years ago--never mind how long precisely-": 0x02a2e85470d6fd96,
+	}
+	for input, want := range vectors {
+		if got := XXHash64([]byte(input)); got != want {
+			t.Errorf("XXHash64(%q) = %x, want %x", input, got, want)
+		}
+	}
+}
+
+// union merges two sets of bytes.
+func union(a, b []byte) []byte {
+	seen := make(map[byte]bool)
+	for _, c := range append(append([]byte{}, a...), b...) {
+		seen[c] = true
+	}
+	out := []byte{}
+	for c := 0; c < 256; c++ {
+		if seen[byte(c)] {
+			out = append(out, byte(c))
+		}
+	}
+	return out
+}
+
+func TestNamespaces(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	writer := NewNodeID()
+	db, err := NewDatabaseWithOptions(storage, Options{
+		DeadLetters: NewMemoryDeadLetters(),
+		Namespaces: map[string]Namespace{
+			"set/":  {Mode: MergeValues, Merge: union},
+			"meta/": {Mode: SingleWriter, Writer: writer},
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Set("set/k", []byte("ac"))
+	if err := db.ReceiveRemote(remoteDelta("set/k", []byte("b"), time.Now().Unix()+60)); err != nil {
+		t.Fatal("Failed to receive delta")
+	}
+	if res, _ := db.Get("set/k"); string(res.Value) != "abc" {
+		t.Errorf("Expected merged value abc but got %s", res.Value)
+	}
+
+	if err := db.Set("meta/k", []byte{1}); err != ErrNotWriter {
+		t.Error("Only the writer should write a single-writer namespace")
+	}
+	if err := db.ReceiveRemote(remoteDelta("meta/k", []byte{1}, 100)); !errors.Is(err, ErrDeltaRejected) {
+		t.Error("Delta from another writer should be rejected")
+	}
+	delta := remoteDelta("meta/k", []byte{1}, 100)
+	delta.Value.ModifiedBy = writer
+	if err := db.ReceiveRemote(delta); err != nil {
+		t.Error("Delta from the writer should be accepted")
+	}
+}
+
+func TestNamespaceReplicas(t *testing.T) {
+	nodes := []NodeID{NewNodeID(), NewNodeID(), NewNodeID()}
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{
+		Namespaces: map[string]Namespace{"cache/": {Replicas: 2, Nodes: nodes}},
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("cache/%d", i)
+		placed := 0
+		for _, node := range nodes {
+			if db.pinnedTo(key, node) {
+				placed++
+			}
+		}
+		if placed != 2 {
+			t.Errorf("Expected %s on 2 nodes but it is on %d", key, placed)
+		}
+	}
+	if !db.pinnedTo("other", nodes[0]) {
+		t.Error("Keys outside the namespace should go everywhere")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	a, b := newReadRepairPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	a.Set("k", []byte{1})
+	if err := a.EnterMaintenance(time.Minute); err != nil {
+		t.Fatal("Failed to enter maintenance")
+	}
+
+	var maint *MaintenanceError
+	if err := a.Set("k", []byte{2}); !errors.As(err, &maint) || maint.RetryAfter != time.Minute || !errors.Is(err, ErrMaintenance) {
+		t.Errorf("Expected a maintenance error but got %v", err)
+	}
+	if err := a.ReceiveRemote(remoteDelta("k", []byte{3}, 100)); !errors.Is(err, ErrMaintenance) {
+		t.Error("Deltas from peers should be refused in maintenance")
+	}
+	if res, _ := a.Get("k"); !bytes.Equal(res.Value, []byte{1}) {
+		t.Error("Reads should be served in maintenance")
+	}
+	if stats := a.Stats(); stats.PausedPeers != stats.Peers {
+		t.Error("Expected every peer to be paused")
+	}
+
+	if err := a.ExitMaintenance(); err != nil {
+		t.Fatal("Failed to exit maintenance")
+	}
+	if err := a.Set("k", []byte{2}); err != nil {
+		t.Error("Writes should be accepted after maintenance")
+	}
+	if stats := a.Stats(); stats.PausedPeers != 0 {
+		t.Error("Expected peers to be resumed")
+	}
+}
@@ -0,0 +1,74 @@
+package minidkvs
+
+import "strings"
+
+// IdentifiedPeer is a Peer that can say which node it is. Keys covered by
+// Options.Pins are only pushed to peers that implement it.
+type IdentifiedPeer interface {
+	Peer
+	NodeID() NodeID
+}
+
+// NodeID returns the ID this node stamps its writes with.
+func (d *Database) NodeID() NodeID {
+	return d.nodeID
+}
+
+// pinnedTo reports whether key may be held by node under Options.Pins and
+// its namespace's replica placement.
+func (d *Database) pinnedTo(key string, node NodeID) bool {
+	if !d.placedOn(key, node) {
+		return false
+	}
+
+	longest := -1
+	var allowed []NodeID
+	for prefix, nodes := range d.options.Pins {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			allowed = nodes
+		}
+	}
+	if longest < 0 {
+		return true
+	}
+
+	for _, id := range allowed {
+		if id == node {
+			return true
+		}
+	}
+	return false
+}
+
+// peersFor returns the active peers that a read of key may ask, the ones
+// that may hold it, and how many replicas of key there are: this node and
+// every peer that may hold it, paused or not. A node that may not hold key
+// asks none, so a pinned value never reaches it through a consistent read or
+// read repair. Only called from the message loop.
+func (d *Database) peersFor(key string) ([]Peer, int) {
+	if !d.pinnedTo(key, d.nodeID) {
+		return nil, 1
+	}
+	replicas := 1
+	var peers []Peer
+	for _, peer := range d.peers {
+		if !d.pinnedToPeer(key, peer) {
+			continue
+		}
+		replicas++
+		if _, paused := d.paused[peer]; !paused {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, replicas
+}
+
+// pinnedToPeer is pinnedTo for a peer. Peers that can't identify themselves
+// only get unpinned keys.
+func (d *Database) pinnedToPeer(key string, peer Peer) bool {
+	if identified, ok := peer.(IdentifiedPeer); ok {
+		return d.pinnedTo(key, identified.NodeID())
+	}
+	return d.pinnedTo(key, "")
+}
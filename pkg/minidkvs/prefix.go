@@ -0,0 +1,66 @@
+package minidkvs
+
+import "github.com/google/uuid"
+
+// DeletePrefixOptions controls DeletePrefix.
+type DeletePrefixOptions struct {
+	// DryRun only counts the keys that would be deleted.
+	DryRun bool
+}
+
+// tryCount wraps a count and includes error obj.
+type tryCount struct {
+	count int
+	err   error
+}
+
+// DeletePrefix deletes every key starting with prefix in one step of the
+// message loop and returns how many keys were (or, with DryRun, would be)
+// deleted. Watchers see the deletes as one Change.Group. Keys that are already
+// deleted or expired aren't counted.
+func (d *Database) DeletePrefix(prefix string, options DeletePrefixOptions) (int, error) {
+	m := dbMessageDeletePrefix{
+		prefix:    prefix,
+		options:   options,
+		replyChan: make(chan tryCount, 1),
+	}
+	try, err := call(d, newDeletePrefixMessage(&m), m.replyChan)
+	if err != nil {
+		return 0, err
+	}
+	return try.count, try.err
+}
+
+// deletePrefix does the work of DeletePrefix. Only called from the message
+// loop. On a storage error the count of keys already deleted is returned.
+func (d *Database) deletePrefix(prefix string, options DeletePrefixOptions) (int, error) {
+	deltas, err := d.dump(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	live := deltas[:0]
+	for _, delta := range deltas {
+		if isLive(delta.Value) {
+			live = append(live, delta)
+		}
+	}
+	if options.DryRun {
+		return len(live), nil
+	}
+
+	group := uuid.New().String()
+	count := 0
+	for _, delta := range live {
+		tombstone, err := d.newValue(delta.Key, nil, true)
+		if err != nil {
+			return count, err
+		}
+		change := Change{Key: delta.Key, Value: tombstone, Group: group}
+		if err := d.storeChange(change); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,208 @@
+package minidkvs
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPresenceTTL is used when Register is given a TTL of zero or less,
+// which would otherwise register a member that never expires.
+const DefaultPresenceTTL = 30 * time.Second
+
+// DefaultPresenceInterval is used when Presence.Watch is given an interval of
+// zero or less.
+const DefaultPresenceInterval = time.Second
+
+// Presence is a liveness registry: services register under a prefix with
+// entries that expire unless refreshed, and anyone can list or watch who is
+// currently registered.
+type Presence struct {
+	db     *Database
+	prefix string
+}
+
+// Member is one live registration.
+type Member struct {
+	Name      string
+	Info      []byte
+	ExpiresAt time.Time
+}
+
+// Registration keeps one member's entry alive until Close.
+type Registration struct {
+	presence *Presence
+	name     string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewPresence is ctor for Presence. Members are stored as prefix+name.
+func NewPresence(db *Database, prefix string) *Presence {
+	return &Presence{db: db, prefix: prefix}
+}
+
+// Register writes the member's entry with the given TTL and keeps rewriting it
+// at a third of the TTL so it stays alive while this process does. If the
+// process dies the entry expires on every node. TTLs are rounded up to whole
+// seconds, the same as WriteOptions.TTL.
+func (p *Presence) Register(name string, info []byte, ttl time.Duration) (*Registration, error) {
+	if ttl <= 0 {
+		ttl = DefaultPresenceTTL
+	}
+	ttl = (ttl + time.Second - 1).Truncate(time.Second)
+
+	write := func() error {
+		_, err := p.db.SetWithOptions(p.prefix+name, info, WriteOptions{TTL: ttl})
+		return err
+	}
+	if err := write(); err != nil {
+		return nil, err
+	}
+
+	r := &Registration{
+		presence: p,
+		name:     name,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				// A failed refresh is retried on the next tick; the entry
+				// only lapses if refreshes keep failing for the whole TTL.
+				write()
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// Close stops refreshing and removes the entry straight away.
+func (r *Registration) Close() error {
+	close(r.stop)
+	<-r.done
+	return r.presence.db.Delete(r.presence.prefix + r.name)
+}
+
+// Members lists every live registration sorted by name. It needs a KeyLister
+// storage.
+func (p *Presence) Members() ([]Member, error) {
+	m := dbMessageDump{prefix: p.prefix, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(p.db, newDumpMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	if try.err != nil {
+		return nil, try.err
+	}
+
+	members := []Member{}
+	for _, delta := range try.deltas {
+		if !isLive(delta.Value) {
+			continue
+		}
+		members = append(members, Member{
+			Name:      strings.TrimPrefix(delta.Key, p.prefix),
+			Info:      delta.Value.Content,
+			ExpiresAt: time.Unix(delta.Value.ExpiresAt, 0),
+		})
+	}
+	return members, nil
+}
+
+// MembershipWatcher delivers the full member list each time it changes.
+type MembershipWatcher struct {
+	Members <-chan []Member
+
+	watcher   *Watcher
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Watch reports the member list straight away and then whenever someone joins,
+// leaves or changes their info. Expiry doesn't produce a change event, so the
+// list is also re-checked every interval to notice members whose entries
+// lapsed. An interval of zero or less uses DefaultPresenceInterval.
+func (p *Presence) Watch(interval time.Duration) (*MembershipWatcher, error) {
+	if interval <= 0 {
+		interval = DefaultPresenceInterval
+	}
+
+	watcher, err := p.db.Watch(p.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan []Member)
+	w := &MembershipWatcher{
+		Members: out,
+		watcher: watcher,
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last []Member
+		first := true
+		for {
+			members, err := p.Members()
+			if err == nil && (first || !sameMembers(last, members)) {
+				select {
+				case out <- members:
+				case <-w.stop:
+					return
+				}
+				last = members
+				first = false
+			}
+
+			select {
+			case <-w.stop:
+				return
+			case _, ok := <-w.watcher.Changes:
+				if !ok {
+					return
+				}
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// Close stops the watcher and closes its Members channel. Calling it again
+// does nothing.
+func (w *MembershipWatcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		w.watcher.Close()
+	})
+}
+
+// sameMembers compares two member lists ignoring expiry times, which change on
+// every refresh.
+func sameMembers(a, b []Member) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !bytes.Equal(a[i].Info, b[i].Info) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package minidkvs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	presence := NewPresence(db, "services/api/")
+	w, err := presence.Watch(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal("Failed to watch presence")
+	}
+	defer w.Close()
+
+	if members := <-w.Members; len(members) != 0 {
+		t.Error("Nobody should be registered yet")
+	}
+
+	reg, err := presence.Register("node-1", []byte("10.0.0.1"), time.Hour)
+	if err != nil {
+		t.Fatal("Failed to register")
+	}
+
+	members := <-w.Members
+	if len(members) != 1 || members[0].Name != "node-1" || string(members[0].Info) != "10.0.0.1" {
+		t.Error("Watcher should see the new member")
+	}
+
+	// An entry that lapsed without a delete is noticed by the periodic check.
+	lapsed := remoteDelta("services/api/node-2", []byte("x"), time.Now().Unix())
+	lapsed.Value.ExpiresAt = time.Now().Unix() + 1
+	db.ReceiveRemote(lapsed)
+	if members := <-w.Members; len(members) != 2 {
+		t.Error("Watcher should see the second member")
+	}
+	if members := <-w.Members; len(members) != 1 {
+		t.Error("Watcher should notice the expired member")
+	}
+
+	if err := reg.Close(); err != nil {
+		t.Error("Failed to deregister")
+	}
+	if members := <-w.Members; len(members) != 0 {
+		t.Error("Watcher should see the member leave")
+	}
+}
+
+func TestPresenceDefaults(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	presence := NewPresence(db, "services/api/")
+	w, err := presence.Watch(0)
+	if err != nil {
+		t.Fatal("Failed to watch presence")
+	}
+	defer w.Close()
+
+	for _, ttl := range []time.Duration{0, time.Nanosecond} {
+		reg, err := presence.Register("node", nil, ttl)
+		if err != nil {
+			t.Fatal("Failed to register")
+		}
+		if left, err := db.TTL("services/api/node"); err != nil || left <= 0 || left == NoExpiry {
+			t.Errorf("Registration with TTL %v should still expire", ttl)
+		}
+		reg.Close()
+	}
+}
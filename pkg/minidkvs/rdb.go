@@ -0,0 +1,588 @@
+package minidkvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"time"
+)
+
+// rdbCRCTable is the CRC-64/Jones polynomial Redis checksums dumps with.
+var rdbCRCTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// RDB opcodes and the value types the import can read or skip.
+const (
+	rdbOpSlotInfo      = 0xf4
+	rdbOpFunction2     = 0xf5
+	rdbOpFunctionPreGA = 0xf6
+	rdbOpModuleAux     = 0xf7
+	rdbOpIdle          = 0xf8
+	rdbOpFreq          = 0xf9
+	rdbOpAux           = 0xfa
+	rdbOpResizeDB      = 0xfb
+	rdbOpExpireMS      = 0xfc
+	rdbOpExpire        = 0xfd
+	rdbOpSelectDB      = 0xfe
+	rdbOpEOF           = 0xff
+
+	rdbTypeString              = 0
+	rdbTypeList                = 1
+	rdbTypeSet                 = 2
+	rdbTypeZSet                = 3
+	rdbTypeHash                = 4
+	rdbTypeZSet2               = 5
+	rdbTypeModule2             = 7
+	rdbTypeQuicklist           = 14
+	rdbTypeStream              = 15
+	rdbTypeQuicklist2          = 18
+	rdbTypeStream2             = 19
+	rdbTypeStream3             = 21
+	rdbTypeHashMetaPreGA       = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMeta            = 24
+	rdbTypeHashListpackEx      = 25
+
+	// Opcodes inside a module value, which module types save through the
+	// RedisModule_Save* API so their values can be skipped.
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSInt   = 1
+	rdbModuleOpUInt   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+)
+
+// rdbMaxString is the longest string Redis allows, so any longer length in a
+// dump means it is corrupt.
+const rdbMaxString = 512 << 20
+
+// errRDBCorrupt is returned for lengths and data that can't be right.
+var errRDBCorrupt = errors.New("corrupt RDB file")
+
+// rdbReader reads a Redis RDB dump, keeping a running checksum of everything
+// read.
+type rdbReader struct {
+	r       *bufio.Reader
+	version int
+	crc     uint64
+}
+
+// rdbRecords returns an importReader for a Redis RDB dump. Only string keys
+// are imported, from every logical database, with their expiry as a TTL. Keys
+// of other types are skipped and keys that have already expired are dropped,
+// the same as Redis does when it loads the dump. Values of pre-release module
+// types can't be skipped, so a dump holding one fails with the key's name.
+func rdbRecords(r io.Reader) (func() (batchWrite, error), error) {
+	rdb := &rdbReader{r: bufio.NewReader(r), crc: ^uint64(0)}
+	header, err := rdb.read(9)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:5]) != "REDIS" {
+		return nil, errors.New("minidkvs: not a Redis RDB file")
+	}
+	if rdb.version, err = strconv.Atoi(string(header[5:])); err != nil {
+		return nil, errors.New("minidkvs: not a Redis RDB file")
+	}
+	return func() (batchWrite, error) {
+		key, value, ttl, err := rdb.next()
+		return batchWrite{key: key, value: value, options: WriteOptions{TTL: ttl}}, err
+	}, nil
+}
+
+// next returns the next live string key.
+func (r *rdbReader) next() (string, []byte, time.Duration, error) {
+	var expireMS int64
+	for {
+		op, err := r.byte()
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		switch op {
+		case rdbOpEOF:
+			return "", nil, 0, r.checksum()
+		case rdbOpAux:
+			if _, err := r.string(); err != nil {
+				return "", nil, 0, err
+			}
+			_, err = r.string()
+		case rdbOpFunction2:
+			_, err = r.string()
+		case rdbOpResizeDB:
+			err = r.lengths(2)
+		case rdbOpSlotInfo:
+			err = r.lengths(3)
+		case rdbOpSelectDB, rdbOpIdle:
+			err = r.lengths(1)
+		case rdbOpFreq:
+			_, err = r.read(1)
+		case rdbOpModuleAux, rdbOpFunctionPreGA:
+			return "", nil, 0, fmt.Errorf("unsupported RDB opcode %#x", op)
+		case rdbOpExpire:
+			var b []byte
+			if b, err = r.read(4); err == nil {
+				expireMS = int64(binary.LittleEndian.Uint32(b)) * 1000
+			}
+		case rdbOpExpireMS:
+			var b []byte
+			if b, err = r.read(8); err == nil {
+				expireMS = int64(binary.LittleEndian.Uint64(b))
+			}
+
+		default:
+			key, err := r.string()
+			if err != nil {
+				return "", nil, 0, err
+			}
+			if op != rdbTypeString {
+				if err := r.skipValue(op, key); err != nil {
+					return "", nil, 0, err
+				}
+				expireMS = 0
+				continue
+			}
+			value, err := r.string()
+			if err != nil {
+				return "", nil, 0, err
+			}
+
+			var ttl time.Duration
+			if expireMS != 0 {
+				if ttl = time.Until(time.UnixMilli(expireMS)); ttl <= 0 {
+					expireMS = 0
+					continue
+				}
+			}
+			return string(key), value, ttl, nil
+		}
+		if err != nil {
+			return "", nil, 0, err
+		}
+	}
+}
+
+// checksum reads the trailing checksum, which dumps from version 5 on have,
+// and checks it unless Redis was configured not to write one.
+func (r *rdbReader) checksum() error {
+	if r.version < 5 {
+		return io.EOF
+	}
+	sum := ^r.crc
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return unexpected(err)
+	}
+	if stored := binary.LittleEndian.Uint64(b); stored != 0 && stored != sum {
+		return errors.New("RDB checksum mismatch")
+	}
+	return io.EOF
+}
+
+// skipValue reads past a value of a type that isn't imported.
+func (r *rdbReader) skipValue(valueType byte, key []byte) error {
+	switch valueType {
+	case rdbTypeList, rdbTypeSet, rdbTypeHash, rdbTypeZSet, rdbTypeZSet2, rdbTypeQuicklist, rdbTypeQuicklist2:
+		n, _, err := r.length()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := r.skipElement(valueType); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 9, 10, 11, 12, 13, 16, 17, 20, rdbTypeHashListpackExPreGA:
+		// Zipmap, ziplist, intset and listpack encodings are one string.
+		_, err := r.string()
+		return err
+	case rdbTypeHashListpackEx:
+		// The earliest field expiry, then the listpack.
+		if _, err := r.read(8); err != nil {
+			return err
+		}
+		_, err := r.string()
+		return err
+	case rdbTypeHashMeta, rdbTypeHashMetaPreGA:
+		return r.skipHashWithTTL(valueType)
+	case rdbTypeStream, rdbTypeStream2, rdbTypeStream3:
+		return r.skipStream(valueType)
+	case rdbTypeModule2:
+		return r.skipModule()
+	}
+	return fmt.Errorf("unsupported RDB value type %d for key %q", valueType, key)
+}
+
+// skipHashWithTTL reads past a hash whose fields have their own expiry.
+func (r *rdbReader) skipHashWithTTL(valueType byte) error {
+	if valueType == rdbTypeHashMeta {
+		// The earliest field expiry, which field expiries are relative to.
+		if _, err := r.read(8); err != nil {
+			return err
+		}
+	}
+	n, _, err := r.length()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		if err := r.lengths(1); err != nil {
+			return err
+		}
+		if _, err := r.string(); err != nil {
+			return err
+		}
+		if _, err := r.string(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStream reads past a stream: its entries as listpacks keyed by master
+// ID, then its metadata and consumer groups. Later stream types add fields.
+func (r *rdbReader) skipStream(valueType byte) error {
+	nodes, _, err := r.length()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		if _, err := r.string(); err != nil {
+			return err
+		}
+		if _, err := r.string(); err != nil {
+			return err
+		}
+	}
+
+	// Length and last ID, then first ID, max deleted ID and entries added.
+	metadata := 3
+	if valueType >= rdbTypeStream2 {
+		metadata += 5
+	}
+	if err := r.lengths(metadata); err != nil {
+		return err
+	}
+
+	groups, _, err := r.length()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if _, err := r.string(); err != nil {
+			return err
+		}
+		// Last delivered ID, then entries read.
+		fields := 2
+		if valueType >= rdbTypeStream2 {
+			fields++
+		}
+		if err := r.lengths(fields); err != nil {
+			return err
+		}
+
+		// Pending entries: a raw ID, delivery time and delivery count.
+		pending, _, err := r.length()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pending; j++ {
+			if _, err := r.read(16 + 8); err != nil {
+				return err
+			}
+			if err := r.lengths(1); err != nil {
+				return err
+			}
+		}
+
+		// Consumers: name, seen time, active time, then their pending IDs.
+		consumers, _, err := r.length()
+		if err != nil {
+			return err
+		}
+		times := 8
+		if valueType >= rdbTypeStream3 {
+			times += 8
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := r.string(); err != nil {
+				return err
+			}
+			if _, err := r.read(times); err != nil {
+				return err
+			}
+			owned, _, err := r.length()
+			if err != nil {
+				return err
+			}
+			if owned > rdbMaxString/16 {
+				return errRDBCorrupt
+			}
+			if _, err := r.read(int(owned) * 16); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipModule reads past a module value: the module ID, then typed fields
+// up to an EOF opcode.
+func (r *rdbReader) skipModule() error {
+	if err := r.lengths(1); err != nil {
+		return err
+	}
+	for {
+		op, _, err := r.length()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbModuleOpEOF:
+			return nil
+		case rdbModuleOpSInt, rdbModuleOpUInt:
+			err = r.lengths(1)
+		case rdbModuleOpFloat:
+			_, err = r.read(4)
+		case rdbModuleOpDouble:
+			_, err = r.read(8)
+		case rdbModuleOpString:
+			_, err = r.string()
+		default:
+			return fmt.Errorf("bad RDB module opcode %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipElement reads past one element of a collection.
+func (r *rdbReader) skipElement(valueType byte) error {
+	switch valueType {
+	case rdbTypeHash:
+		if _, err := r.string(); err != nil {
+			return err
+		}
+	case rdbTypeZSet:
+		if _, err := r.string(); err != nil {
+			return err
+		}
+		n, err := r.byte()
+		if err != nil || n >= 253 {
+			// 253 to 255 are NaN and the infinities, with nothing after.
+			return err
+		}
+		_, err = r.read(int(n))
+		return err
+	case rdbTypeZSet2:
+		if _, err := r.string(); err != nil {
+			return err
+		}
+		_, err := r.read(8)
+		return err
+	case rdbTypeQuicklist2:
+		if err := r.lengths(1); err != nil {
+			return err
+		}
+	}
+	_, err := r.string()
+	return err
+}
+
+// read reads exactly n bytes. Long reads grow their buffer as data arrives,
+// so a corrupt length fails at the end of the input rather than allocating
+// all of it up front.
+func (r *rdbReader) read(n int) ([]byte, error) {
+	var b []byte
+	if n <= 64<<10 {
+		b = make([]byte, n)
+		if _, err := io.ReadFull(r.r, b); err != nil {
+			return nil, unexpected(err)
+		}
+	} else {
+		var err error
+		if b, err = io.ReadAll(io.LimitReader(r.r, int64(n))); err != nil {
+			return nil, err
+		}
+		if len(b) < n {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	r.crc = crc64.Update(r.crc, rdbCRCTable, b)
+	return b, nil
+}
+
+func (r *rdbReader) byte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads a length. Encoded is true when it is really the format of a
+// specially encoded string.
+func (r *rdbReader) length() (n uint64, encoded bool, err error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := r.byte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case 0x80:
+		buf, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case 0x81:
+		buf, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("bad RDB length byte %#x", b)
+}
+
+// lengths reads past n lengths.
+func (r *rdbReader) lengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, _, err := r.length(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// string reads a string, which may be stored as an integer or compressed.
+func (r *rdbReader) string() ([]byte, error) {
+	n, encoded, err := r.length()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > rdbMaxString {
+			return nil, errRDBCorrupt
+		}
+		return r.read(int(n))
+	}
+
+	switch n {
+	case 0:
+		b, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case 1:
+		b, err := r.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case 2:
+		b, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case 3:
+		compressed, _, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		size, _, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		if compressed > rdbMaxString || size > rdbMaxString {
+			return nil, errRDBCorrupt
+		}
+		data, err := r.read(int(compressed))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(data, int(size))
+	}
+	return nil, fmt.Errorf("bad RDB string encoding %d", n)
+}
+
+// lzfDecompress expands LZF data, which Redis uses for long strings, into
+// size bytes.
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	// No LZF code expands more than 88 times, a three byte back reference
+	// to 264 bytes, so a larger size can't be right.
+	if size > len(in)*88 {
+		return nil, errRDBCorrupt
+	}
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		if len(out) > size {
+			return nil, errRDBCorrupt
+		}
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes.
+			end := i + ctrl + 1
+			if end > len(in) {
+				return nil, errRDBCorrupt
+			}
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+
+		// A back reference: copy length bytes from earlier in the output.
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errRDBCorrupt
+			}
+			length += int(in[i])
+			i++
+		}
+		length += 2
+		if i >= len(in) {
+			return nil, errRDBCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errRDBCorrupt
+		}
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != size {
+		return nil, errRDBCorrupt
+	}
+	return out, nil
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF, since a dump ends with
+// its EOF opcode rather than where the data runs out.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package minidkvs
+
+import "time"
+
+// RuntimeOptions are the Options that can be changed on a live Database with
+// Reconfigure. The rest are read outside the message loop or shape state
+// built when the Database opens, so changing them needs a restart.
+type RuntimeOptions struct {
+	ReadRepair        bool
+	MaxValueSize      int
+	MinFreeSpace      int64
+	TombstoneWindow   time.Duration
+	HistoryRetention  time.Duration
+	GroupCommitWindow time.Duration
+}
+
+type dbMessageReconfigure struct {
+	// options is nil to only read the current options.
+	options   *RuntimeOptions
+	replyChan chan RuntimeOptions
+}
+
+// RuntimeOptions returns the options currently in effect, including any
+// cluster settings.
+func (d *Database) RuntimeOptions() (RuntimeOptions, error) {
+	m := dbMessageReconfigure{replyChan: make(chan RuntimeOptions, 1)}
+	return call(d, newReloadMessage(&m), m.replyChan)
+}
+
+// Reconfigure replaces the runtime options. They take effect from the next
+// operation, without reopening the Database. Cluster settings still override
+// the options they cover.
+func (d *Database) Reconfigure(options RuntimeOptions) error {
+	m := dbMessageReconfigure{options: &options, replyChan: make(chan RuntimeOptions, 1)}
+	_, err := call(d, newReloadMessage(&m), m.replyChan)
+	return err
+}
+
+// reconfigure does the work of Reconfigure and RuntimeOptions. Only called
+// from the message loop.
+func (d *Database) reconfigure(options *RuntimeOptions) RuntimeOptions {
+	if options != nil {
+		for _, o := range []*Options{&d.configured, &d.options} {
+			o.ReadRepair = options.ReadRepair
+			o.MaxValueSize = options.MaxValueSize
+			o.MinFreeSpace = options.MinFreeSpace
+			o.TombstoneWindow = options.TombstoneWindow
+			o.HistoryRetention = options.HistoryRetention
+			o.GroupCommitWindow = options.GroupCommitWindow
+		}
+		d.loadClusterConfig()
+	}
+
+	return RuntimeOptions{
+		ReadRepair:        d.options.ReadRepair,
+		MaxValueSize:      d.options.MaxValueSize,
+		MinFreeSpace:      d.options.MinFreeSpace,
+		TombstoneWindow:   d.options.TombstoneWindow,
+		HistoryRetention:  d.options.HistoryRetention,
+		GroupCommitWindow: d.options.GroupCommitWindow,
+	}
+}
@@ -0,0 +1,33 @@
+package minidkvs
+
+// RedactedContent replaces content removed by a Redactor from RedactTagged.
+var RedactedContent = []byte("[redacted]")
+
+// Redactor returns the content to show in place of value's real content in
+// exports and operational tooling. Returning value.Content unchanged shows it
+// as is.
+type Redactor func(key string, value *Value) []byte
+
+// RedactTagged hides the content of values carrying any of tags, such as
+// "pii".
+func RedactTagged(tags ...string) Redactor {
+	return func(key string, value *Value) []byte {
+		for _, tag := range tags {
+			if value.HasTag(tag) {
+				return RedactedContent
+			}
+		}
+		return value.Content
+	}
+}
+
+// apply returns a copy of delta with its content redacted. A nil Redactor
+// returns delta itself.
+func (r Redactor) apply(delta *Delta) *Delta {
+	if r == nil || delta.Value == nil {
+		return delta
+	}
+	value := *delta.Value
+	value.Content = r(delta.Key, delta.Value)
+	return &Delta{Key: delta.Key, Value: &value}
+}
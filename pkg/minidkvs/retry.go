@@ -0,0 +1,46 @@
+package minidkvs
+
+import "time"
+
+// Backoff for Update between attempts that lost a race, doubling each time.
+const (
+	updateAttempts   = 10
+	updateMinBackoff = time.Millisecond
+	updateMaxBackoff = 100 * time.Millisecond
+)
+
+// Update replaces key's content with fn of its current content, retrying with
+// backoff whenever another write gets in between the read and the write. fn
+// gets nil for a missing, deleted or expired key, may be called several
+// times, and can abort by returning an error, which Update returns. After
+// repeated lost races Update gives up with ErrVersionMismatch.
+//
+// Unlike Patch, fn runs in the caller's goroutine and may call the Database.
+func (d *Database) Update(key string, fn func(old []byte) ([]byte, error)) error {
+	backoff := updateMinBackoff
+	for attempt := 0; ; attempt++ {
+		current, err := d.getRaw(key, true)
+		if err != nil {
+			return err
+		}
+
+		var old []byte
+		if isLive(current) {
+			old = current.Content
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+
+		_, err = d.SetWithVersion(key, value, versionOf(current))
+		if err != ErrVersionMismatch || attempt+1 == updateAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > updateMaxBackoff {
+			backoff = updateMaxBackoff
+		}
+	}
+}
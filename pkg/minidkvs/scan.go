@@ -0,0 +1,213 @@
+package minidkvs
+
+import "sort"
+
+// DefaultScanChunkSize is used when ScanOptions.ChunkSize is zero.
+const DefaultScanChunkSize = 256
+
+// ScanOptions controls Scan.
+type ScanOptions struct {
+	// ChunkSize is how many keys are read per trip through the message
+	// loop. Other operations run between chunks.
+	ChunkSize int
+
+	// IncludeDeleted returns tombstones and expired values too.
+	IncludeDeleted bool
+}
+
+// Scanner iterates over the keys under a prefix as they were when Scan was
+// called. It is not safe for concurrent use.
+type Scanner struct {
+	db      *Database
+	scan    *scanState
+	buf     []Delta
+	current Delta
+	err     error
+	done    bool
+}
+
+// scanState is the message loop's side of a Scanner or ReadTxn.
+type scanState struct {
+	keys    []string
+	pos     int
+	options ScanOptions
+
+	// everything is set for a ReadTxn, which may read any key any number
+	// of times, so every key written while it is open is preserved.
+	everything bool
+
+	// preimages holds what keys not yet read held when the scan started,
+	// for keys written since.
+	preimages map[string]*Value
+}
+
+type scanOp int
+
+const (
+	scanOpen scanOp = iota
+	scanNext
+	scanGet
+	scanClose
+)
+
+type dbMessageScan struct {
+	op        scanOp
+	scan      *scanState
+	prefix    string
+	key       string
+	replyChan chan tryDeltas
+}
+
+// Scan iterates over every key starting with prefix in key order, seeing the
+// database exactly as it was when Scan was called. Keys are fetched in chunks
+// so a long scan doesn't stall other operations. Writes made during the scan
+// keep the old value of keys it hasn't reached, which costs a storage read per
+// write until the Scanner is exhausted or closed. It needs a KeyLister
+// storage.
+func (d *Database) Scan(prefix string, options ScanOptions) (*Scanner, error) {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = DefaultScanChunkSize
+	}
+	scan := &scanState{options: options, preimages: make(map[string]*Value)}
+	m := dbMessageScan{op: scanOpen, scan: scan, prefix: prefix, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(d, newScanMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Scanner{db: d, scan: scan}, nil
+}
+
+// Next advances to the next key, returning false when there are none left or
+// on error.
+func (s *Scanner) Next() bool {
+	for len(s.buf) == 0 {
+		if s.done || s.err != nil {
+			return false
+		}
+		m := dbMessageScan{op: scanNext, scan: s.scan, replyChan: make(chan tryDeltas, 1)}
+		try, err := call(s.db, newScanMessage(&m), m.replyChan)
+		if err == nil {
+			err = try.err
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if try.deltas == nil {
+			s.done = true
+		}
+		s.buf = try.deltas
+	}
+	s.current, s.buf = s.buf[0], s.buf[1:]
+	return true
+}
+
+// Delta returns the key and value Next moved to.
+func (s *Scanner) Delta() Delta {
+	return s.current
+}
+
+// Err returns the error that stopped Next, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Close stops the scan early. Scanners that ran to the end close themselves.
+func (s *Scanner) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	m := dbMessageScan{op: scanClose, scan: s.scan, replyChan: make(chan tryDeltas, 1)}
+	_, err := call(s.db, newScanMessage(&m), m.replyChan)
+	return err
+}
+
+// handleScan is the message loop's half of Scanner.
+func (d *Database) handleScan(m *dbMessageScan) tryDeltas {
+	scan := m.scan
+	switch m.op {
+	case scanOpen:
+		if scan.everything {
+			d.scans[scan] = struct{}{}
+			return tryDeltas{}
+		}
+		keys, err := d.storageKeys(m.prefix)
+		if err != nil {
+			return tryDeltas{err: err}
+		}
+		scan.keys = keys
+		d.scans[scan] = struct{}{}
+		return tryDeltas{}
+
+	case scanNext:
+		// A nil result tells the Scanner it is finished, so an empty
+		// chunk of all-deleted keys must still be non-nil.
+		deltas := []Delta{}
+		for len(deltas) == 0 && scan.pos < len(scan.keys) {
+			end := scan.pos + scan.options.ChunkSize
+			if end > len(scan.keys) {
+				end = len(scan.keys)
+			}
+			for _, key := range scan.keys[scan.pos:end] {
+				value, preserved := scan.preimages[key]
+				if preserved {
+					delete(scan.preimages, key)
+				} else {
+					var err error
+					if value, err = d.storageGet(key); err != nil {
+						return tryDeltas{err: err}
+					}
+				}
+				scan.pos++
+				if value != nil && (scan.options.IncludeDeleted || isLive(value)) {
+					deltas = append(deltas, Delta{Key: key, Value: value})
+				}
+			}
+		}
+		if len(deltas) == 0 {
+			delete(d.scans, scan)
+			return tryDeltas{}
+		}
+		return tryDeltas{deltas: deltas}
+
+	case scanGet:
+		value, preserved := scan.preimages[m.key]
+		if !preserved {
+			var err error
+			if value, err = d.storageGet(m.key); err != nil {
+				return tryDeltas{err: err}
+			}
+		}
+		return tryDeltas{deltas: []Delta{{Key: m.key, Value: value}}}
+
+	default:
+		delete(d.scans, scan)
+		return tryDeltas{}
+	}
+}
+
+// preserve keeps old as the value of key for every open scan that hasn't
+// read key yet. Only the first write matters; later ones would overwrite
+// the value the scan needs.
+func (d *Database) preserve(key string, old *Value) {
+	for scan := range d.scans {
+		if scan.everything {
+			if _, ok := scan.preimages[key]; !ok {
+				scan.preimages[key] = old
+			}
+			continue
+		}
+		remaining := scan.keys[scan.pos:]
+		i := sort.SearchStrings(remaining, key)
+		if i == len(remaining) || remaining[i] != key {
+			continue
+		}
+		if _, ok := scan.preimages[key]; !ok {
+			scan.preimages[key] = old
+		}
+	}
+}
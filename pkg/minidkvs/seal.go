@@ -0,0 +1,67 @@
+package minidkvs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrSealBroken is returned by DeltaSealer.Open when a sealed delta was made
+// with a different key or has been tampered with.
+var ErrSealBroken = errors.New("minidkvs: sealed delta failed authentication")
+
+// DeltaSealer encrypts deltas with a key shared by the cluster, so that relays
+// and hubs carrying them between peers can't read or alter them even when
+// they terminate TLS. Transports call Seal before sending and Open before
+// passing the delta to ReceiveRemote.
+type DeltaSealer struct {
+	aead cipher.AEAD
+}
+
+// NewDeltaSealer is ctor for DeltaSealer. Key must be 16, 24 or 32 bytes for
+// AES-128, AES-192 or AES-256.
+func NewDeltaSealer(key []byte) (*DeltaSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &DeltaSealer{aead: aead}, nil
+}
+
+// Seal encrypts the whole delta, key included. Each call uses a fresh random
+// nonce, which is prepended to the result.
+func (s *DeltaSealer) Seal(delta *Delta) ([]byte, error) {
+	plain, err := json.Marshal(delta)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts a delta made by Seal.
+func (s *DeltaSealer) Open(sealed []byte) (*Delta, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, ErrSealBroken
+	}
+	nonce, box := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, box, nil)
+	if err != nil {
+		return nil, ErrSealBroken
+	}
+	var delta Delta
+	if err := json.Unmarshal(plain, &delta); err != nil {
+		return nil, err
+	}
+	return &delta, nil
+}
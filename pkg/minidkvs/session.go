@@ -0,0 +1,98 @@
+package minidkvs
+
+import "errors"
+
+// ErrStaleRead is returned when no reachable replica has caught up with the
+// causal token passed to a read.
+var ErrStaleRead = errors.New("minidkvs: no replica has caught up with causal token")
+
+// CausalToken identifies a write by its origin node and version. A read given
+// the token only succeeds with a version at least as new as that write, and
+// tokens of the same key can be compared with Supersedes to put writes in the
+// order every node applies them.
+type CausalToken struct {
+	Version    int
+	ModifiedAt int64
+	ModifiedBy NodeID
+	// Fence is the key's Value.Fence after the write.
+	Fence uint64
+}
+
+func newCausalToken(value *Value) CausalToken {
+	if value == nil {
+		return CausalToken{}
+	}
+	return CausalToken{
+		Version:    value.Version,
+		ModifiedAt: value.ModifiedAt,
+		ModifiedBy: value.ModifiedBy,
+		Fence:      value.Fence,
+	}
+}
+
+// Supersedes reports whether t is a later write to the same key than other.
+func (t CausalToken) Supersedes(other CausalToken) bool {
+	return valueWins(t.value(), other.value())
+}
+
+// value gives a Value carrying only the fields that order writes.
+func (t CausalToken) value() *Value {
+	return &Value{ModifiedAt: t.ModifiedAt, ModifiedBy: t.ModifiedBy, Fence: t.Fence}
+}
+
+// satisfiedBy reports whether value is the write the token came from or one
+// that supersedes it. A nil token is satisfied by anything.
+func (t *CausalToken) satisfiedBy(value *Value) bool {
+	if t == nil {
+		return true
+	}
+	if value == nil {
+		return false
+	}
+	written := t.value()
+	return sameWrite(value, written) || valueWins(value, written)
+}
+
+// Session tracks the causal token of every write made through it so that a
+// client moving between nodes always reads its own writes. If the node it
+// reads from is behind, the read goes to that node's peers, and fails with
+// ErrStaleRead if none of them has caught up either. A Session is not safe
+// for concurrent use.
+type Session struct {
+	tokens map[string]CausalToken
+}
+
+// NewSession is ctor for Session.
+func NewSession() *Session {
+	return &Session{tokens: make(map[string]CausalToken)}
+}
+
+// Set writes through db and remembers the write's token.
+func (s *Session) Set(db *Database, key string, value []byte) error {
+	token, err := db.SetWithToken(key, value)
+	if err != nil {
+		return err
+	}
+	s.tokens[key] = token
+	return nil
+}
+
+// Delete deletes through db and remembers the write's token.
+func (s *Session) Delete(db *Database, key string) error {
+	token, err := db.DeleteWithToken(key)
+	if err != nil {
+		return err
+	}
+	s.tokens[key] = token
+	return nil
+}
+
+// Get reads from db, never returning anything older than this session's own
+// last write to key.
+func (s *Session) Get(db *Database, key string) (GetResult, error) {
+	options := ReadOptions{}
+	if token, ok := s.tokens[key]; ok {
+		options.After = &token
+	}
+	return db.GetWithOptions(key, options)
+}
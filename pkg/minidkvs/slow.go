@@ -0,0 +1,116 @@
+package minidkvs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowOp describes an operation that took longer than Options.SlowOpThreshold.
+type SlowOp struct {
+	// Op is the operation, like "set" or "list", or for storage calls the
+	// names used in Stats.Storage.
+	Op string
+	// Key is the key the operation was for, or the prefix for storage key
+	// listings. Empty when there isn't a single key.
+	Key string
+	// Duration is how long the operation took. For database operations it
+	// includes waiting for the message loop.
+	Duration time.Duration
+	// Storage is true for calls to Storage and false for calls to the
+	// Database.
+	Storage bool
+}
+
+var dbMessageTypeNames = [...]string{
+	dbMessageTypeReceive: "receive",
+	dbMessageTypeSet:     "set",
+	dbMessageTypeGet:     "get",
+	dbMessageTypeDelete:  "delete",
+	dbMessageTypeClose:   "close",
+	dbMessageTypeRaw:     "get_raw",
+	dbMessageTypeAddPeer: "add_peer",
+	dbMessageTypeLetters: "dead_letters",
+	dbMessageTypeWatch:   "watch",
+	dbMessageTypeUnwatch: "unwatch",
+	dbMessageTypeDump:    "dump",
+	dbMessageTypeDelPre:  "delete_prefix",
+	dbMessageTypeCopy:    "copy",
+	dbMessageTypeNextID:  "next_id",
+	dbMessageTypeBatch:   "batch",
+	dbMessageTypeGetAt:   "get_at",
+	dbMessageTypeUndel:   "undelete",
+	dbMessageTypeTouch:   "touch",
+	dbMessageTypeStats:   "stats",
+	dbMessageTypeHealth:  "health",
+	dbMessageTypePause:   "pause",
+	dbMessageTypeFlush:   "flush",
+	dbMessageTypeDigests: "digests",
+	dbMessageTypeScan:    "scan",
+	dbMessageTypeList:    "list",
+	dbMessageTypeCount:   "count",
+	dbMessageTypeSweep:   "sweep",
+	dbMessageTypeMeta:    "get_meta",
+	dbMessageTypeSubtree: "replace_subtree",
+	dbMessageTypeUpdate:  "update",
+	dbMessageTypeTxn:     "txn",
+	dbMessageTypeReload:  "reload",
+	dbMessageTypeMaint:   "maintenance",
+}
+
+func (t dbMessageType) String() string {
+	if int(t) < len(dbMessageTypeNames) && dbMessageTypeNames[t] != "" {
+		return dbMessageTypeNames[t]
+	}
+	return "unknown"
+}
+
+// key returns the key msg is for, if it is a single-key operation.
+func (msg dbMessage) key() string {
+	switch msg.msgType {
+	case dbMessageTypeReceive:
+		return msg.receiveMsg.delta.Key
+	case dbMessageTypeSet:
+		return msg.setMsg.key
+	case dbMessageTypeGet:
+		return msg.getMsg.key
+	case dbMessageTypeDelete:
+		return msg.deleteMsg.key
+	case dbMessageTypeMeta:
+		return msg.metaMsg.key
+	case dbMessageTypeUpdate:
+		return msg.updateMsg.key
+	}
+	return ""
+}
+
+// slowCall reports msg to Options.OnSlowOp if it took longer than
+// Options.SlowOpThreshold. It runs in the caller's goroutine.
+func (d *Database) slowCall(msg dbMessage, start time.Time) {
+	if d.options.SlowOpThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed <= d.options.SlowOpThreshold {
+		return
+	}
+	atomic.AddInt64(&d.slowCalls, 1)
+	if d.options.OnSlowOp != nil {
+		d.options.OnSlowOp(SlowOp{Op: msg.msgType.String(), Key: msg.key(), Duration: elapsed})
+	}
+}
+
+// recordStorage adds a storage call to Stats.Storage and reports it if it was
+// slow. Only called from the message loop.
+func (d *Database) recordStorage(op, key string, start time.Time, bytes int, err error) {
+	stats := d.opStats(op)
+	stats.record(start, bytes, err)
+
+	elapsed := time.Since(start)
+	if d.options.SlowOpThreshold <= 0 || elapsed <= d.options.SlowOpThreshold {
+		return
+	}
+	stats.Slow++
+	if d.options.OnSlowOp != nil {
+		d.options.OnSlowOp(SlowOp{Op: op, Key: key, Duration: elapsed, Storage: true})
+	}
+}
@@ -0,0 +1,55 @@
+package minidkvs
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStorage takes delay over every Get.
+type slowStorage struct {
+	*MemoryStorage
+	delay time.Duration
+}
+
+func (s *slowStorage) Get(key string) (*Value, error) {
+	time.Sleep(s.delay)
+	return s.MemoryStorage.Get(key)
+}
+
+func TestSlowOps(t *testing.T) {
+	storage := &slowStorage{MemoryStorage: mustMemoryStorage(t), delay: 20 * time.Millisecond}
+	var mu sync.Mutex
+	var slow []SlowOp
+	db, err := NewDatabaseWithOptions(storage, Options{
+		SlowOpThreshold: 10 * time.Millisecond,
+		OnSlowOp: func(op SlowOp) {
+			mu.Lock()
+			defer mu.Unlock()
+			slow = append(slow, op)
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Get("k")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(slow) != 2 {
+		t.Fatalf("Expected a slow storage call and a slow database call but got %v", slow)
+	}
+	if slow[0] != (SlowOp{Op: "get", Key: "k", Duration: slow[0].Duration, Storage: true}) {
+		t.Errorf("Unexpected storage report %+v", slow[0])
+	}
+	if slow[1].Op != "get" || slow[1].Key != "k" || slow[1].Storage {
+		t.Errorf("Unexpected database report %+v", slow[1])
+	}
+
+	stats := db.Stats()
+	if stats.Storage["get"].Slow != 1 || stats.SlowCalls != 1 {
+		t.Error("Stats should count slow operations")
+	}
+}
@@ -0,0 +1,90 @@
+package minidkvs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrKeysUnsupported is returned by operations that need to enumerate keys when
+// the Storage doesn't implement KeyLister.
+var ErrKeysUnsupported = errors.New("minidkvs: storage cannot list keys")
+
+// tryDeltas wraps a list of deltas and includes error obj.
+type tryDeltas struct {
+	deltas []Delta
+	err    error
+}
+
+// dump reads every stored value under prefix, tombstones included. Only called
+// from the message loop.
+func (d *Database) dump(prefix string) ([]Delta, error) {
+	keys, err := d.storageKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make([]Delta, 0, len(keys))
+	for _, key := range keys {
+		value, err := d.storageGet(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			deltas = append(deltas, Delta{Key: key, Value: value})
+		}
+	}
+	return deltas, nil
+}
+
+// Snapshot writes every key, including tombstones and metadata, to w as JSON
+// lines of Delta. The snapshot is consistent: it is read in one go by the
+// message loop.
+func (d *Database) Snapshot(w io.Writer) error {
+	m := dbMessageDump{replyChan: make(chan tryDeltas, 1)}
+	try, err := call(d, newDumpMessage(&m), m.replyChan)
+	if err != nil {
+		return err
+	}
+	if try.err != nil {
+		return try.err
+	}
+	return writeSnapshot(w, try.deltas)
+}
+
+// writeSnapshot writes deltas in the format of Snapshot.
+func writeSnapshot(w io.Writer, deltas []Delta) error {
+	encoder := json.NewEncoder(w)
+	for i := range deltas {
+		if err := encoder.Encode(&deltas[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore merges a snapshot written by Snapshot into the database. Each entry
+// is applied like a delta from a peer, so newer local values are kept.
+func (d *Database) Restore(r io.Reader) error {
+	return restore(r, d.ReceiveRemote)
+}
+
+// restore decodes each delta of a snapshot and passes it to apply, stopping at
+// the first error.
+func restore(r io.Reader, apply func(delta *Delta) error) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var delta Delta
+		err := decoder.Decode(&delta)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := apply(&delta); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package minidkvs
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortedSet is a replicated leaderboard. Every node keeps its own share of each
+// member's score under prefix+member+"/"+nodeID, so nodes never overwrite each
+// other's additions and a member's score is the sum of the shares. Any two
+// nodes that have seen the same additions agree on every score and ranking,
+// whatever order the additions arrived in. Member and node ID are
+// path-escaped in the key, so either may contain "/".
+type SortedSet struct {
+	db     *Database
+	prefix string
+}
+
+// ScoredMember is one entry of a SortedSet.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// NewSortedSet is ctor for SortedSet.
+func NewSortedSet(db *Database, prefix string) *SortedSet {
+	return &SortedSet{db: db, prefix: prefix}
+}
+
+// AddScore adds delta, which may be negative, to member's score.
+func (s *SortedSet) AddScore(member string, delta float64) error {
+	key := s.memberPrefix(member) + url.PathEscape(string(s.db.NodeID()))
+	_, err := s.db.update(key, func(current []byte) ([]byte, error) {
+		share := 0.0
+		if current != nil {
+			var err error
+			if share, err = strconv.ParseFloat(string(current), 64); err != nil {
+				return nil, &CodecError{Key: key, Err: err}
+			}
+		}
+		return []byte(strconv.FormatFloat(share+delta, 'g', -1, 64)), nil
+	})
+	return err
+}
+
+// Score returns member's score, zero if it has none.
+func (s *SortedSet) Score(member string) (float64, error) {
+	members, err := s.scores(s.memberPrefix(member))
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if m.Member == member {
+			return m.Score, nil
+		}
+	}
+	return 0, nil
+}
+
+// Top returns the n highest scoring members, highest first. Ties are ordered
+// by member. It needs a KeyLister storage.
+func (s *SortedSet) Top(n int) ([]ScoredMember, error) {
+	members, err := s.scores(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score > members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+	if len(members) > n {
+		members = members[:n]
+	}
+	return members, nil
+}
+
+// memberPrefix is the prefix of every share of member's score.
+func (s *SortedSet) memberPrefix(member string) string {
+	return s.prefix + url.PathEscape(member) + "/"
+}
+
+// scores sums the shares under prefix into one entry per member, in member
+// order. Shares are added in key order so every node rounds the same way.
+func (s *SortedSet) scores(prefix string) ([]ScoredMember, error) {
+	deltas, err := s.db.dumpLive(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []ScoredMember{}
+	for _, delta := range deltas {
+		escaped, _, ok := strings.Cut(delta.Key[len(s.prefix):], "/")
+		if !ok {
+			continue
+		}
+		member, err := url.PathUnescape(escaped)
+		if err != nil {
+			return nil, &CodecError{Key: delta.Key, Err: err}
+		}
+		share, err := strconv.ParseFloat(string(delta.Value.Content), 64)
+		if err != nil {
+			return nil, &CodecError{Key: delta.Key, Err: err}
+		}
+		if len(members) == 0 || members[len(members)-1].Member != member {
+			members = append(members, ScoredMember{Member: member})
+		}
+		members[len(members)-1].Score += share
+	}
+	return members, nil
+}
@@ -0,0 +1,56 @@
+package minidkvs
+
+import "testing"
+
+func TestSortedSetMerges(t *testing.T) {
+	a, _ := NewMemoryDatabase()
+	defer a.Close()
+	b, _ := NewMemoryDatabase()
+	defer b.Close()
+
+	boardA, boardB := NewSortedSet(a, "board/"), NewSortedSet(b, "board/")
+	boardA.AddScore("ann", 10)
+	boardA.AddScore("ann", 5)
+	boardB.AddScore("ann", 1)
+	boardB.AddScore("bob", 20)
+	boardB.AddScore("cat/dog", 3)
+	boardA.AddScore("cat", -2)
+
+	syncAll(t, a, b)
+
+	for _, board := range []*SortedSet{boardA, boardB} {
+		top, err := board.Top(2)
+		if err != nil {
+			t.Fatal("Failed to read top")
+		}
+		if len(top) != 2 || top[0] != (ScoredMember{"bob", 20}) || top[1] != (ScoredMember{"ann", 16}) {
+			t.Errorf("Unexpected ranking %v", top)
+		}
+		if score, _ := board.Score("cat"); score != -2 {
+			t.Error("Score should not include members nested under it")
+		}
+		if score, _ := board.Score("cat/dog"); score != 3 {
+			t.Error("Members containing a slash should keep their score")
+		}
+	}
+}
+
+func TestSortedSetEscapesNodeID(t *testing.T) {
+	storage, err := NewMemoryStorageWithNodeID("rack/1")
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	db, err := NewDatabase(storage)
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	board := NewSortedSet(db, "board/")
+	board.AddScore("a/b", 2)
+	board.AddScore("a/b", 3)
+	top, err := board.Top(5)
+	if err != nil || len(top) != 1 || top[0] != (ScoredMember{"a/b", 5}) {
+		t.Errorf("Unexpected ranking %v", top)
+	}
+}
@@ -0,0 +1,62 @@
+package minidkvs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrLowSpace is returned for writes that carry content while storage has less
+// than Options.MinFreeSpace free. Deletes are still accepted.
+var ErrLowSpace = errors.New("minidkvs: storage is low on space")
+
+// spaceCheckInterval bounds how often StorageSpace is asked, since finding
+// free space usually means a system call.
+const spaceCheckInterval = time.Second
+
+// StorageSpace is an optional Storage extension for backends that can report
+// their disk usage.
+type StorageSpace interface {
+	// Space returns the bytes the storage uses and the bytes still free
+	// on the device it writes to.
+	Space() (used, free int64, err error)
+}
+
+// space is the last answer from StorageSpace.
+type space struct {
+	used, free int64
+	checked    time.Time
+}
+
+// currentSpace returns the storage's space, asking at most once per
+// spaceCheckInterval. ok is false when the storage can't say. Only called
+// from the message loop.
+func (d *Database) currentSpace() (space, bool) {
+	reporter, ok := d.storage.(StorageSpace)
+	if !ok {
+		return space{}, false
+	}
+	if time.Since(d.space.checked) < spaceCheckInterval {
+		return d.space, true
+	}
+
+	used, free, err := reporter.Space()
+	if err != nil {
+		// Keep the last answer rather than let writes through blind.
+		return d.space, !d.space.checked.IsZero()
+	}
+	d.space = space{used: used, free: free, checked: time.Now()}
+	return d.space, true
+}
+
+// checkSpace refuses a write of value when free space is below
+// Options.MinFreeSpace. Writes without content, like deletes and sweeps,
+// always pass since they are how space is recovered.
+func (d *Database) checkSpace(value *Value) error {
+	if d.options.MinFreeSpace <= 0 || len(value.Content) == 0 {
+		return nil
+	}
+	if s, ok := d.currentSpace(); ok && s.free < d.options.MinFreeSpace {
+		return ErrLowSpace
+	}
+	return nil
+}
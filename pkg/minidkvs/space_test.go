@@ -0,0 +1,42 @@
+package minidkvs
+
+import "testing"
+
+// fullStorage reports a fixed amount of free space.
+type fullStorage struct {
+	*MemoryStorage
+	free int64
+}
+
+func (f *fullStorage) Space() (int64, int64, error) {
+	return 1000, f.free, nil
+}
+
+func TestLowSpace(t *testing.T) {
+	storage := &fullStorage{MemoryStorage: mustMemoryStorage(t), free: 10}
+	db, err := NewDatabaseWithOptions(storage, Options{MinFreeSpace: 100})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	storage.Set("k", &Value{Version: 1, ModifiedBy: "other", ModifiedAt: 1, Content: []byte{1}})
+
+	if err := db.Set("new", []byte{1}); err != ErrLowSpace {
+		t.Error("Writes should be refused when space is low")
+	}
+	if err := db.ReceiveRemote(remoteDelta("remote", []byte{1}, 100)); err != ErrLowSpace {
+		t.Error("Replicated writes should be refused when space is low")
+	}
+	if res, err := db.Get("k"); err != nil || !res.HasValue {
+		t.Error("Reads should still work when space is low")
+	}
+	if err := db.Delete("k"); err != nil {
+		t.Error("Deletes should still work when space is low")
+	}
+
+	stats := db.Stats()
+	if stats.UsedBytes != 1000 || stats.FreeBytes != 10 {
+		t.Error("Stats should report storage space")
+	}
+}
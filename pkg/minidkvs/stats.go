@@ -0,0 +1,229 @@
+package minidkvs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// OpStats aggregates one kind of operation.
+type OpStats struct {
+	Count   int64
+	Errors  int64
+	Bytes   int64
+	Latency time.Duration
+	// Slow counts operations over Options.SlowOpThreshold.
+	Slow int64
+}
+
+// record adds one operation.
+func (s *OpStats) record(start time.Time, bytes int, err error) {
+	s.Count++
+	s.Bytes += int64(bytes)
+	s.Latency += time.Since(start)
+	if err != nil {
+		s.Errors++
+	}
+}
+
+// StorageMetrics is an optional Storage extension for backends that track
+// their own metrics, such as the remote calls behind a cache. They are
+// reported in Stats.Backend next to what the Database measured.
+type StorageMetrics interface {
+	Metrics() map[string]OpStats
+}
+
+// Stats is a point-in-time view of a Database's counters.
+type Stats struct {
+	// Storage is measured by the Database around every call it makes to
+	// Storage, keyed by operation ("get", "set", "set_batch", "keys"). It is
+	// the time spent in storage as opposed to queueing in the message loop.
+	Storage map[string]OpStats
+
+	// Backend is whatever the Storage reports about itself through
+	// StorageMetrics. Nil if it doesn't.
+	Backend map[string]OpStats
+
+	// StorageHealthy is false while the storage circuit breaker is open.
+	StorageHealthy bool
+
+	// InFlight is how many calls are waiting for or being handled by the
+	// message loop, including this one.
+	InFlight int64
+
+	// Peers is how many peers are registered, of which PausedPeers are
+	// paused. Rejected counts deltas from peers that failed validation.
+	Peers       int
+	PausedPeers int
+	Rejected    int64
+
+	// AuditFailures counts stored writes whose AuditLog entry couldn't be
+	// appended.
+	AuditFailures int64
+
+	// SlowCalls counts calls to the Database that took longer than
+	// Options.SlowOpThreshold, including time spent waiting for the
+	// message loop.
+	SlowCalls int64
+
+	// UsedBytes and FreeBytes are the storage's disk usage as reported
+	// through StorageSpace. Both are zero if it doesn't.
+	UsedBytes int64
+	FreeBytes int64
+}
+
+// Stats returns the current counters, or zero Stats if the database is closed
+// or has failed.
+func (d *Database) Stats() Stats {
+	m := dbMessageStats{replyChan: make(chan Stats, 1)}
+	return wait(d, newStatsMessage(&m), m.replyChan)
+}
+
+// stats builds a Stats. Only called from the message loop.
+func (d *Database) stats() Stats {
+	stats := Stats{
+		Storage:        make(map[string]OpStats),
+		StorageHealthy: !d.breaker.open,
+		InFlight:       atomic.LoadInt64(&d.inFlight),
+		Peers:          len(d.peers),
+		PausedPeers:    len(d.paused),
+		Rejected:       d.rejected,
+		AuditFailures:  d.auditFailures,
+		SlowCalls:      atomic.LoadInt64(&d.slowCalls),
+	}
+	for op, s := range d.storageStats {
+		stats.Storage[op] = *s
+	}
+	if metrics, ok := d.storage.(StorageMetrics); ok {
+		stats.Backend = metrics.Metrics()
+	}
+	if s, ok := d.currentSpace(); ok {
+		stats.UsedBytes, stats.FreeBytes = s.used, s.free
+	}
+	return stats
+}
+
+// opStats returns the counters for op, creating them if needed.
+func (d *Database) opStats(op string) *OpStats {
+	s, ok := d.storageStats[op]
+	if !ok {
+		s = &OpStats{}
+		d.storageStats[op] = s
+	}
+	return s
+}
+
+// storageGet is storage.Get with metrics.
+func (d *Database) storageGet(key string) (*Value, error) {
+	if value, ok := d.absent.get(key); ok {
+		return value, nil
+	}
+
+	var value *Value
+	start := time.Now()
+	err := d.guard(func() (err error) {
+		value, err = d.storage.Get(key)
+		return err
+	})
+	bytes := 0
+	if value != nil {
+		bytes = len(value.Content)
+	}
+	d.recordStorage("get", key, start, bytes, err)
+	if err == nil && (value == nil || value.Deleted) {
+		d.absent.put(key, value)
+	}
+	return value, err
+}
+
+// beforeWrite reads what key holds before it is overwritten, when digests or
+// open scans need it. Digests only need the header. The returned function is
+// called after the write succeeds.
+func (d *Database) beforeWrite(key string) (func(value *Value), error) {
+	if !d.digests.ready && len(d.scans) == 0 {
+		return func(*Value) {}, nil
+	}
+	get := d.storageGetMeta
+	if len(d.scans) > 0 {
+		get = d.storageGet
+	}
+	old, err := get(key)
+	if err != nil {
+		return nil, err
+	}
+	return func(value *Value) {
+		d.digestWrite(key, old, value)
+		d.preserve(key, old)
+	}, nil
+}
+
+// storageSet is storage.Set with metrics.
+func (d *Database) storageSet(key string, value *Value) error {
+	if err := d.checkSpace(value); err != nil {
+		return err
+	}
+	afterWrite, err := d.beforeWrite(key)
+	if err != nil {
+		return err
+	}
+
+	d.absent.forget(key)
+	start := time.Now()
+	err = d.guard(func() error { return d.storage.Set(key, value) })
+	d.recordStorage("set", key, start, len(value.Content), err)
+	if err == nil {
+		afterWrite(value)
+		d.noteExpiry(value)
+	}
+	return err
+}
+
+// storageSetBatch is BatchStorage.SetBatch with metrics. Only called when the
+// storage implements BatchStorage.
+func (d *Database) storageSetBatch(deltas []Delta) error {
+	for _, delta := range deltas {
+		if err := d.checkSpace(delta.Value); err != nil {
+			return err
+		}
+	}
+	updates := make([]func(*Value), len(deltas))
+	for i, delta := range deltas {
+		update, err := d.beforeWrite(delta.Key)
+		if err != nil {
+			return err
+		}
+		updates[i] = update
+		d.absent.forget(delta.Key)
+	}
+	start := time.Now()
+	err := d.guard(func() error { return d.storage.(BatchStorage).SetBatch(deltas) })
+	if err == nil {
+		for i, delta := range deltas {
+			updates[i](delta.Value)
+			d.noteExpiry(delta.Value)
+		}
+	}
+	bytes := 0
+	for _, delta := range deltas {
+		bytes += len(delta.Value.Content)
+	}
+	d.recordStorage("set_batch", "", start, bytes, err)
+	return err
+}
+
+// storageKeys is KeyLister.Keys with metrics. It returns ErrKeysUnsupported
+// when the storage can't list keys.
+func (d *Database) storageKeys(prefix string) ([]string, error) {
+	lister, ok := d.storage.(KeyLister)
+	if !ok {
+		return nil, ErrKeysUnsupported
+	}
+
+	var keys []string
+	start := time.Now()
+	err := d.guard(func() (err error) {
+		keys, err = lister.Keys(prefix)
+		return err
+	})
+	d.recordStorage("keys", prefix, start, 0, err)
+	return keys, err
+}
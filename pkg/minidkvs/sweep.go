@@ -0,0 +1,120 @@
+package minidkvs
+
+import "time"
+
+// sweepBatch is how many expired keys one trip through the message loop
+// sweeps, so that a backlog doesn't stall other operations.
+const sweepBatch = 256
+
+// sweepRetry is how long the sweeper waits after a failed sweep.
+const sweepRetry = time.Second
+
+// ExpiryIndex is an optional Storage extension that lets Options.SweepExpired
+// find expired values without scanning every key. Storage indexes each value
+// that has an ExpiresAt and non-empty Content, updating the index on every
+// Set, SetBatch and Delete.
+type ExpiryIndex interface {
+	// NextExpiry returns the earliest ExpiresAt in the index, or zero when
+	// it is empty.
+	NextExpiry() (int64, error)
+	// ExpiredKeys returns up to limit indexed keys whose ExpiresAt is at or
+	// before the unix time now.
+	ExpiredKeys(now int64, limit int) ([]string, error)
+}
+
+type dbMessageSweep struct {
+	replyChan chan trySweep
+}
+
+type trySweep struct {
+	next int64
+	err  error
+}
+
+// sweeper runs sweeps until the database closes, sleeping until the next
+// value is due. Writes that expire sooner wake it through sweepWake.
+func (d *Database) sweeper() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.stopped:
+			return
+		case <-d.sweepWake:
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+		case <-timer.C:
+		}
+
+		m := dbMessageSweep{replyChan: make(chan trySweep, 1)}
+		try, err := call(d, newSweepMessage(&m), m.replyChan)
+		if err == nil {
+			err = try.err
+		}
+
+		switch {
+		case err != nil:
+			timer.Reset(sweepRetry)
+		case try.next == 0:
+			// Nothing expires until a write says otherwise.
+			timer.Reset(time.Duration(1<<63 - 1))
+		default:
+			timer.Reset(time.Until(time.Unix(try.next, 0)))
+		}
+	}
+}
+
+// sweep drops the content of up to sweepBatch expired values and returns when
+// the next one is due. The rest of the value is kept so that the expired write
+// still wins over older ones and digests don't change. Only called from the
+// message loop.
+func (d *Database) sweep() (int64, error) {
+	index := d.storage.(ExpiryIndex)
+	now := time.Now().Unix()
+
+	keys, err := index.ExpiredKeys(now, sweepBatch)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		value, err := d.storageGet(key)
+		if err != nil {
+			return 0, err
+		}
+		if value == nil || !value.Expired(now) || len(value.Content) == 0 {
+			continue
+		}
+		swept := *value
+		swept.Content = nil
+		if err := d.storageSet(key, &swept); err != nil {
+			return 0, err
+		}
+	}
+	if len(keys) == sweepBatch {
+		d.nextSweep = now
+		return now, nil
+	}
+
+	d.nextSweep, err = index.NextExpiry()
+	return d.nextSweep, err
+}
+
+// noteExpiry wakes the sweeper when value expires before its next sweep. Only
+// called from the message loop.
+func (d *Database) noteExpiry(value *Value) {
+	if d.sweepWake == nil || value.ExpiresAt == 0 || len(value.Content) == 0 {
+		return
+	}
+	if d.nextSweep != 0 && d.nextSweep <= value.ExpiresAt {
+		return
+	}
+	d.nextSweep = value.ExpiresAt
+	select {
+	case d.sweepWake <- struct{}{}:
+	default:
+	}
+}
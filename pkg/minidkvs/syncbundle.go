@@ -0,0 +1,120 @@
+package minidkvs
+
+import (
+	"errors"
+	"io"
+)
+
+// SyncBundleBuckets is how many buckets a SyncState divides the keyspace
+// into. It is fixed so that any two nodes can compare states.
+const SyncBundleBuckets = 1024
+
+// SyncState summarizes what a node holds for WriteSyncBundle, as the digest of
+// each of SyncBundleBuckets buckets of the keyspace. It is small and
+// JSON-encodable, so a node that can't reach its peers can carry it to them
+// as a file.
+type SyncState struct {
+	Node    NodeID
+	Digests []uint64
+}
+
+// SyncState returns this node's SyncState. It reads every key, which needs a
+// KeyLister storage. Keys Options.ReplicateFilter keeps local are left out.
+func (d *Database) SyncState() (SyncState, error) {
+	deltas, err := d.dumpReplicated("")
+	if err != nil {
+		return SyncState{}, err
+	}
+
+	return SyncState{Node: d.nodeID, Digests: d.syncDigests(deltas)}, nil
+}
+
+// WriteSyncBundle writes to w, in the format of Snapshot, every value the node
+// described by since may be missing: everything in a bucket whose digest
+// differs from this node's. A zero SyncState gets everything. Like
+// replication, the bundle leaves out keys Options.ReplicateFilter keeps local
+// and keys pinned away from the node described by since. The receiving node
+// applies it with ApplySyncBundle, which keeps whichever of two versions wins
+// as if they had replicated, so bundles can be exchanged in both directions
+// and applied more than once. It returns how many values were written.
+func (d *Database) WriteSyncBundle(since SyncState, w io.Writer) (int, error) {
+	deltas, err := d.dumpReplicated(since.Node)
+	if err != nil {
+		return 0, err
+	}
+
+	digests := d.syncDigests(deltas)
+	bundle := []Delta{}
+	for _, delta := range deltas {
+		if !delta.pinned {
+			continue
+		}
+		b := d.bucket(delta.Key, SyncBundleBuckets)
+		if len(since.Digests) != SyncBundleBuckets || since.Digests[b] != digests[b] {
+			bundle = append(bundle, delta.Delta)
+		}
+	}
+	return len(bundle), writeSnapshot(w, bundle)
+}
+
+// ApplySyncBundle applies a bundle written by WriteSyncBundle the way Restore
+// applies a snapshot, except that a value this node rejects, such as one
+// pinned to other nodes, is skipped instead of stopping the rest of the
+// bundle. It returns the keys it skipped.
+func (d *Database) ApplySyncBundle(r io.Reader) ([]string, error) {
+	skipped := []string{}
+	err := restore(r, func(delta *Delta) error {
+		err := d.ReceiveRemote(delta)
+		if errors.Is(err, ErrDeltaRejected) {
+			skipped = append(skipped, delta.Key)
+			return nil
+		}
+		return err
+	})
+	return skipped, err
+}
+
+// syncDelta is a stored value that replicates, and whether it may be held by
+// the node a bundle is for.
+type syncDelta struct {
+	Delta
+	pinned bool
+}
+
+// syncDigests hashes deltas into SyncBundleBuckets digests the same way as
+// Digests.
+func (d *Database) syncDigests(deltas []syncDelta) []uint64 {
+	digests := make([]uint64, SyncBundleBuckets)
+	for _, delta := range deltas {
+		digests[d.bucket(delta.Key, SyncBundleBuckets)] ^= d.entryHash(delta.Key, delta.Value)
+	}
+	return digests
+}
+
+// dumpReplicated reads every stored value that replicates, tombstones
+// included, in one go, noting which of them node may hold under Pins. Keys
+// pinned away from node still count towards the digests, since both nodes'
+// states must be computed the same way to be compared.
+func (d *Database) dumpReplicated(node NodeID) ([]syncDelta, error) {
+	pinned := map[string]bool{}
+	m := dbMessageDump{
+		filter: func(key string, value *Value) bool {
+			pinned[key] = d.pinnedTo(key, node)
+			return d.replicates(key, value)
+		},
+		replyChan: make(chan tryDeltas, 1),
+	}
+	try, err := call(d, newDumpMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make([]syncDelta, len(try.deltas))
+	for i, delta := range try.deltas {
+		deltas[i] = syncDelta{Delta: delta, pinned: pinned[delta.Key]}
+	}
+	return deltas, nil
+}
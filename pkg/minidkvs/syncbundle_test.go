@@ -0,0 +1,108 @@
+package minidkvs
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSyncBundles(t *testing.T) {
+	a, _ := NewMemoryDatabase()
+	defer a.Close()
+	b, _ := NewMemoryDatabase()
+	defer b.Close()
+
+	for i := 0; i < 100; i++ {
+		a.Set(fmt.Sprintf("shared/%d", i), []byte{byte(i)})
+	}
+	syncAll(t, a, b)
+	a.Set("from-a", []byte("a"))
+	b.Set("from-b", []byte("b"))
+	b.Delete("shared/1")
+
+	// b carries its state to a and comes back with a's bundle, and the
+	// other way around.
+	stateB, err := b.SyncState()
+	if err != nil {
+		t.Fatal("Failed to read sync state")
+	}
+	var toB bytes.Buffer
+	count, err := a.WriteSyncBundle(stateB, &toB)
+	if err != nil || count == 0 || count > 10 {
+		t.Fatalf("Expected a small bundle of differing buckets but got %d, %v", count, err)
+	}
+	stateA, _ := a.SyncState()
+	var toA bytes.Buffer
+	b.WriteSyncBundle(stateA, &toA)
+	if _, err := b.ApplySyncBundle(&toB); err != nil {
+		t.Fatal("Failed to apply bundle")
+	}
+	if _, err := a.ApplySyncBundle(&toA); err != nil {
+		t.Fatal("Failed to apply bundles")
+	}
+
+	for _, db := range []*Database{a, b} {
+		if res, _ := db.Get("from-a"); string(res.Value) != "a" {
+			t.Error("Expected a's write on both nodes")
+		}
+		if res, _ := db.Get("from-b"); string(res.Value) != "b" {
+			t.Error("Expected b's write on both nodes")
+		}
+		if res, _ := db.Get("shared/1"); res.HasValue {
+			t.Error("Expected the delete on both nodes")
+		}
+	}
+
+	stateA, _ = a.SyncState()
+	stateB, _ = b.SyncState()
+	var empty bytes.Buffer
+	if count, _ := a.WriteSyncBundle(stateB, &empty); count != 0 || !reflect.DeepEqual(stateA.Digests, stateB.Digests) {
+		t.Error("Nodes should agree once bundles are applied")
+	}
+}
+
+func TestSyncBundleRespectsPinsAndFilter(t *testing.T) {
+	pins := map[string][]NodeID{"eu/": {"a"}}
+	local := func(key string, value *Value) bool { return !value.HasTag("local") }
+	storage, err := NewMemoryStorageWithNodeID("a")
+	if err != nil {
+		t.Fatal("Failed to create storage")
+	}
+	a, err := NewDatabaseWithOptions(storage, Options{Pins: pins, ReplicateFilter: local})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer a.Close()
+	b, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{Pins: pins})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer b.Close()
+
+	a.Set("eu/x", []byte("pinned"))
+	a.SetWithOptions("secret", []byte("local"), WriteOptions{Tags: []string{"local"}})
+	a.Set("shared", []byte("s"))
+
+	state, _ := b.SyncState()
+	var bundle bytes.Buffer
+	if count, err := a.WriteSyncBundle(state, &bundle); err != nil || count != 1 {
+		t.Fatalf("Bundle should only hold the shared key, got %d, %v", count, err)
+	}
+
+	// A bundle from a node without the pins still applies everything b may
+	// hold.
+	c, _ := NewMemoryDatabase()
+	defer c.Close()
+	c.Set("eu/y", []byte("pinned"))
+	c.Set("other", []byte("o"))
+	bundle.Reset()
+	c.WriteSyncBundle(SyncState{}, &bundle)
+	skipped, err := b.ApplySyncBundle(&bundle)
+	if err != nil || !reflect.DeepEqual(skipped, []string{"eu/y"}) {
+		t.Errorf("Expected only the pinned key to be skipped, got %v, %v", skipped, err)
+	}
+	if res, _ := b.Get("other"); string(res.Value) != "o" {
+		t.Error("Keys after a rejected one should still be applied")
+	}
+}
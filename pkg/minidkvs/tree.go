@@ -0,0 +1,146 @@
+package minidkvs
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// TreeSeparator separates the levels of hierarchical keys like "a/b/c".
+const TreeSeparator = "/"
+
+type dbMessageReplaceSubtree struct {
+	prefix    string
+	values    map[string][]byte
+	errorChan chan error
+}
+
+// treePrefix is the key prefix of everything below path. The empty path is
+// the root.
+func treePrefix(path string) string {
+	if path == "" || strings.HasSuffix(path, TreeSeparator) {
+		return path
+	}
+	return path + TreeSeparator
+}
+
+// ListChildren returns the names of the levels directly below path, sorted
+// and each once, whether they hold a value or only have keys further down.
+// Only live keys count. It needs a KeyLister storage.
+func (d *Database) ListChildren(path string) ([]string, error) {
+	prefix := treePrefix(path)
+	deltas, err := d.dumpLive(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	children := []string{}
+	for _, delta := range deltas {
+		child := strings.TrimPrefix(delta.Key, prefix)
+		if i := strings.Index(child, TreeSeparator); i >= 0 {
+			child = child[:i]
+		}
+		if len(children) == 0 || children[len(children)-1] != child {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+// SubtreeSnapshot returns the content of every live key below path, keyed by
+// the rest of the key after path and its separator. It is read in one step of
+// the message loop, so it is consistent. It needs a KeyLister storage.
+func (d *Database) SubtreeSnapshot(path string) (map[string][]byte, error) {
+	prefix := treePrefix(path)
+	deltas, err := d.dumpLive(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(deltas))
+	for _, delta := range deltas {
+		values[strings.TrimPrefix(delta.Key, prefix)] = delta.Value.Content
+	}
+	return values, nil
+}
+
+// ReplaceSubtree makes values, keyed as SubtreeSnapshot returns them, the
+// whole of the subtree below path, in one step of the message loop. Keys not
+// in values are deleted and keys whose content is unchanged are left alone.
+// Watchers see the writes as one Change.Group. On a storage error nothing is
+// changed. It needs a KeyLister storage.
+func (d *Database) ReplaceSubtree(path string, values map[string][]byte) error {
+	m := dbMessageReplaceSubtree{prefix: treePrefix(path), values: values, errorChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newReplaceSubtreeMessage(&m), m.errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// dumpLive is Snapshot's dump without tombstones and expired values.
+func (d *Database) dumpLive(prefix string) ([]Delta, error) {
+	m := dbMessageDump{prefix: prefix, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(d, newDumpMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	live := try.deltas[:0]
+	for _, delta := range try.deltas {
+		if isLive(delta.Value) {
+			live = append(live, delta)
+		}
+	}
+	return live, nil
+}
+
+// replaceSubtree does the work of ReplaceSubtree. Only called from the message
+// loop.
+func (d *Database) replaceSubtree(prefix string, values map[string][]byte) error {
+	deltas, err := d.dump(prefix)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*Value, len(deltas))
+	for _, delta := range deltas {
+		existing[delta.Key] = delta.Value
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Check every write before making any, so a bad value doesn't leave
+	// the subtree half replaced.
+	changes := []Change{}
+	group := uuid.New().String()
+	for _, key := range keys {
+		full := prefix + key
+		old := existing[full]
+		delete(existing, full)
+		if isLive(old) && bytes.Equal(old.Content, values[key]) {
+			continue
+		}
+		value, err := d.prepareLocal(old, values[key], WriteOptions{})
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Key: full, Value: value, Group: group})
+	}
+	for _, delta := range deltas {
+		if old, ok := existing[delta.Key]; ok && isLive(old) {
+			tombstone := d.newValueFrom(old, nil, true)
+			changes = append(changes, Change{Key: delta.Key, Value: tombstone, Group: group})
+		}
+	}
+
+	return d.storeChanges(changes)
+}
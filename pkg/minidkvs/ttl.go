@@ -0,0 +1,64 @@
+package minidkvs
+
+import "time"
+
+// NoExpiry is what TTL returns for a key that never expires.
+const NoExpiry time.Duration = -1
+
+// expiresAt turns a TTL into the unix time it runs out, rounding up to whole
+// seconds. A zero TTL never expires.
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return time.Now().Unix() + seconds
+}
+
+// TTL returns how long key has left before it expires, or NoExpiry. It returns
+// ErrKeyNotFound when the key is missing, deleted or already expired.
+func (d *Database) TTL(key string) (time.Duration, error) {
+	value, err := d.getRaw(key, true)
+	if err != nil {
+		return 0, err
+	}
+	if !isLive(value) {
+		return 0, ErrKeyNotFound
+	}
+	if value.ExpiresAt == 0 {
+		return NoExpiry, nil
+	}
+	return time.Until(time.Unix(value.ExpiresAt, 0)), nil
+}
+
+// Touch gives key a new TTL counted from now without changing its content.
+// A zero ttl removes the expiry. It is a new write, so it replicates. It
+// returns ErrKeyNotFound when the key is missing, deleted or already expired.
+func (d *Database) Touch(key string, ttl time.Duration) error {
+	m := dbMessageTouch{key: key, ttl: ttl, errorChan: make(chan error, 1)}
+	err, timeoutErr := call(d, newTouchMessage(&m), m.errorChan)
+	if timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// touch does the work of Touch. Only called from the message loop.
+func (d *Database) touch(key string, ttl time.Duration) error {
+	current, err := d.storageGet(key)
+	if err != nil {
+		return err
+	}
+	if !isLive(current) {
+		return ErrKeyNotFound
+	}
+
+	value, err := d.newValue(key, current.Content, false)
+	if err != nil {
+		return err
+	}
+	value.Tags = current.Tags
+	value.Extensions = current.Extensions
+	value.ExpiresAt = expiresAt(ttl)
+	return d.store(key, value, false)
+}
@@ -0,0 +1,91 @@
+package minidkvs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLAndTouch(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if _, err := db.TTL("missing"); err != ErrKeyNotFound {
+		t.Error("TTL of a missing key should fail")
+	}
+
+	db.Set("forever", []byte{1})
+	if ttl, err := db.TTL("forever"); err != nil || ttl != NoExpiry {
+		t.Error("Key without TTL should report NoExpiry")
+	}
+
+	db.SetWithOptions("session", []byte{1}, WriteOptions{TTL: time.Hour})
+	ttl, err := db.TTL("session")
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Error("TTL should be about an hour")
+	}
+
+	if err := db.Touch("session", 2*time.Hour); err != nil {
+		t.Error("Failed to touch")
+	}
+	if ttl, _ := db.TTL("session"); ttl <= time.Hour {
+		t.Error("Touch should extend the TTL")
+	}
+	if res, _ := db.Get("session"); !res.HasValue || res.Value[0] != 1 {
+		t.Error("Touch should keep the content")
+	}
+
+	if err := db.Touch("session", 0); err != nil {
+		t.Error("Failed to touch")
+	}
+	if ttl, _ := db.TTL("session"); ttl != NoExpiry {
+		t.Error("Touch with zero should remove the expiry")
+	}
+
+	expired := remoteDelta("expired", []byte{1}, time.Now().Unix()-10)
+	expired.Value.ExpiresAt = time.Now().Unix() - 1
+	db.ReceiveRemote(expired)
+	if res, _ := db.Get("expired"); res.HasValue {
+		t.Error("Expired value should read as missing")
+	}
+	if err := db.Touch("expired", time.Hour); err != ErrKeyNotFound {
+		t.Error("Touching an expired key should fail")
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	storage := mustMemoryStorage(t)
+	db, err := NewDatabaseWithOptions(storage, Options{SweepExpired: true})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.SetWithOptions("later", []byte{1}, WriteOptions{TTL: time.Hour})
+
+	// Already expired on arrival, so it should wake the sweeper early.
+	delta := remoteDelta("gone", []byte{1, 2, 3}, time.Now().Unix())
+	delta.Value.ExpiresAt = time.Now().Unix()
+	if err := db.ReceiveRemote(delta); err != nil {
+		t.Fatal("Failed to receive delta")
+	}
+
+	swept := func() bool {
+		value, _ := db.GetRemote("gone")
+		return value != nil && value.Content == nil
+	}
+	if !waitFor(swept) {
+		t.Fatal("Expired content should be swept")
+	}
+	if value, _ := db.GetRemote("gone"); value.ModifiedAt != delta.Value.ModifiedAt {
+		t.Error("Sweeping should keep the value's metadata")
+	}
+	if value, _ := db.GetRemote("later"); value == nil || value.Content == nil {
+		t.Error("Live value should not be swept")
+	}
+	if next, _ := storage.NextExpiry(); next == 0 {
+		t.Error("Live value should stay in the expiry index")
+	}
+}
@@ -0,0 +1,215 @@
+package minidkvs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrBadCompare is returned by Txn.Commit for a comparison it doesn't
+// understand.
+var ErrBadCompare = errors.New("minidkvs: invalid transaction comparison")
+
+// Cmp is one condition of a transaction, made by CompareVersion or
+// CompareValue.
+type Cmp struct {
+	key     string
+	op      string
+	byValue bool
+	version int
+	value   []byte
+}
+
+// CompareVersion compares key's stored version with version using op, one of
+// "=", "!=", "<" or ">". A missing key has version 0.
+func CompareVersion(key, op string, version int) Cmp {
+	return Cmp{key: key, op: op, version: version}
+}
+
+// CompareValue compares key's content with value using "=" or "!=". A missing,
+// deleted or expired key has nil content.
+func CompareValue(key, op string, value []byte) Cmp {
+	return Cmp{key: key, op: op, byValue: true, value: value}
+}
+
+// TxnOp is one operation of a transaction, made by OpPut, OpDelete or OpGet.
+type TxnOp struct {
+	key    string
+	value  []byte
+	delete bool
+	get    bool
+}
+
+// OpPut sets key to value.
+func OpPut(key string, value []byte) TxnOp {
+	return TxnOp{key: key, value: value}
+}
+
+// OpDelete deletes key.
+func OpDelete(key string) TxnOp {
+	return TxnOp{key: key, delete: true}
+}
+
+// OpGet reads key, seeing writes made earlier in the same branch.
+func OpGet(key string) TxnOp {
+	return TxnOp{key: key, get: true}
+}
+
+// Txn is a conditional multi-key transaction: if every comparison holds the
+// Then operations run, otherwise the Else operations do. The comparisons and
+// the chosen branch run in one step of the message loop, so nothing else on
+// this node happens in between. Like every write, what the branch writes
+// replicates with last-writer-wins, so this is compare-and-set per node rather
+// than across the cluster.
+type Txn struct {
+	db    *Database
+	cmps  []Cmp
+	then  []TxnOp
+	other []TxnOp
+}
+
+// TxnResponse is the outcome of a Txn.
+type TxnResponse struct {
+	// Succeeded is true when the comparisons held and Then ran.
+	Succeeded bool
+	// Gets holds the result of each OpGet in the branch that ran, in order.
+	Gets []GetResult
+}
+
+type dbMessageTxn struct {
+	txn       *Txn
+	replyChan chan tryTxn
+}
+
+type tryTxn struct {
+	response TxnResponse
+	err      error
+}
+
+// Txn starts a transaction.
+func (d *Database) Txn() *Txn {
+	return &Txn{db: d}
+}
+
+// If adds comparisons, all of which must hold for Then to run.
+func (t *Txn) If(cmps ...Cmp) *Txn {
+	t.cmps = append(t.cmps, cmps...)
+	return t
+}
+
+// Then adds operations to run when the comparisons hold.
+func (t *Txn) Then(ops ...TxnOp) *Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+// Else adds operations to run when a comparison fails.
+func (t *Txn) Else(ops ...TxnOp) *Txn {
+	t.other = append(t.other, ops...)
+	return t
+}
+
+// Commit runs the transaction. Watchers see its writes as one Change.Group.
+// Either every write in the branch is made or, on an error, none of them.
+func (t *Txn) Commit() (TxnResponse, error) {
+	m := dbMessageTxn{txn: t, replyChan: make(chan tryTxn, 1)}
+	try, err := call(t.db, newTxnMessage(&m), m.replyChan)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	return try.response, try.err
+}
+
+// txn does the work of Txn.Commit. Only called from the message loop.
+func (d *Database) txn(t *Txn) (TxnResponse, error) {
+	succeeded := true
+	for _, cmp := range t.cmps {
+		ok, err := d.compare(cmp)
+		if err != nil {
+			return TxnResponse{}, err
+		}
+		if !ok {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := t.then
+	if !succeeded {
+		ops = t.other
+	}
+	// Every write is prepared before any is made, with staged standing in
+	// for storage so later ops see the ones before them.
+	response := TxnResponse{Succeeded: succeeded}
+	group := uuid.New().String()
+	staged := make(map[string]*Value)
+	changes := []Change{}
+	for _, op := range ops {
+		existing, ok := staged[op.key]
+		if !ok {
+			var err error
+			if existing, err = d.storageGet(op.key); err != nil {
+				return TxnResponse{}, err
+			}
+		}
+
+		var value *Value
+		switch {
+		case op.get:
+			response.Gets = append(response.Gets, newGetResult(existing))
+			continue
+		case op.delete:
+			value = d.newValueFrom(existing, nil, true)
+		default:
+			var err error
+			if value, err = d.prepareLocal(existing, op.value, WriteOptions{}); err != nil {
+				return TxnResponse{}, err
+			}
+		}
+		staged[op.key] = value
+		changes = append(changes, Change{Key: op.key, Value: value, Group: group})
+	}
+	if len(changes) == 0 {
+		return response, nil
+	}
+	if err := d.storeChanges(changes); err != nil {
+		return TxnResponse{}, err
+	}
+	return response, nil
+}
+
+// compare evaluates one Cmp. Only called from the message loop.
+func (d *Database) compare(cmp Cmp) (bool, error) {
+	value, err := d.storageGet(cmp.key)
+	if err != nil {
+		return false, err
+	}
+
+	if cmp.byValue {
+		var content []byte
+		if isLive(value) {
+			content = value.Content
+		}
+		switch cmp.op {
+		case "=":
+			return bytes.Equal(content, cmp.value), nil
+		case "!=":
+			return !bytes.Equal(content, cmp.value), nil
+		}
+	} else {
+		version := versionOf(value)
+		switch cmp.op {
+		case "=":
+			return version == cmp.version, nil
+		case "!=":
+			return version != cmp.version, nil
+		case "<":
+			return version < cmp.version, nil
+		case ">":
+			return version > cmp.version, nil
+		}
+	}
+	return false, fmt.Errorf("%w: %q", ErrBadCompare, cmp.op)
+}
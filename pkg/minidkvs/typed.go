@@ -0,0 +1,96 @@
+package minidkvs
+
+import "sync"
+
+// TypedStore is a view of a Database where every value is a T, encoded with a
+// Codec.
+type TypedStore[T any] struct {
+	db    *Database
+	codec Codec
+}
+
+// NewTyped is ctor for TypedStore.
+func NewTyped[T any](db *Database, codec Codec) *TypedStore[T] {
+	return &TypedStore[T]{db: db, codec: codec}
+}
+
+// TypedChange is Change with the value decoded. Value is the zero T when
+// Deleted is set or when decoding failed, in which case Err says why.
+type TypedChange[T any] struct {
+	Key     string
+	Value   T
+	Deleted bool
+	Remote  bool
+	Err     error
+}
+
+// TypedWatcher is Watcher with decoded values.
+type TypedWatcher[T any] struct {
+	Changes <-chan TypedChange[T]
+
+	watcher   *Watcher
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Get decodes the value under key. A missing key returns the zero T and false.
+func (s *TypedStore[T]) Get(key string) (T, bool, error) {
+	var v T
+	found, err := s.db.GetWithCodec(key, &v, s.codec)
+	return v, found, err
+}
+
+// Set encodes v and upserts it under key.
+func (s *TypedStore[T]) Set(key string, v T) error {
+	return s.db.SetWithCodec(key, v, s.codec)
+}
+
+// Watch subscribes to decoded changes of every key starting with prefix.
+func (s *TypedStore[T]) Watch(prefix string) (*TypedWatcher[T], error) {
+	watcher, err := s.db.Watch(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan TypedChange[T])
+	w := &TypedWatcher[T]{
+		Changes: out,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(out)
+		for change := range w.watcher.Changes {
+			select {
+			case out <- s.decode(change):
+			case <-w.done:
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// Close unsubscribes the watcher and closes its Changes channel. Calling it
+// again does nothing.
+func (w *TypedWatcher[T]) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.watcher.Close()
+	})
+}
+
+func (s *TypedStore[T]) decode(change Change) TypedChange[T] {
+	typed := TypedChange[T]{
+		Key:     change.Key,
+		Deleted: change.Value.Deleted,
+		Remote:  change.Remote,
+	}
+	if !typed.Deleted {
+		if err := s.codec.Unmarshal(change.Value.Content, &typed.Value); err != nil {
+			typed.Err = &CodecError{Key: change.Key, Err: err}
+		}
+	}
+	return typed
+}
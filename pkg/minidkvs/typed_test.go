@@ -0,0 +1,49 @@
+package minidkvs
+
+import "testing"
+
+type point struct {
+	X, Y int
+}
+
+func TestTypedStore(t *testing.T) {
+	db, err := NewMemoryDatabase()
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	points := NewTyped[point](db, JSONCodec)
+	w, err := points.Watch("p/")
+	if err != nil {
+		t.Fatal("Failed to watch")
+	}
+	defer w.Close()
+
+	if _, found, err := points.Get("p/1"); found || err != nil {
+		t.Error("Missing key should not be found")
+	}
+
+	if err := points.Set("p/1", point{X: 1, Y: 2}); err != nil {
+		t.Error("Failed to set typed value")
+	}
+
+	p, found, err := points.Get("p/1")
+	if err != nil || !found || p.X != 1 || p.Y != 2 {
+		t.Error("Typed value read back wrong")
+	}
+
+	change := <-w.Changes
+	if change.Err != nil || change.Value.X != 1 {
+		t.Error("Typed watch delivered wrong value")
+	}
+
+	db.Set("p/bad", []byte("nope"))
+	change = <-w.Changes
+	if change.Err == nil {
+		t.Error("Undecodable value should give an error")
+	}
+
+	// The deferred Close makes this a second call, which must not panic.
+	w.Close()
+}
@@ -0,0 +1,46 @@
+package minidkvs
+
+type dbMessageUpdate struct {
+	key       string
+	fn        func(current []byte) ([]byte, error)
+	replyChan chan tryValue
+}
+
+// update replaces key's content with fn of its current content, in one step of
+// the message loop so that concurrent updates on this node don't lose each
+// other's changes. fn gets nil for a missing, deleted or expired key. It runs
+// in the message loop so must not call the Database.
+func (d *Database) update(key string, fn func(current []byte) ([]byte, error)) (*Value, error) {
+	m := dbMessageUpdate{key: key, fn: fn, replyChan: make(chan tryValue, 1)}
+	try, err := call(d, newUpdateMessage(&m), m.replyChan)
+	if err != nil {
+		return nil, err
+	}
+	return try.value, try.err
+}
+
+// updateLocal does the work of update. Only called from the message loop.
+func (d *Database) updateLocal(key string, fn func(current []byte) ([]byte, error)) (*Value, error) {
+	existing, err := d.storageGet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var current []byte
+	if isLive(existing) {
+		current = existing.Content
+	}
+	content, err := fn(current)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := d.prepareLocal(existing, content, WriteOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.storeChange(Change{Key: key, Value: value}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
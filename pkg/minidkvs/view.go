@@ -0,0 +1,55 @@
+package minidkvs
+
+// ReadTxn reads keys as they all were at one moment. It is only valid inside
+// the function passed to View.
+type ReadTxn struct {
+	db   *Database
+	scan *scanState
+}
+
+// View calls fn with a ReadTxn that sees every key as it was when View was
+// called, so values assembled from several keys are never torn by concurrent
+// writes or an Import. Writers are not blocked: while fn runs,
+// each write first saves the value it replaces for the transaction, which
+// costs a storage read per write. View returns fn's error.
+func (d *Database) View(fn func(tx *ReadTxn) error) error {
+	scan := &scanState{everything: true, preimages: make(map[string]*Value)}
+	m := dbMessageScan{op: scanOpen, scan: scan, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(d, newScanMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		m := dbMessageScan{op: scanClose, scan: scan, replyChan: make(chan tryDeltas, 1)}
+		call(d, newScanMessage(&m), m.replyChan)
+	}()
+	return fn(&ReadTxn{db: d, scan: scan})
+}
+
+// Get reads key as of the start of the transaction. Like local reads it
+// doesn't consult peers.
+func (tx *ReadTxn) Get(key string) (GetResult, error) {
+	value, err := tx.GetRemote(key)
+	if err != nil {
+		return GetResult{}, err
+	}
+	return newGetResult(value), nil
+}
+
+// GetRemote is Get returning the stored value with its metadata, including
+// tombstones.
+func (tx *ReadTxn) GetRemote(key string) (*Value, error) {
+	m := dbMessageScan{op: scanGet, scan: tx.scan, key: key, replyChan: make(chan tryDeltas, 1)}
+	try, err := call(tx.db, newScanMessage(&m), m.replyChan)
+	if err == nil {
+		err = try.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return try.deltas[0].Value, nil
+}
@@ -0,0 +1,204 @@
+package minidkvs
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// ErrUnknownWatchFilter is returned when WatchOptions names a filter that
+// isn't in Options.WatchFilters.
+var ErrUnknownWatchFilter = errors.New("minidkvs: unknown watch filter")
+
+// WatchOptions narrows down which changes a Watcher receives. Every condition
+// is checked in the message loop, so filtered changes cost the watcher
+// nothing.
+type WatchOptions struct {
+	// Pattern is a path.Match glob the key must match, e.g. "user/*/name".
+	Pattern string
+
+	// Filter names a predicate registered in Options.WatchFilters.
+	Filter string
+
+	// RemoteOnly skips changes written on this node.
+	RemoteOnly bool
+}
+
+// Change describes a key being written, deleted or replicated. Value is the
+// stored Value, so deletes arrive with Value.Deleted set.
+type Change struct {
+	Key    string
+	Value  *Value
+	Remote bool
+
+	// Group is shared by every change made by one multi-key operation, such
+	// as DeletePrefix, and empty otherwise.
+	Group string
+
+	// Actor is Value.Actor of the write, if it had one.
+	Actor string
+}
+
+// Token returns the ordering token of the write behind the change.
+func (c Change) Token() CausalToken {
+	return newCausalToken(c.Value)
+}
+
+// Watcher delivers changes to keys under a prefix. Changes are queued rather
+// than dropped when the reader falls behind, so Changes must be drained or the
+// Watcher closed. A Watcher sees changes to a key in the order they were
+// applied locally, which is always the order their tokens supersede each
+// other.
+type Watcher struct {
+	Changes <-chan Change
+
+	db      *Database
+	id      int
+	prefix  string
+	options WatchOptions
+	filter  func(Change) bool
+	in      chan Change
+	out     chan Change
+}
+
+// Watch subscribes to changes of every key starting with prefix. An empty
+// prefix watches the whole database. It fails with ErrClosed after Close and
+// ErrTimeout when the message loop doesn't answer in time.
+func (d *Database) Watch(prefix string) (*Watcher, error) {
+	return d.WatchWithOptions(prefix, WatchOptions{})
+}
+
+// WatchWithOptions is Watch with extra conditions on the changes delivered.
+// It fails on a malformed Pattern or unknown Filter.
+func (d *Database) WatchWithOptions(prefix string, options WatchOptions) (*Watcher, error) {
+	if _, err := path.Match(options.Pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var filter func(Change) bool
+	if options.Filter != "" {
+		var ok bool
+		if filter, ok = d.options.WatchFilters[options.Filter]; !ok {
+			return nil, ErrUnknownWatchFilter
+		}
+	}
+
+	out := make(chan Change)
+	w := &Watcher{
+		Changes: out,
+		db:      d,
+		prefix:  prefix,
+		options: options,
+		filter:  filter,
+		in:      make(chan Change),
+		out:     out,
+	}
+
+	m := dbMessageWatch{watcher: w, doneChan: make(chan struct{})}
+	if _, err := call(d, newWatchMessage(&m), m.doneChan); err != nil {
+		// After a timeout the loop may still register w, so queue the
+		// unwatch behind it to stop its pump.
+		go w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// wants reports whether change passes all of the watcher's conditions.
+func (w *Watcher) wants(change Change) bool {
+	if !strings.HasPrefix(change.Key, w.prefix) {
+		return false
+	}
+	if w.options.RemoteOnly && !change.Remote {
+		return false
+	}
+	if w.options.Pattern != "" {
+		if ok, _ := path.Match(w.options.Pattern, change.Key); !ok {
+			return false
+		}
+	}
+	return w.filter == nil || w.filter(change)
+}
+
+// Close unsubscribes the watcher and closes its Changes channel. Changes that
+// are still queued are discarded.
+func (w *Watcher) Close() {
+	m := dbMessageWatch{watcher: w, doneChan: make(chan struct{})}
+	wait(w.db, newUnwatchMessage(&m), m.doneChan)
+}
+
+// pump moves changes from the message loop to the reader, queueing as many as
+// needed so that a slow reader never blocks the message loop.
+func (w *Watcher) pump(out chan Change) {
+	var queue []Change
+	for {
+		var send chan Change
+		var next Change
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case change, ok := <-w.in:
+			if !ok {
+				close(out)
+				return
+			}
+			queue = append(queue, change)
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+// notify hands change to every watcher whose prefix matches. Only called from
+// the message loop.
+func (d *Database) notify(change Change) {
+	for _, w := range d.watchers {
+		if w.wants(change) {
+			w.in <- change
+		}
+	}
+}
+
+// addWatcher registers w and starts its pump. Only called from the message
+// loop. The pump starts here rather than in WatchWithOptions so that a watch
+// which fails leaves nothing running.
+func (d *Database) addWatcher(w *Watcher) {
+	w.id = d.nextWatcherID
+	d.nextWatcherID++
+	d.watchers[w.id] = w
+	go w.pump(w.out)
+}
+
+// removeWatcher forgets w and stops its pump. Only called from the message
+// loop. Closing an already closed or never registered watcher is a no-op.
+func (d *Database) removeWatcher(w *Watcher) {
+	if d.watchers[w.id] == w {
+		delete(d.watchers, w.id)
+		close(w.in)
+	}
+}
+
+// OrderFilter remembers the newest token seen per key so that consumers who
+// relay changes over something that may reorder or repeat them can discard
+// anything stale. It is not safe for concurrent use.
+type OrderFilter struct {
+	last map[string]CausalToken
+}
+
+// NewOrderFilter is ctor for OrderFilter.
+func NewOrderFilter() *OrderFilter {
+	return &OrderFilter{last: make(map[string]CausalToken)}
+}
+
+// Accept reports whether token is newer than anything seen so far for key and
+// if so remembers it.
+func (f *OrderFilter) Accept(key string, token CausalToken) bool {
+	if last, ok := f.last[key]; ok && !token.Supersedes(last) {
+		return false
+	}
+	f.last[key] = token
+	return true
+}
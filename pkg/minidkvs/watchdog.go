@@ -0,0 +1,98 @@
+package minidkvs
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Stall describes an operation that has held the message loop for longer than
+// Options.StallTimeout. Nothing else can run until it finishes.
+type Stall struct {
+	Op       string
+	Key      string
+	Duration time.Duration
+	// Stack holds the stacks of every goroutine, since the message loop's
+	// own can't be picked out.
+	Stack []byte
+}
+
+// minWatchdogTick is the shortest interval the watchdog checks the loop at,
+// however small StallTimeout is.
+const minWatchdogTick = time.Millisecond
+
+// loopActivity records what the message loop is doing for the watchdog.
+type loopActivity struct {
+	mu    sync.Mutex
+	msg   dbMessage
+	start time.Time
+	busy  bool
+	// seq identifies each operation so that a stall is reported once.
+	seq uint64
+}
+
+func (a *loopActivity) begin(msg dbMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.msg = msg
+	a.start = time.Now()
+	a.busy = true
+	a.seq++
+}
+
+func (a *loopActivity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.busy = false
+}
+
+// watchdog reports to Options.OnStall whenever one operation holds the
+// message loop for longer than Options.StallTimeout, until the database
+// closes.
+func (d *Database) watchdog() {
+	timeout := d.options.StallTimeout
+	tick := timeout / 4
+	if tick < minWatchdogTick {
+		tick = minWatchdogTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var reported uint64
+	for {
+		select {
+		case <-d.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		d.activity.mu.Lock()
+		msg, start, busy, seq := d.activity.msg, d.activity.start, d.activity.busy, d.activity.seq
+		d.activity.mu.Unlock()
+
+		elapsed := time.Since(start)
+		if !busy || seq == reported || elapsed < timeout {
+			continue
+		}
+		reported = seq
+		d.options.OnStall(Stall{
+			Op:       msg.msgType.String(),
+			Key:      msg.key(),
+			Duration: elapsed,
+			Stack:    allStacks(),
+		})
+	}
+}
+
+// allStacks returns runtime.Stack for every goroutine, growing the buffer
+// until it fits.
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,58 @@
+package minidkvs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStallWatchdog(t *testing.T) {
+	storage := &hangingStorage{MemoryStorage: mustMemoryStorage(t), release: make(chan struct{})}
+	stalls := make(chan Stall, 10)
+	db, err := NewDatabaseWithOptions(storage, Options{
+		OperationTimeout: 10 * time.Millisecond,
+		StallTimeout:     20 * time.Millisecond,
+		OnStall:          func(stall Stall) { stalls <- stall },
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	db.Get("stuck")
+
+	select {
+	case stall := <-stalls:
+		if stall.Op != "get" || stall.Key != "stuck" {
+			t.Errorf("Unexpected stall %+v", stall)
+		}
+		if !bytes.Contains(stall.Stack, []byte("hangingStorage")) {
+			t.Error("Stall should include the stuck goroutine's stack")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a stall report")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(stalls) != 0 {
+		t.Error("A stall should be reported once")
+	}
+	close(storage.release)
+}
+
+func TestStallWatchdogTinyTimeout(t *testing.T) {
+	db, err := NewDatabaseWithOptions(mustMemoryStorage(t), Options{
+		StallTimeout: time.Nanosecond,
+		OnStall:      func(Stall) {},
+	})
+	if err != nil {
+		t.Fatal("Failed to create database")
+	}
+	defer db.Close()
+
+	if err := db.Set("k", []byte{1}); err != nil {
+		t.Error("Database should work with a tiny StallTimeout")
+	}
+	// Give the watchdog time to start its ticker.
+	time.Sleep(10 * time.Millisecond)
+}